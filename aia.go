@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// caKeyID returns the hex subject key identifier of a CA certificate, which
+// names its published DER file. Certificates without one use the SHA-1 hash
+// of the public key, as in RFC 5280 section 4.2.1.2.
+func caKeyID(cert *x509.Certificate) string {
+	if len(cert.SubjectKeyId) > 0 {
+		return hex.EncodeToString(cert.SubjectKeyId)
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		sum := sha1.Sum(cert.RawSubjectPublicKeyInfo)
+		return hex.EncodeToString(sum[:])
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// caIssuersURL returns the URL of the issuer certificate for the Authority
+// Information Access extension, or nil if ca_issuers_url is not configured.
+// The URL names the issuer by key, so it stays valid after rotations.
+func caIssuersURL(issuer *x509.Certificate, cfg *Config) []string {
+	if cfg.CAIssuersURL == "" {
+		return nil
+	}
+	return []string{strings.TrimSuffix(cfg.CAIssuersURL, "/") + "/" + caKeyID(issuer) + ".cer"}
+}
+
+// exportIssuerCertificates writes every CA certificate of the selected CA,
+// including archived ones, to dir as <key id>.cer in DER, matching the URLs
+// from caIssuersURL. It returns the names of the written files.
+func exportIssuerCertificates(dir string) ([]string, error) {
+	caDir, err := getCertyDir()
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect CA certificates, preferring self-signed roots over cross
+	// certificates and skipping CAs cross-signed by the previous root
+	certs := map[string]*x509.Certificate{}
+	err = filepath.WalkDir(caDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != caDir && d.Name() == casDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if !strings.HasSuffix(name, ".pem") || strings.HasSuffix(name, "-key.pem") || strings.Contains(name, "-fullchain") || strings.HasSuffix(name, crossSuffix+".pem") {
+			return nil
+		}
+
+		cert := readCACertificateFile(path)
+		if cert == nil {
+			return nil
+		}
+		id := caKeyID(cert)
+		if existing, ok := certs[id]; ok && (isSelfSigned(existing) || !isSelfSigned(cert)) {
+			return nil
+		}
+		certs[id] = cert
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	var files []string
+	for id, cert := range certs {
+		name := id + ".cer"
+		if err := os.WriteFile(filepath.Join(dir, name), cert.Raw, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readCACertificateFile returns the CA certificate in a PEM file, or nil if
+// the file does not start with a CA certificate
+func readCACertificateFile(path string) *x509.Certificate {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || !cert.IsCA {
+		return nil
+	}
+	return cert
+}
+
+// isSelfSigned reports whether a certificate is issued by its own subject
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCAIssuersURL(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure the issuer URL before installing
+	cfg := DefaultConfig()
+	cfg.CAIssuersURL = "http://pki.example.com/certs/"
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	// The intermediate points to the root
+	wantRootURL := "http://pki.example.com/certs/" + caKeyID(rootCert) + ".cer"
+	if !slices.Equal(intCert.IssuingCertificateURL, []string{wantRootURL}) {
+		t.Errorf("Expected intermediate AIA %q, got %v", wantRootURL, intCert.IssuingCertificateURL)
+	}
+
+	// Leaves point to the intermediate
+	leaf := issueTestLeaf(t, tmpDir, "leaf", cfg)
+	wantIntURL := "http://pki.example.com/certs/" + caKeyID(intCert) + ".cer"
+	if !slices.Equal(leaf.IssuingCertificateURL, []string{wantIntURL}) {
+		t.Errorf("Expected leaf AIA %q, got %v", wantIntURL, leaf.IssuingCertificateURL)
+	}
+
+	// After rotation, the export serves both intermediates under their own URLs
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	newIntCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	exportDir := filepath.Join(t.TempDir(), "pki")
+	files, err := exportIssuerCertificates(exportDir)
+	if err != nil {
+		t.Fatalf("Failed to export issuer certificates: %v", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expected 3 exported certificates, got %v", files)
+	}
+	for _, cert := range []*x509.Certificate{rootCert, intCert, newIntCert} {
+		data, err := os.ReadFile(filepath.Join(exportDir, caKeyID(cert)+".cer"))
+		if err != nil {
+			t.Errorf("Expected %s to be exported: %v", cert.Subject.CommonName, err)
+			continue
+		}
+		if !bytes.Equal(data, cert.Raw) {
+			t.Errorf("Expected DER of %s in the export", cert.Subject.CommonName)
+		}
+	}
+}
+
+func TestExportIssuersPrefersSelfSignedRoots(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA and roll over the root, creating cross certificates
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	if _, err := rolloverRoot(); err != nil {
+		t.Fatalf("Failed to roll over root CA: %v", err)
+	}
+
+	exportDir := t.TempDir()
+	if _, err := exportIssuerCertificates(exportDir); err != nil {
+		t.Fatalf("Failed to export issuer certificates: %v", err)
+	}
+
+	// Cross certificates share the key ID of a root but never replace it
+	for _, name := range []string{"rootCA", "rootCA-previous"} {
+		root, err := loadCACertificate(name)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+		data, err := os.ReadFile(filepath.Join(exportDir, caKeyID(root)+".cer"))
+		if err != nil {
+			t.Fatalf("Expected %s to be exported: %v", name, err)
+		}
+		if !bytes.Equal(data, root.Raw) {
+			t.Errorf("Expected the self-signed %s in the export", name)
+		}
+	}
+}
+
+func TestValidateCAIssuersURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"", false},
+		{"http://pki.example.com/certs", false},
+		{"https://pki.example.com", false},
+		{"ftp://pki.example.com", true},
+		{"pki.example.com/certs", true},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.CAIssuersURL = tt.url
+		err := validateConfig(cfg)
+		if tt.wantErr && err == nil {
+			t.Errorf("Expected validation error for %q", tt.url)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("Expected %q to be valid, got %v", tt.url, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archiveDirName is the subdirectory of the certy directory holding archived CA material
+const archiveDirName = "archive"
+
+// newArchiveDir creates a timestamped directory archive/<prefix>-<timestamp>
+// and returns its path relative to the certy directory. A numeric suffix is
+// added if an archive with the same timestamp already exists.
+func newArchiveDir(prefix string) (string, error) {
+	dir, err := getCertyDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, archiveDirName), 0700); err != nil {
+		return "", fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	base := filepath.Join(archiveDirName, prefix+"-"+time.Now().UTC().Format("20060102T150405Z"))
+	name := base
+	for i := 2; ; i++ {
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err == nil {
+			return name, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("failed to create archive directory: %w", err)
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// archiveCAFiles copies the named files from the certy directory into
+// archiveName, skipping files that do not exist
+func archiveCAFiles(archiveName string, files ...string) error {
+	for _, file := range files {
+		srcPath, err := getCAFilePath(file)
+		if err != nil {
+			return err
+		}
+		dstPath, err := getCAFilePath(filepath.Join(archiveName, file))
+		if err != nil {
+			return err
+		}
+
+		if err := copyFile(srcPath, dstPath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to archive %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst, preserving the file mode
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// snapshotCADir copies the whole CA directory, except existing archives and
+// named CAs stored below it, into archiveName
+func snapshotCADir(archiveName string) error {
+	dir, err := getCertyDir()
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, archiveName)
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if (rel == archiveDirName || rel == casDirName) && d.IsDir() {
+			return filepath.SkipDir
+		}
+
+		target := filepath.Join(dst, rel)
+		switch {
+		case rel == ".":
+			return nil
+		case d.IsDir():
+			return os.MkdirAll(target, 0700)
+		case d.Type().IsRegular():
+			if err := copyFile(path, target); err != nil {
+				return fmt.Errorf("failed to snapshot %s: %w", rel, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewArchiveDir(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	first, err := newArchiveDir("test")
+	if err != nil {
+		t.Fatalf("Failed to create archive directory: %v", err)
+	}
+	second, err := newArchiveDir("test")
+	if err != nil {
+		t.Fatalf("Failed to create second archive directory: %v", err)
+	}
+	if first == second {
+		t.Errorf("Expected unique archive directories, both were %q", first)
+	}
+
+	info, err := os.Stat(filepath.Join(tmpDir, first))
+	if err != nil {
+		t.Fatalf("Archive directory not created: %v", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("Expected archive permissions 0700, got %o", info.Mode().Perm())
+	}
+}
+
+func TestArchiveCAFiles(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "secret.pem"), []byte("key"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	archiveName, err := newArchiveDir("test")
+	if err != nil {
+		t.Fatalf("Failed to create archive directory: %v", err)
+	}
+
+	// Missing files are skipped
+	if err := archiveCAFiles(archiveName, "secret.pem", "missing.pem"); err != nil {
+		t.Fatalf("Failed to archive files: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(tmpDir, archiveName, "secret.pem"))
+	if err != nil {
+		t.Fatalf("File not archived: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected archived file permissions 0600, got %o", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "secret.pem")); err != nil {
+		t.Error("Original file should remain in place")
+	}
+}
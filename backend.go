@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// KeyBackend stores CA private keys and provides signers for them.
+// Keys are addressed by their CA base name (e.g. "rootCA", "intermediateCA"),
+// so issuance code never needs to know where or how a key is held.
+type KeyBackend interface {
+	// CreateKey generates and stores a new key, returning a signer for it
+	CreateKey(name, keyType string, keySize int) (crypto.Signer, error)
+	// Signer returns a signer for an existing key
+	Signer(name string) (crypto.Signer, error)
+	// HasKey reports whether a key with the given name exists
+	HasKey(name string) (bool, error)
+	// ArchiveKey moves an existing key to archiveName so that name can be reused
+	ArchiveKey(name, archiveName string) error
+	// ImportKey stores an externally generated key under name
+	ImportKey(name string, key crypto.Signer) error
+	// CanImport reports whether ImportKey is supported
+	CanImport() bool
+}
+
+// newKeyBackend returns the key backend selected by the configuration
+func newKeyBackend(cfg *Config) (KeyBackend, error) {
+	switch cfg.KeyBackend {
+	case "", "file":
+		return &fileBackend{encrypt: cfg.EncryptCAKeys}, nil
+	case "pkcs11":
+		return newPKCS11Backend(cfg.PKCS11)
+	default:
+		return nil, fmt.Errorf("unsupported key backend: %s", cfg.KeyBackend)
+	}
+}
+
+// fileBackend keeps CA keys as PEM files in the certy directory
+type fileBackend struct {
+	encrypt bool // encrypt new keys with the CA passphrase
+}
+
+// CreateKey generates a key and writes it to <name>-key.pem
+func (b *fileBackend) CreateKey(name, keyType string, keySize int) (crypto.Signer, error) {
+	key, err := generatePrivateKey(keyType, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	var passphrase []byte
+	if b.encrypt {
+		passphrase, err = caPassphrase.get(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := saveCAKey(key, name, passphrase); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ImportKey writes an existing key to <name>-key.pem
+func (b *fileBackend) ImportKey(name string, key crypto.Signer) error {
+	var passphrase []byte
+	if b.encrypt {
+		var err error
+		passphrase, err = caPassphrase.get(true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return saveCAKey(key, name, passphrase)
+}
+
+// CanImport reports that file keys can always be imported
+func (b *fileBackend) CanImport() bool {
+	return true
+}
+
+// Signer loads <name>-key.pem, decrypting it if necessary
+func (b *fileBackend) Signer(name string) (crypto.Signer, error) {
+	keyPath, err := getCAFilePath(name + "-key.pem")
+	if err != nil {
+		return nil, err
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s key: %w", name, err)
+	}
+
+	keyBlock, _ := pem.Decode(keyData)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("failed to decode %s key PEM", name)
+	}
+
+	privateKey, err := loadPrivateKeyPEM(keyBlock, caPassphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s key: %w", name, err)
+	}
+
+	return privateKey, nil
+}
+
+// HasKey reports whether <name>-key.pem exists
+func (b *fileBackend) HasKey(name string) (bool, error) {
+	keyPath, err := getCAFilePath(name + "-key.pem")
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check %s key: %w", name, err)
+	}
+	return true, nil
+}
+
+// ArchiveKey moves <name>-key.pem to <archiveName>-key.pem
+func (b *fileBackend) ArchiveKey(name, archiveName string) error {
+	keyPath, err := getCAFilePath(name + "-key.pem")
+	if err != nil {
+		return err
+	}
+	archivePath, err := getCAFilePath(archiveName + "-key.pem")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(keyPath, archivePath); err != nil {
+		return fmt.Errorf("failed to archive %s key: %w", name, err)
+	}
+	return nil
+}
+
+// encryptExistingCAKeys encrypts the unencrypted CA keys in the certy
+// directory with the CA passphrase, returning the names of the keys it
+// encrypted. All keys are read and re-encrypted to staged files before any
+// key file is replaced.
+func encryptExistingCAKeys() ([]string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.KeyBackend == "pkcs11" {
+		return nil, fmt.Errorf("CA keys on a PKCS#11 token are protected by the token and cannot be encrypted")
+	}
+	if !cfg.EncryptCAKeys {
+		return nil, fmt.Errorf("set encrypt_ca_keys: true in config.yml first, so that new CA keys are encrypted as well")
+	}
+
+	backend := &fileBackend{encrypt: true}
+	passphrase, err := caPassphrase.get(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load every key, checking that already encrypted keys use the same passphrase
+	var names []string
+	keys := make(map[string]crypto.Signer)
+	for _, name := range caKeyNames(cfg) {
+		has, err := backend.HasKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			continue
+		}
+		key, err := backend.Signer(name)
+		if err != nil {
+			return nil, err
+		}
+		encrypted, err := caKeyEncrypted(name)
+		if err != nil {
+			return nil, err
+		}
+		if !encrypted {
+			names = append(names, name)
+			keys[name] = key
+		}
+	}
+
+	// Write the encrypted keys next to the originals, then replace them
+	var staged []string
+	discard := func() {
+		for _, name := range staged {
+			removeCAFile(name)
+		}
+	}
+	for _, name := range names {
+		if err := saveCAKey(keys[name], name+stagedSuffix, passphrase); err != nil {
+			discard()
+			return nil, err
+		}
+		staged = append(staged, name+stagedSuffix+"-key.pem")
+	}
+	for _, name := range names {
+		if err := renameCAFile(name+stagedSuffix+"-key.pem", name+"-key.pem"); err != nil {
+			discard()
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
+
+// caKeyEncrypted reports whether <name>-key.pem holds an encrypted key
+func caKeyEncrypted(name string) (bool, error) {
+	keyPath, err := getCAFilePath(name + "-key.pem")
+	if err != nil {
+		return false, err
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s key: %w", name, err)
+	}
+
+	keyBlock, _ := pem.Decode(keyData)
+	if keyBlock == nil {
+		return false, fmt.Errorf("failed to decode %s key PEM", name)
+	}
+	return keyBlock.Type == "ENCRYPTED PRIVATE KEY", nil
+}
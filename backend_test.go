@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewKeyBackend(t *testing.T) {
+	cfg := DefaultConfig()
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := backend.(*fileBackend); !ok {
+		t.Errorf("Expected file backend, got %T", backend)
+	}
+
+	cfg.KeyBackend = "unknown"
+	if _, err := newKeyBackend(cfg); err == nil {
+		t.Error("Expected error for unknown key backend")
+	}
+
+	// Without PKCS#11 support or a usable module the backend must fail cleanly
+	cfg.KeyBackend = "pkcs11"
+	cfg.PKCS11 = PKCS11Config{Module: filepath.Join(t.TempDir(), "missing.so"), TokenLabel: "certy"}
+	t.Setenv("CERTY_PKCS11_PIN", "1234")
+	if _, err := newKeyBackend(cfg); err == nil {
+		t.Error("Expected error for unavailable PKCS#11 module")
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	backend := &fileBackend{}
+
+	if has, err := backend.HasKey("testCA"); err != nil || has {
+		t.Errorf("Key should not exist before creation (err: %v)", err)
+	}
+
+	key, err := backend.CreateKey("testCA", "ecdsa", 256)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	if has, err := backend.HasKey("testCA"); err != nil || !has {
+		t.Errorf("Key should exist after creation (err: %v)", err)
+	}
+
+	// Verify key file permissions
+	info, err := os.Stat(filepath.Join(tmpDir, "testCA-key.pem"))
+	if err != nil {
+		t.Fatalf("Failed to stat key file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected key file permissions 0600, got %v", info.Mode().Perm())
+	}
+
+	// Verify the signer matches the created key
+	signer, err := backend.Signer("testCA")
+	if err != nil {
+		t.Fatalf("Failed to load signer: %v", err)
+	}
+	if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+		t.Error("Loaded signer does not match created key")
+	}
+
+	if _, err := backend.Signer("missingCA"); err == nil {
+		t.Error("Expected error loading a missing key")
+	}
+
+	// A key that cannot be checked is reported as an error, not as missing
+	if _, err := backend.HasKey(filepath.Join("testCA-key.pem", "nestedCA")); err == nil {
+		t.Error("Expected error checking a key below a regular file")
+	}
+}
+
+func TestFileBackendEncrypted(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+	t.Setenv("CERTY_CA_PASSPHRASE", "backend-secret")
+
+	backend := &fileBackend{encrypt: true}
+	if _, err := backend.CreateKey("testCA", "ed25519", 0); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	keyData, err := os.ReadFile(filepath.Join(tmpDir, "testCA-key.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	if block, _ := pem.Decode(keyData); block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		t.Fatal("Expected ENCRYPTED PRIVATE KEY block")
+	}
+
+	if _, err := backend.Signer("testCA"); err != nil {
+		t.Errorf("Failed to load encrypted signer: %v", err)
+	}
+}
+
+func TestEncryptExistingCAKeys(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// New installs encrypt CA keys by default
+	if !DefaultConfig().EncryptCAKeys {
+		t.Error("Expected encrypt_ca_keys to default to true")
+	}
+
+	// Install with unencrypted keys, as older installs did
+	cfg := DefaultConfig()
+	cfg.EncryptCAKeys = false
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// The migration requires encrypt_ca_keys so new keys are encrypted too
+	if _, err := encryptExistingCAKeys(); err == nil {
+		t.Error("Expected error while encrypt_ca_keys is false")
+	}
+	cfg.EncryptCAKeys = true
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	names, err := encryptExistingCAKeys()
+	if err != nil {
+		t.Fatalf("Failed to encrypt CA keys: %v", err)
+	}
+	if len(names) != 2 || names[0] != "rootCA" || names[1] != "intermediateCA" {
+		t.Errorf("Expected rootCA and intermediateCA to be encrypted, got %v", names)
+	}
+	for _, file := range []string{"rootCA-key.pem", "intermediateCA-key.pem"} {
+		keyData, err := os.ReadFile(filepath.Join(tmpDir, file))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		block, _ := pem.Decode(keyData)
+		if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+			t.Errorf("Expected ENCRYPTED PRIVATE KEY in %s", file)
+		}
+	}
+	staged, _ := filepath.Glob(filepath.Join(tmpDir, "*"+stagedSuffix+"*"))
+	if len(staged) > 0 {
+		t.Errorf("Expected no staged files, found %v", staged)
+	}
+	if _, _, err := loadIntermediateCA(); err != nil {
+		t.Fatalf("Failed to load encrypted intermediate CA: %v", err)
+	}
+
+	// Running it again changes nothing
+	names, err = encryptExistingCAKeys()
+	if err != nil {
+		t.Fatalf("Failed to encrypt CA keys again: %v", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("Expected no keys to encrypt, got %v", names)
+	}
+
+	// Keys encrypted with another passphrase are rejected
+	t.Setenv("CERTY_CA_PASSPHRASE", "wrong")
+	if _, err := encryptExistingCAKeys(); err == nil {
+		t.Error("Expected error with a different CA passphrase")
+	}
+}
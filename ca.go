@@ -1,158 +1,471 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"math/big"
 	"os"
+	"slices"
 	"time"
 )
 
 // installCA creates the root CA and intermediate CA infrastructure
 func installCA() error {
-	// Ensure certy directory exists
-	dir, err := getCertyDir()
+	cfg, err := initCertyDir()
 	if err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create certy directory: %w", err)
+	// Build CA subjects, with a per-install suffix if configured
+	suffix := ""
+	if cfg.CA.UniqueSuffix {
+		suffix, err = newCASuffix()
+		if err != nil {
+			return err
+		}
 	}
+	rootSubject := cfg.CA.Root.pkixName(defaultRootCN, suffix)
+	intSubject := cfg.CA.Intermediate.pkixName(defaultIntermediateCN, suffix)
 
-	// Load existing config if present, otherwise use defaults
-	cfg, err := loadConfig()
+	// Select where CA keys are kept
+	backend, err := newKeyBackend(cfg)
 	if err != nil {
-		// If config doesn't exist, use defaults
-		cfg = DefaultConfig()
-	}
-
-	// Save config to ensure it exists
-	if err := saveConfig(cfg); err != nil {
-		return fmt.Errorf("failed to save config: %w", err)
+		return err
 	}
 
 	// Generate root CA
 	fmt.Println("Generating root CA...")
-	rootKey, rootCert, err := generateRootCA(cfg)
+	rootKey, err := backend.CreateKey("rootCA", cfg.DefaultKeyType, cfg.DefaultKeySize)
+	if err != nil {
+		return fmt.Errorf("failed to generate root CA key: %w", err)
+	}
+	rootCert, err := signRootCA(rootKey, rootSubject, rootMaxPathLen+hierarchyPathLen(cfg), cfg)
 	if err != nil {
 		return fmt.Errorf("failed to generate root CA: %w", err)
 	}
 
 	// Save root CA
-	if err := saveKeyAndCert(rootKey, rootCert, "rootCA"); err != nil {
+	if err := saveCACertificate(rootCert, "rootCA"); err != nil {
 		return fmt.Errorf("failed to save root CA: %w", err)
 	}
 
+	// Generate the CA tiers between the root and the intermediates
+	parentKey, parentCert, err := createHierarchy(backend, rootKey, rootCert, suffix, cfg)
+	if err != nil {
+		return err
+	}
+
 	// Generate intermediate CA
 	fmt.Println("Generating intermediate CA...")
-	intKey, intCert, err := generateIntermediateCA(rootKey, rootCert, cfg)
+	intKey, err := backend.CreateKey("intermediateCA", cfg.DefaultKeyType, cfg.DefaultKeySize)
+	if err != nil {
+		return fmt.Errorf("failed to generate intermediate CA key: %w", err)
+	}
+	intCert, err := signIntermediateCA(intKey.Public(), intSubject, nil, parentKey, parentCert, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to generate intermediate CA: %w", err)
 	}
 
 	// Save intermediate CA
-	if err := saveKeyAndCert(intKey, intCert, "intermediateCA"); err != nil {
+	if err := saveCACertificate(intCert, "intermediateCA"); err != nil {
 		return fmt.Errorf("failed to save intermediate CA: %w", err)
 	}
 
-	// Save intermediate CA fullchain (intermediate + root)
-	if err := saveFullChain(intCert, rootCert); err != nil {
+	// Save intermediate CA fullchain (intermediate + tiers + root)
+	if err := saveChainBundles("intermediateCA", intCert); err != nil {
 		return fmt.Errorf("failed to save intermediate CA fullchain: %w", err)
 	}
 
-	// Initialize serial number file
-	serialPath, err := getCAFilePath("serial.txt")
+	// Generate purpose-specific issuers
+	for _, ic := range cfg.CA.Issuers {
+		fmt.Printf("Generating %s issuer...\n", ic.Name)
+		if err := createIssuer(ic, backend, parentKey, parentCert, suffix, cfg); err != nil {
+			return err
+		}
+	}
+
+	// Initialize serial number file, never going below already issued serials
+	if err := initSerialNumber(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+)
+
+// rootMaxPathLen allows one intermediate CA below a root created by -install,
+// plus the path length of the configured hierarchy tiers
+const rootMaxPathLen = 1
+
+// Default CA common names, used when the configuration leaves them empty
+const (
+	defaultRootCN         = "Certy Root CA"
+	defaultIntermediateCN = "Certy Intermediate CA"
+)
+
+// initCertyDir ensures the certy directory and its config file exist and
+// returns the configuration
+func initCertyDir() (*Config, error) {
+	// Ensure certy directory exists
+	dir, err := getCertyDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create certy directory: %w", err)
+	}
+
+	// Load existing config if present, otherwise use defaults
+	cfg, err := loadConfig()
+	if err != nil {
+		// If config doesn't exist, use defaults
+		cfg = DefaultConfig()
+	}
+
+	// Save config to ensure it exists
+	if err := saveConfig(cfg); err != nil {
+		return nil, fmt.Errorf("failed to save config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// installPendingIntermediate generates the intermediate CA key and writes a
+// PKCS#10 request to intermediateCA.csr for signing by an external root. The
+// CA stays pending until finishIntermediateCA ingests the signed certificate.
+// It returns the path of the CSR.
+func installPendingIntermediate() (string, error) {
+	cfg, err := initCertyDir()
+	if err != nil {
+		return "", err
+	}
+	if len(cfg.CA.Hierarchy) > 0 {
+		return "", fmt.Errorf("ca.hierarchy cannot be used with -external-root; the external root provides the upper tiers")
+	}
+
+	suffix := ""
+	if cfg.CA.UniqueSuffix {
+		suffix, err = newCASuffix()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate intermediate CA key
+	fmt.Println("Generating intermediate CA key...")
+	intKey, err := backend.CreateKey("intermediateCA", cfg.DefaultKeyType, cfg.DefaultKeySize)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate intermediate CA key: %w", err)
+	}
+
+	// Create and save the CSR
+	csrDER, err := createIntermediateCSR(intKey, cfg.CA.Intermediate.pkixName(defaultIntermediateCN, suffix))
+	if err != nil {
+		return "", err
+	}
+	csrPath, err := getCAFilePath("intermediateCA.csr")
+	if err != nil {
+		return "", err
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	if err := os.WriteFile(csrPath, csrPEM, 0644); err != nil {
+		return "", fmt.Errorf("failed to write intermediate CA CSR: %w", err)
+	}
+
+	return csrPath, nil
+}
+
+// createIntermediateCSR creates a CSR for an intermediate CA. The request
+// asks for the same CA extensions signIntermediateCA would set.
+func createIntermediateCSR(key crypto.Signer, subject pkix.Name) ([]byte, error) {
+	basicConstraints, err := asn1.Marshal(struct {
+		IsCA       bool `asn1:"optional"`
+		MaxPathLen int  `asn1:"optional,default:-1"`
+	}{IsCA: true, MaxPathLen: 0})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode basic constraints: %w", err)
+	}
+
+	// keyCertSign (bit 5) and cRLSign (bit 6)
+	keyUsage, err := asn1.Marshal(asn1.BitString{Bytes: []byte{0x06}, BitLength: 7})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key usage: %w", err)
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: subject,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidExtensionBasicConstraints, Critical: true, Value: basicConstraints},
+			{Id: oidExtensionKeyUsage, Critical: true, Value: keyUsage},
+		},
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create intermediate CA CSR: %w", err)
+	}
+	return csrDER, nil
+}
+
+// finishIntermediateCA completes a pending install with the intermediate
+// certificate signed by the external root. rootFile may be empty if certFile
+// also contains the root certificate.
+func finishIntermediateCA(certFile, rootFile string) error {
+	if caStatus() != CAPending {
+		return fmt.Errorf("no pending intermediate CA; run 'certy -install -external-root' first")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	backend, err := newKeyBackend(cfg)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(serialPath, []byte("1"), 0644); err != nil {
-		return fmt.Errorf("failed to initialize serial file: %w", err)
+	intKey, err := backend.Signer("intermediateCA")
+	if err != nil {
+		return err
+	}
+
+	// Find the signed intermediate and its root
+	certs, _, err := readImportFile(certFile)
+	if err != nil {
+		return err
+	}
+	intCert := findCertificateForKey(certs, intKey)
+	if intCert == nil {
+		return fmt.Errorf("%s does not contain a certificate for the pending intermediate CA key", certFile)
+	}
+	rootCerts := certs
+	if rootFile != "" {
+		if rootCerts, _, err = readImportFile(rootFile); err != nil {
+			return err
+		}
+	}
+	rootCert := findIssuer(rootCerts, intCert)
+	if rootCert == nil {
+		return fmt.Errorf("no root CA certificate that signed the intermediate was found (use -import-root)")
+	}
+	if err := validateImportedChain(rootCert, intCert); err != nil {
+		return err
+	}
+
+	// Save certificates and leave the pending state
+	if err := saveCACertificate(rootCert, "rootCA"); err != nil {
+		return fmt.Errorf("failed to save root CA: %w", err)
+	}
+	if err := saveCACertificate(intCert, "intermediateCA"); err != nil {
+		return fmt.Errorf("failed to save intermediate CA: %w", err)
+	}
+	if err := saveFullChain("intermediateCA", intCert, rootCert); err != nil {
+		return fmt.Errorf("failed to save intermediate CA fullchain: %w", err)
+	}
+	if err := initSerialNumber(); err != nil {
+		return err
+	}
+
+	csrPath, err := getCAFilePath("intermediateCA.csr")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(csrPath); err != nil {
+		return fmt.Errorf("failed to remove intermediate CA CSR: %w", err)
 	}
 
 	return nil
 }
 
-// generateRootCA generates a self-signed root CA certificate
-func generateRootCA(cfg *Config) (*rsa.PrivateKey, *x509.Certificate, error) {
+// caSuffixLength is the length of the random suffix appended to CA common names
+const caSuffixLength = 8
+
+// newCASuffix returns a random hex suffix that makes CA names unique per install
+func newCASuffix() (string, error) {
+	b := make([]byte, caSuffixLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate CA name suffix: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// pkixName converts a subject configuration into a distinguished name.
+// An empty common name falls back to defaultCN, and suffix is appended to
+// the common name when it is not empty.
+func (s SubjectConfig) pkixName(defaultCN, suffix string) pkix.Name {
+	name := pkix.Name{CommonName: s.CommonName}
+	if name.CommonName == "" {
+		name.CommonName = defaultCN
+	}
+	if suffix != "" {
+		name.CommonName += " " + suffix
+	}
+	s.applyTo(&name, true)
+	return name
+}
+
+// applyTo sets the subject attributes other than the common name on name.
+// Attributes name already has are only replaced when override is set.
+func (s SubjectConfig) applyTo(name *pkix.Name, override bool) {
+	set := func(field *[]string, value string) {
+		if value != "" && (override || len(*field) == 0) {
+			*field = []string{value}
+		}
+	}
+	set(&name.Organization, s.Organization)
+	set(&name.OrganizationalUnit, s.OrganizationalUnit)
+	set(&name.Country, s.Country)
+	set(&name.Province, s.Province)
+	set(&name.Locality, s.Locality)
+	if s.SerialNumber != "" && (override || name.SerialNumber == "") {
+		name.SerialNumber = s.SerialNumber
+	}
+
+	// Add the attributes given by OID
+	for _, attr := range s.Attributes {
+		oid, err := parseOID(attr.OID)
+		if err != nil {
+			continue
+		}
+		i := slices.IndexFunc(name.ExtraNames, func(a pkix.AttributeTypeAndValue) bool { return a.Type.Equal(oid) })
+		switch {
+		case i < 0:
+			name.ExtraNames = append(name.ExtraNames, pkix.AttributeTypeAndValue{Type: oid, Value: attr.Value})
+		case override:
+			name.ExtraNames[i].Value = attr.Value
+		}
+	}
+}
+
+// generateRootCA generates an in-memory key and a self-signed root CA certificate
+func generateRootCA(cfg *Config) (crypto.Signer, *x509.Certificate, error) {
 	// Generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, cfg.DefaultKeySize)
+	privateKey, err := generatePrivateKey(cfg.DefaultKeyType, cfg.DefaultKeySize)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
+	cert, err := signRootCA(privateKey, cfg.CA.Root.pkixName(defaultRootCN, ""), rootMaxPathLen, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return privateKey, cert, nil
+}
+
+// signRootCA creates a self-signed root CA certificate for the given key.
+// maxPathLen limits the number of CA certificates below the root.
+func signRootCA(privateKey crypto.Signer, subject pkix.Name, maxPathLen int, cfg *Config) (*x509.Certificate, error) {
 	// Create certificate template
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
 	}
 
 	template := &x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName:   "Certy Root CA",
-			Organization: []string{"Certy"},
-		},
+		SerialNumber:          serialNumber,
+		Subject:               subject,
 		NotBefore:             time.Now().AddDate(0, 0, -1),
 		NotAfter:              time.Now().AddDate(0, 0, cfg.RootCAValidityDays),
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		MaxPathLen:            1,
-		MaxPathLenZero:        false,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
 	}
 
 	// Create self-signed certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
 
 	// Parse certificate
 	cert, err := x509.ParseCertificate(certDER)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
-	return privateKey, cert, nil
+	return cert, nil
 }
 
-// generateIntermediateCA generates an intermediate CA certificate signed by the root CA
-func generateIntermediateCA(rootKey *rsa.PrivateKey, rootCert *x509.Certificate, cfg *Config) (*rsa.PrivateKey, *x509.Certificate, error) {
+// generateIntermediateCA generates an in-memory key and an intermediate CA
+// certificate signed by the root CA
+func generateIntermediateCA(rootKey crypto.Signer, rootCert *x509.Certificate, cfg *Config) (crypto.Signer, *x509.Certificate, error) {
 	// Generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, cfg.DefaultKeySize)
+	privateKey, err := generatePrivateKey(cfg.DefaultKeyType, cfg.DefaultKeySize)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
+	cert, err := signIntermediateCA(privateKey.Public(), cfg.CA.Intermediate.pkixName(defaultIntermediateCN, ""), nil, rootKey, rootCert, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return privateKey, cert, nil
+}
+
+// signIntermediateCA creates an intermediate CA certificate for publicKey signed by the
+// root CA or the lowest hierarchy tier. A non-empty extKeyUsage restricts the purposes
+// of the certificates it can issue.
+func signIntermediateCA(publicKey crypto.PublicKey, subject pkix.Name, extKeyUsage []x509.ExtKeyUsage, parentKey crypto.Signer, parentCert *x509.Certificate, cfg *Config) (*x509.Certificate, error) {
+	return signCA(publicKey, subject, cfg.IntCAValidityDays, 0, extKeyUsage, parentKey, parentCert, cfg)
+}
+
+// signCA creates a subordinate CA certificate for publicKey signed by the parent CA.
+// maxPathLen limits the number of CA certificates below it.
+func signCA(publicKey crypto.PublicKey, subject pkix.Name, validityDays, maxPathLen int, extKeyUsage []x509.ExtKeyUsage, parentKey crypto.Signer, parentCert *x509.Certificate, cfg *Config) (*x509.Certificate, error) {
 	// Create certificate template
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	// The CA cannot outlive its parent
+	notAfter := time.Now().AddDate(0, 0, validityDays)
+	if notAfter.After(parentCert.NotAfter) {
+		notAfter = parentCert.NotAfter
 	}
 
 	template := &x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName:   "Certy Intermediate CA",
-			Organization: []string{"Certy"},
-		},
+		SerialNumber:          serialNumber,
+		Subject:               subject,
 		NotBefore:             time.Now().AddDate(0, 0, -1),
-		NotAfter:              time.Now().AddDate(0, 0, cfg.IntCAValidityDays),
+		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		MaxPathLen:            0,
-		MaxPathLenZero:        true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+		ExtKeyUsage:           extKeyUsage,
+	}
+
+	// Restrict the names it may issue for, if configured
+	if err := cfg.CA.NameConstraints.apply(template); err != nil {
+		return nil, err
 	}
 
-	// Add CRL distribution point if configured
-	if cfg.CRLURL != "" {
-		template.CRLDistributionPoints = []string{cfg.CRLURL}
+	// Add the root CRL distribution point if configured. The leaf CRLs are
+	// signed by the intermediates, and CAs below a hierarchy tier are not
+	// on the root CRL, so neither gets a fallback.
+	if cfg.RootCRLURL != "" && isSelfSigned(parentCert) {
+		template.CRLDistributionPoints = []string{cfg.RootCRLURL}
 	}
 
 	// Add OCSP server URL if configured
@@ -160,24 +473,45 @@ func generateIntermediateCA(rootKey *rsa.PrivateKey, rootCert *x509.Certificate,
 		template.OCSPServer = []string{cfg.OCSPURL}
 	}
 
-	// Create certificate signed by root CA
-	certDER, err := x509.CreateCertificate(rand.Reader, template, rootCert, &privateKey.PublicKey, rootKey)
+	// Add the parent CA certificate URL if configured
+	template.IssuingCertificateURL = caIssuersURL(parentCert, cfg)
+
+	// Assert the configured certificate policies
+	if err := addPolicies(template, cfg.CertificatePolicies); err != nil {
+		return nil, err
+	}
+
+	// Create certificate signed by the parent CA
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parentCert, publicKey, parentKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
 
 	// Parse certificate
 	cert, err := x509.ParseCertificate(certDER)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
-	return privateKey, cert, nil
+	return cert, nil
+}
+
+// saveKeyAndCert saves a private key and certificate to PEM files.
+// The key is encrypted as PKCS#8 when a passphrase is given.
+func saveKeyAndCert(key crypto.Signer, cert *x509.Certificate, baseName string, passphrase []byte) error {
+	if err := saveCAKey(key, baseName, passphrase); err != nil {
+		return err
+	}
+	return saveCACertificate(cert, baseName)
 }
 
-// saveKeyAndCert saves a private key and certificate to PEM files
-func saveKeyAndCert(key *rsa.PrivateKey, cert *x509.Certificate, baseName string) error {
-	// Save private key
+// saveCAKey saves a CA private key to <baseName>-key.pem, encrypted when a passphrase is given
+func saveCAKey(key crypto.Signer, baseName string, passphrase []byte) error {
+	keyPEM, err := encodePrivateKeyPEM(key, passphrase)
+	if err != nil {
+		return err
+	}
+
 	keyPath, err := getCAFilePath(baseName + "-key.pem")
 	if err != nil {
 		return err
@@ -189,15 +523,15 @@ func saveKeyAndCert(key *rsa.PrivateKey, cert *x509.Certificate, baseName string
 	}
 	defer keyFile.Close()
 
-	keyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}
 	if err := pem.Encode(keyFile, keyPEM); err != nil {
 		return fmt.Errorf("failed to write key file: %w", err)
 	}
 
-	// Save certificate
+	return nil
+}
+
+// saveCACertificate saves a CA certificate to <baseName>.pem
+func saveCACertificate(cert *x509.Certificate, baseName string) error {
 	certPath, err := getCAFilePath(baseName + ".pem")
 	if err != nil {
 		return err
@@ -220,83 +554,92 @@ func saveKeyAndCert(key *rsa.PrivateKey, cert *x509.Certificate, baseName string
 	return nil
 }
 
-// saveFullChain saves the intermediate CA and root CA as a fullchain PEM file
-func saveFullChain(intCert, rootCert *x509.Certificate) error {
-	fullchainPath, err := getCAFilePath("intermediateCA-fullchain.pem")
+// saveFullChain saves an intermediate CA and the root CA as <baseName>-fullchain.pem
+func saveFullChain(baseName string, intCert, rootCert *x509.Certificate) error {
+	return saveChain(baseName+"-fullchain.pem", intCert, rootCert)
+}
+
+// saveChain saves a certificate chain, leaf or intermediate first, as a PEM
+// file in the CA directory
+func saveChain(fileName string, certs ...*x509.Certificate) error {
+	chainPath, err := getCAFilePath(fileName)
 	if err != nil {
 		return err
 	}
 
-	fullchainFile, err := os.Create(fullchainPath)
+	chainFile, err := os.Create(chainPath)
 	if err != nil {
 		return fmt.Errorf("failed to create fullchain file: %w", err)
 	}
-	defer fullchainFile.Close()
-
-	// Write intermediate CA certificate first
-	intCertPEM := &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: intCert.Raw,
-	}
-	if err := pem.Encode(fullchainFile, intCertPEM); err != nil {
-		return fmt.Errorf("failed to write intermediate certificate: %w", err)
-	}
+	defer chainFile.Close()
 
-	// Write root CA certificate second
-	rootCertPEM := &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: rootCert.Raw,
-	}
-	if err := pem.Encode(fullchainFile, rootCertPEM); err != nil {
-		return fmt.Errorf("failed to write root certificate: %w", err)
+	for _, cert := range certs {
+		certPEM := &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Raw,
+		}
+		if err := pem.Encode(chainFile, certPEM); err != nil {
+			return fmt.Errorf("failed to write certificate chain: %w", err)
+		}
 	}
 
 	return nil
 }
 
 // loadIntermediateCA loads the intermediate CA key and certificate
-func loadIntermediateCA() (*rsa.PrivateKey, *x509.Certificate, error) {
-	// Load private key
-	keyPath, err := getCAFilePath("intermediateCA-key.pem")
+func loadIntermediateCA() (crypto.Signer, *x509.Certificate, error) {
+	return loadCA("intermediateCA")
+}
+
+// loadCA loads a CA signer from the configured key backend together with
+// its certificate from <baseName>.pem
+func loadCA(baseName string) (crypto.Signer, *x509.Certificate, error) {
+	cfg, err := loadConfig()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	keyData, err := os.ReadFile(keyPath)
+	backend, err := newKeyBackend(cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read intermediate CA key: %w", err)
-	}
-
-	keyBlock, _ := pem.Decode(keyData)
-	if keyBlock == nil {
-		return nil, nil, fmt.Errorf("failed to decode intermediate CA key PEM")
+		return nil, nil, err
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	// Load private key
+	privateKey, err := backend.Signer(baseName)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse intermediate CA key: %w", err)
+		return nil, nil, err
 	}
 
 	// Load certificate
-	certPath, err := getCAFilePath("intermediateCA.pem")
+	cert, err := loadCACertificate(baseName)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return privateKey, cert, nil
+}
+
+// loadCACertificate loads the CA certificate stored in <baseName>.pem
+func loadCACertificate(baseName string) (*x509.Certificate, error) {
+	certPath, err := getCAFilePath(baseName + ".pem")
+	if err != nil {
+		return nil, err
+	}
+
 	certData, err := os.ReadFile(certPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read intermediate CA certificate: %w", err)
+		return nil, fmt.Errorf("failed to read %s certificate: %w", baseName, err)
 	}
 
 	certBlock, _ := pem.Decode(certData)
 	if certBlock == nil {
-		return nil, nil, fmt.Errorf("failed to decode intermediate CA certificate PEM")
+		return nil, fmt.Errorf("failed to decode %s certificate PEM", baseName)
 	}
 
 	cert, err := x509.ParseCertificate(certBlock.Bytes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse intermediate CA certificate: %w", err)
+		return nil, fmt.Errorf("failed to parse %s certificate: %w", baseName, err)
 	}
 
-	return privateKey, cert, nil
+	return cert, nil
 }
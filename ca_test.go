@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInstallCA(t *testing.T) {
@@ -58,8 +64,12 @@ func TestGenerateRootCA(t *testing.T) {
 	if privateKey == nil {
 		t.Fatal("Private key is nil")
 	}
-	if privateKey.N.BitLen() != cfg.DefaultKeySize {
-		t.Errorf("Expected key size %d, got %d", cfg.DefaultKeySize, privateKey.N.BitLen())
+	rsaKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("Expected RSA private key, got %T", privateKey)
+	}
+	if rsaKey.N.BitLen() != cfg.DefaultKeySize {
+		t.Errorf("Expected key size %d, got %d", cfg.DefaultKeySize, rsaKey.N.BitLen())
 	}
 
 	// Verify certificate
@@ -138,6 +148,24 @@ func TestGenerateIntermediateCA(t *testing.T) {
 	}
 }
 
+func TestGenerateIntermediateCAClampedToParent(t *testing.T) {
+	// A root expiring before the intermediate's configured validity
+	cfg := DefaultConfig()
+	cfg.RootCAValidityDays = 400
+	rootKey, rootCert, err := generateRootCA(cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate root CA: %v", err)
+	}
+
+	_, intCert, err := generateIntermediateCA(rootKey, rootCert, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediate CA: %v", err)
+	}
+	if !intCert.NotAfter.Equal(rootCert.NotAfter) {
+		t.Errorf("Expected intermediate NotAfter clamped to %v, got %v", rootCert.NotAfter, intCert.NotAfter)
+	}
+}
+
 func TestSaveAndLoadCA(t *testing.T) {
 	// Create temp directory
 	tmpDir := t.TempDir()
@@ -153,7 +181,7 @@ func TestSaveAndLoadCA(t *testing.T) {
 	}
 
 	// Save root CA
-	if err := saveKeyAndCert(rootKey, rootCert, "rootCA"); err != nil {
+	if err := saveKeyAndCert(rootKey, rootCert, "rootCA", nil); err != nil {
 		t.Fatalf("Failed to save root CA: %v", err)
 	}
 
@@ -187,7 +215,7 @@ func TestSaveAndLoadCA(t *testing.T) {
 		t.Fatalf("Failed to parse key: %v", err)
 	}
 
-	if loadedKey.N.Cmp(rootKey.N) != 0 {
+	if loadedKey.N.Cmp(rootKey.(*rsa.PrivateKey).N) != 0 {
 		t.Error("Loaded key does not match original")
 	}
 
@@ -297,9 +325,7 @@ func TestCertificateChainValidity(t *testing.T) {
 	certPath, keyPath, err := generateCertificate(
 		[]string{"example.com"},
 		CertTypeTLS,
-		false,
-		"",
-		"",
+		CertOptions{},
 		cfg,
 	)
 	if err != nil {
@@ -358,7 +384,7 @@ func TestKeyFilePermissions(t *testing.T) {
 	}
 
 	// Save root CA
-	if err := saveKeyAndCert(rootKey, rootCert, "rootCA"); err != nil {
+	if err := saveKeyAndCert(rootKey, rootCert, "rootCA", nil); err != nil {
 		t.Fatalf("Failed to save root CA: %v", err)
 	}
 
@@ -375,3 +401,363 @@ func TestKeyFilePermissions(t *testing.T) {
 		t.Errorf("Expected key file permissions %v, got %v", expected, mode)
 	}
 }
+
+func TestInstallCAWithECDSA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure unencrypted ECDSA P-384 keys before installing
+	cfg := DefaultConfig()
+	cfg.DefaultKeyType = "ecdsa"
+	cfg.DefaultKeySize = 384
+	cfg.EncryptCAKeys = false
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Verify both CA keys are stored as EC keys
+	for _, file := range []string{"rootCA-key.pem", "intermediateCA-key.pem"} {
+		keyData, err := os.ReadFile(filepath.Join(tmpDir, file))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		block, _ := pem.Decode(keyData)
+		if block == nil {
+			t.Fatalf("Failed to decode %s", file)
+		}
+		if block.Type != "EC PRIVATE KEY" {
+			t.Errorf("Expected EC PRIVATE KEY in %s, got %s", file, block.Type)
+		}
+	}
+
+	// Verify intermediate CA loads as a P-384 key
+	intKey, intCert, err := loadIntermediateCA()
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	ecKey, ok := intKey.(*ecdsa.PrivateKey)
+	if !ok {
+		t.Fatalf("Expected ECDSA private key, got %T", intKey)
+	}
+	if ecKey.Curve.Params().BitSize != 384 {
+		t.Errorf("Expected P-384 curve, got %s", ecKey.Curve.Params().Name)
+	}
+	if intCert.PublicKeyAlgorithm != x509.ECDSA {
+		t.Errorf("Expected ECDSA intermediate certificate, got %v", intCert.PublicKeyAlgorithm)
+	}
+
+	// Verify the ECDSA intermediate can issue certificates
+	certPath, keyPath, err := generateCertificate([]string{"example.com"}, CertTypeTLS, CertOptions{}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+
+	cert := loadCertFromFile(t, certPath)
+	if err := cert.CheckSignatureFrom(intCert); err != nil {
+		t.Errorf("Certificate not properly signed by ECDSA intermediate: %v", err)
+	}
+}
+
+func TestInstallCAWithEd25519(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure unencrypted Ed25519 keys before installing
+	cfg := DefaultConfig()
+	cfg.DefaultKeyType = "ed25519"
+	cfg.EncryptCAKeys = false
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Verify the root CA is an Ed25519 certificate stored as PKCS#8
+	rootCert := loadCertFromFile(t, filepath.Join(tmpDir, "rootCA.pem"))
+	if rootCert.PublicKeyAlgorithm != x509.Ed25519 {
+		t.Errorf("Expected Ed25519 root CA, got %v", rootCert.PublicKeyAlgorithm)
+	}
+
+	keyData, err := os.ReadFile(filepath.Join(tmpDir, "rootCA-key.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read root CA key: %v", err)
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("Expected PKCS#8 PRIVATE KEY block for Ed25519 root CA key")
+	}
+
+	// Verify the Ed25519 hierarchy issues a verifiable certificate
+	certPath, keyPath, err := generateCertificate([]string{"example.com"}, CertTypeTLS, CertOptions{KeySpec: "ed25519"}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(loadCertFromFile(t, filepath.Join(tmpDir, "intermediateCA.pem")))
+
+	cert := loadCertFromFile(t, certPath)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: "example.com"}); err != nil {
+		t.Errorf("Ed25519 certificate chain verification failed: %v", err)
+	}
+}
+
+func TestInstallCAWithEncryptedKeys(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+	t.Setenv("CERTY_CA_PASSPHRASE", "ca-secret")
+
+	// Enable CA key encryption before installing
+	cfg := DefaultConfig()
+	cfg.EncryptCAKeys = true
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Verify both CA keys are encrypted PKCS#8
+	for _, file := range []string{"rootCA-key.pem", "intermediateCA-key.pem"} {
+		keyData, err := os.ReadFile(filepath.Join(tmpDir, file))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		block, _ := pem.Decode(keyData)
+		if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+			t.Errorf("Expected ENCRYPTED PRIVATE KEY in %s", file)
+		}
+	}
+
+	// Intermediate CA is decrypted transparently
+	if _, _, err := loadIntermediateCA(); err != nil {
+		t.Fatalf("Failed to load encrypted intermediate CA: %v", err)
+	}
+
+	// Issuing works with the passphrase available
+	certPath, keyPath, err := generateCertificate([]string{"example.com"}, CertTypeTLS, CertOptions{}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	os.Remove(certPath)
+	os.Remove(keyPath)
+
+	// A wrong passphrase is rejected
+	t.Setenv("CERTY_CA_PASSPHRASE", "wrong")
+	if _, _, err := loadIntermediateCA(); err == nil {
+		t.Error("Expected error loading intermediate CA with wrong passphrase")
+	}
+}
+
+func TestInstallCAWithCustomSubjects(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure CA subjects before installing
+	cfg := DefaultConfig()
+	cfg.CA.Root = SubjectConfig{
+		CommonName:         "Acme Dev Root CA",
+		Organization:       "Acme Corp",
+		OrganizationalUnit: "Platform",
+		Country:            "US",
+		Province:           "Texas",
+		Locality:           "Austin",
+	}
+	cfg.CA.Intermediate = SubjectConfig{CommonName: "Acme Dev Issuing CA", Organization: "Acme Corp"}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	// Verify root subject
+	want := "CN=Acme Dev Root CA,OU=Platform,O=Acme Corp,L=Austin,ST=Texas,C=US"
+	if rootCert.Subject.String() != want {
+		t.Errorf("Expected root subject %q, got %q", want, rootCert.Subject.String())
+	}
+
+	// Verify intermediate subject and that it chains to the root
+	if intCert.Subject.String() != "CN=Acme Dev Issuing CA,O=Acme Corp" {
+		t.Errorf("Unexpected intermediate subject %q", intCert.Subject.String())
+	}
+	if intCert.Issuer.String() != rootCert.Subject.String() {
+		t.Errorf("Expected intermediate issuer %q, got %q", rootCert.Subject.String(), intCert.Issuer.String())
+	}
+	if err := intCert.CheckSignatureFrom(rootCert); err != nil {
+		t.Errorf("Intermediate not signed by root: %v", err)
+	}
+}
+
+func TestInstallCAWithUniqueSuffix(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CA.UniqueSuffix = true
+
+	// Install twice into separate directories
+	var names []string
+	for i := 0; i < 2; i++ {
+		customCADir = t.TempDir()
+		if err := saveConfig(cfg); err != nil {
+			t.Fatalf("Failed to save config: %v", err)
+		}
+		if err := installCA(); err != nil {
+			t.Fatalf("Failed to install CA: %v", err)
+		}
+
+		rootCert, err := loadCACertificate("rootCA")
+		if err != nil {
+			t.Fatalf("Failed to load root CA: %v", err)
+		}
+		intCert, err := loadCACertificate("intermediateCA")
+		if err != nil {
+			t.Fatalf("Failed to load intermediate CA: %v", err)
+		}
+
+		// Root and intermediate share the install suffix
+		suffix := strings.TrimPrefix(rootCert.Subject.CommonName, "Certy Root CA ")
+		if len(suffix) != caSuffixLength {
+			t.Errorf("Expected %d character suffix, got %q", caSuffixLength, rootCert.Subject.CommonName)
+		}
+		if intCert.Subject.CommonName != "Certy Intermediate CA "+suffix {
+			t.Errorf("Expected intermediate CN with suffix %q, got %q", suffix, intCert.Subject.CommonName)
+		}
+		names = append(names, rootCert.Subject.CommonName)
+	}
+	customCADir = ""
+
+	if names[0] == names[1] {
+		t.Errorf("Expected unique root names, both were %q", names[0])
+	}
+}
+
+func TestInstallPendingIntermediate(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Phase 1: intermediate key and CSR
+	csrPath, err := installPendingIntermediate()
+	if err != nil {
+		t.Fatalf("Failed to create pending intermediate: %v", err)
+	}
+	if caStatus() != CAPending {
+		t.Fatalf("Expected pending CA state, got %v", caStatus())
+	}
+	if caExists() {
+		t.Error("A pending CA must not be usable for issuing")
+	}
+
+	csrData, err := os.ReadFile(csrPath)
+	if err != nil {
+		t.Fatalf("Failed to read CSR: %v", err)
+	}
+	block, _ := pem.Decode(csrData)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		t.Fatal("Expected a PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Errorf("Invalid CSR signature: %v", err)
+	}
+	if csr.Subject.CommonName != "Certy Intermediate CA" {
+		t.Errorf("Expected CSR CN 'Certy Intermediate CA', got '%s'", csr.Subject.CommonName)
+	}
+
+	// Sign the CSR with an external root, honoring the requested extensions
+	cfg := DefaultConfig()
+	rootKey, rootCert, err := generateRootCA(cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate external root: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1000),
+		Subject:         csr.Subject,
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().AddDate(1, 0, 0),
+		ExtraExtensions: csr.Extensions,
+	}
+	intDER, err := x509.CreateCertificate(rand.Reader, template, rootCert, csr.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("Failed to sign CSR: %v", err)
+	}
+	intCert, err := x509.ParseCertificate(intDER)
+	if err != nil {
+		t.Fatalf("Failed to parse signed intermediate: %v", err)
+	}
+	if !intCert.IsCA || !intCert.MaxPathLenZero || intCert.KeyUsage != x509.KeyUsageCertSign|x509.KeyUsageCRLSign {
+		t.Errorf("Requested CA extensions not present: IsCA=%v MaxPathLenZero=%v KeyUsage=%v", intCert.IsCA, intCert.MaxPathLenZero, intCert.KeyUsage)
+	}
+
+	srcDir := t.TempDir()
+	intPath := filepath.Join(srcDir, "int.pem")
+	rootPath := filepath.Join(srcDir, "root.pem")
+	writeImportFixture(t, intPath, []*x509.Certificate{intCert}, nil)
+	writeImportFixture(t, rootPath, []*x509.Certificate{rootCert}, nil)
+
+	// A certificate for another key is rejected
+	_, otherInt, err := generateIntermediateCA(rootKey, rootCert, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediate CA: %v", err)
+	}
+	otherPath := filepath.Join(srcDir, "other.pem")
+	writeImportFixture(t, otherPath, []*x509.Certificate{otherInt}, nil)
+	if err := finishIntermediateCA(otherPath, rootPath); err == nil {
+		t.Error("Expected error for a certificate that does not match the pending key")
+	}
+
+	// Phase 2: ingest the signed certificate
+	if err := finishIntermediateCA(intPath, rootPath); err != nil {
+		t.Fatalf("Failed to finish intermediate CA: %v", err)
+	}
+	if !caExists() {
+		t.Fatal("CA should be ready after finishing the intermediate")
+	}
+	if _, err := os.Stat(csrPath); !os.IsNotExist(err) {
+		t.Error("CSR should be removed once the intermediate is installed")
+	}
+	verifyImportedCA(t, tmpDir, rootCert, intCert, false)
+
+	// Finishing again is rejected
+	if err := finishIntermediateCA(intPath, rootPath); err == nil {
+		t.Error("Expected error finishing an intermediate that is not pending")
+	}
+}
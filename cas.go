@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	casDirName      = "cas"        // Subdirectory of the certy home holding named CAs
+	defaultCAFile   = "default-ca" // File in the certy home naming the default CA
+	defaultCAName   = "default"    // Name of the CA stored directly in the certy home
+	caNameEnvVar    = "CERTY_CA"   // Environment variable selecting a named CA
+	maxCANameLength = 64
+)
+
+// caNamePattern restricts CA names to safe directory names
+var caNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// validateCAName checks that a CA name can be used as a directory name
+func validateCAName(name string) error {
+	if len(name) > maxCANameLength || !caNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid CA name %q (use letters, digits, '.', '_' and '-')", name)
+	}
+	return nil
+}
+
+// selectedCAName returns the CA selected with -ca, $CERTY_CA or the
+// default-ca file, in that order of priority, falling back to "default"
+func selectedCAName(home string) (string, error) {
+	name := caName
+	if name == "" {
+		name = os.Getenv(caNameEnvVar)
+	}
+	if name == "" {
+		var err error
+		if name, err = getDefaultCAName(home); err != nil {
+			return "", err
+		}
+	}
+
+	if err := validateCAName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// namedCADir returns the directory holding the named CA
+func namedCADir(home, name string) string {
+	if name == defaultCAName {
+		return home
+	}
+	return filepath.Join(home, casDirName, name)
+}
+
+// getDefaultCAName returns the CA recorded in the default-ca file, or "default"
+func getDefaultCAName(home string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(home, defaultCAFile))
+	if os.IsNotExist(err) {
+		return defaultCAName, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read default CA: %w", err)
+	}
+
+	name := strings.TrimSpace(string(data))
+	if name == "" {
+		return defaultCAName, nil
+	}
+	return name, nil
+}
+
+// setDefaultCA records name as the CA used when -ca is not given
+func setDefaultCA(name string) error {
+	if err := validateCAName(name); err != nil {
+		return err
+	}
+
+	home, err := getCertyHome()
+	if err != nil {
+		return err
+	}
+	defaultPath := filepath.Join(home, defaultCAFile)
+
+	// The home CA is the default when no file exists
+	if name == defaultCAName {
+		if err := os.Remove(defaultPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to reset default CA: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(namedCADir(home, name)); os.IsNotExist(err) {
+		return fmt.Errorf("CA %q does not exist; create it with 'certy -ca %s -install'", name, name)
+	}
+	if err := os.WriteFile(defaultPath, []byte(name+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set default CA: %w", err)
+	}
+	return nil
+}
+
+// listCAs returns the names of all CAs in the certy home, sorted, with the
+// home CA listed as "default" if it has been initialized
+func listCAs() ([]string, error) {
+	home, err := getCertyHome()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if _, err := os.Stat(filepath.Join(home, "config.yml")); err == nil {
+		names = append(names, defaultCAName)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(home, casDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list CAs: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && validateCAName(entry.Name()) == nil && entry.Name() != defaultCAName {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
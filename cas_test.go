@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateCAName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"staging", false},
+		{"partner-test_2.0", false},
+		{"default", false},
+		{"", true},
+		{"../etc", true},
+		{".hidden", true},
+		{"with space", true},
+		{"a/b", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCAName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateCAName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectedCADir(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() {
+		customCADir = ""
+		caName = ""
+	}()
+	t.Setenv("CERTY_CA", "")
+
+	// Home CA by default
+	dir, err := getCertyDir()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if dir != tmpDir {
+		t.Errorf("Expected %s, got %s", tmpDir, dir)
+	}
+
+	// Default CA file
+	if err := os.MkdirAll(filepath.Join(tmpDir, "cas", "dev"), 0755); err != nil {
+		t.Fatalf("Failed to create CA directory: %v", err)
+	}
+	if err := setDefaultCA("dev"); err != nil {
+		t.Fatalf("Failed to set default CA: %v", err)
+	}
+	dir, _ = getCertyDir()
+	if dir != filepath.Join(tmpDir, "cas", "dev") {
+		t.Errorf("Expected default CA directory, got %s", dir)
+	}
+
+	// Environment variable overrides the default
+	t.Setenv("CERTY_CA", "staging")
+	dir, _ = getCertyDir()
+	if dir != filepath.Join(tmpDir, "cas", "staging") {
+		t.Errorf("Expected CERTY_CA directory, got %s", dir)
+	}
+
+	// -ca overrides everything
+	caName = "default"
+	dir, _ = getCertyDir()
+	if dir != tmpDir {
+		t.Errorf("Expected home CA directory, got %s", dir)
+	}
+
+	// Invalid names are rejected
+	caName = "../escape"
+	if _, err := getCertyDir(); err == nil {
+		t.Error("Expected error for invalid CA name")
+	}
+}
+
+func TestNamedCAsAreIndependent(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() {
+		customCADir = ""
+		caName = ""
+	}()
+	t.Setenv("CERTY_CA", "")
+
+	// Install the home CA and two named CAs
+	for _, name := range []string{"", "staging", "partner-test"} {
+		caName = name
+		if err := installCA(); err != nil {
+			t.Fatalf("Failed to install CA %q: %v", name, err)
+		}
+	}
+
+	// Each CA has its own files and serial counter
+	caName = "staging"
+	certPath, keyPath, err := generateCertificate([]string{"staging.example.com"}, CertTypeTLS, CertOptions{}, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	if err := revokeCertificate("1", 0); err != nil {
+		t.Fatalf("Failed to revoke certificate: %v", err)
+	}
+
+	stagingDir := filepath.Join(tmpDir, "cas", "staging")
+	for _, file := range []string{"config.yml", "rootCA.pem", "intermediateCA-key.pem", "serial.txt", "issued.db", "revoked.db"} {
+		if _, err := os.Stat(filepath.Join(stagingDir, file)); err != nil {
+			t.Errorf("Expected %s in staging CA: %v", file, err)
+		}
+	}
+	for _, file := range []string{"issued.db", "revoked.db"} {
+		if _, err := os.Stat(filepath.Join(tmpDir, file)); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist in the home CA", file)
+		}
+	}
+
+	stagingRoot := loadCertFromFile(t, filepath.Join(stagingDir, "rootCA.pem"))
+	homeRoot := loadCertFromFile(t, filepath.Join(tmpDir, "rootCA.pem"))
+	if stagingRoot.Equal(homeRoot) {
+		t.Error("Named CAs should have their own root")
+	}
+
+	caName = "partner-test"
+	serial, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	if serial != 1 {
+		t.Errorf("Expected independent serial 1 for partner-test, got %d", serial)
+	}
+
+	// Listing
+	names, err := listCAs()
+	if err != nil {
+		t.Fatalf("Failed to list CAs: %v", err)
+	}
+	if want := []string{"default", "partner-test", "staging"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected CAs %v, got %v", want, names)
+	}
+
+	// Reinstalling the home CA does not snapshot the named CAs
+	caName = ""
+	archiveName, err := reinstallCA()
+	if err != nil {
+		t.Fatalf("Failed to reinstall CA: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, archiveName, "cas")); !os.IsNotExist(err) {
+		t.Error("Home CA snapshot should not include named CAs")
+	}
+}
+
+func TestSetDefaultCA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if err := setDefaultCA("missing"); err == nil {
+		t.Error("Expected error for a CA that does not exist")
+	}
+
+	if err := os.MkdirAll(filepath.Join(tmpDir, "cas", "prod"), 0755); err != nil {
+		t.Fatalf("Failed to create CA directory: %v", err)
+	}
+	if err := setDefaultCA("prod"); err != nil {
+		t.Fatalf("Failed to set default CA: %v", err)
+	}
+	name, err := getDefaultCAName(tmpDir)
+	if err != nil || name != "prod" {
+		t.Errorf("Expected default CA prod, got %q (%v)", name, err)
+	}
+
+	// Resetting to the home CA removes the file
+	if err := setDefaultCA("default"); err != nil {
+		t.Fatalf("Failed to reset default CA: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "default-ca")); !os.IsNotExist(err) {
+		t.Error("default-ca file should be removed")
+	}
+}
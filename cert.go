@@ -1,16 +1,15 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,74 +25,144 @@ const (
 	CertTypeSMIME
 )
 
+// CertOptions holds the per-issuance settings for generateCertificate
+type CertOptions struct {
+	KeySpec    string // Key algorithm (see resolveKeySpec), empty for the configured default
+	CertFile   string // Custom certificate output path
+	KeyFile    string // Custom private key output path
+	EncryptKey bool   // Encrypt the private key with a passphrase from keyPassphrase
+	Issuer     string // Issuer name (see selectIssuer), empty to route by certificate type
+	Profile    string // Issuance profile from config, empty for the defaults of the certificate type
+
+	Subject        SubjectConfig // Subject attributes overriding the request and profile; the common name is ignored
+	OmitCommonName bool          // Leave the common name out of the subject, relying on the SANs
+
+	Validity  time.Duration // Validity from the start, zero for the profile or configured default
+	NotBefore time.Time     // Explicit start, zero for the backdated time of issuance
+	NotAfter  time.Time     // Explicit end, zero to use Validity
+}
+
 // generateCertificate generates a certificate based on the inputs
-func generateCertificate(inputs []string, certType CertificateType, useECDSA bool, certFile, keyFile string, cfg *Config) (string, string, error) {
-	// Load intermediate CA
-	caKey, caCert, err := loadIntermediateCA()
+func generateCertificate(inputs []string, certType CertificateType, opts CertOptions, cfg *Config) (string, string, error) {
+	// Select the profile, which decides the certificate type when given
+	profile := certTypeProfile(certType)
+	if opts.Profile != "" {
+		var err error
+		if profile, err = findProfile(cfg, opts.Profile); err != nil {
+			return "", "", err
+		}
+		certType = profile.certType()
+	}
+
+	// Resolve key algorithm, falling back to the profile and configured defaults
+	keySpec := opts.KeySpec
+	if keySpec == "" {
+		keySpec = profile.KeyType
+	}
+	keyType, keySize, err := resolveKeySpec(keySpec, cfg)
 	if err != nil {
 		return "", "", err
 	}
 
-	// Generate key pair
-	var privateKey interface{}
-	var publicKey interface{}
-
-	if useECDSA {
-		ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// Obtain the key passphrase up front so nothing is issued if it is unavailable
+	var passphrase []byte
+	if opts.EncryptKey {
+		passphrase, err = keyPassphrase.get(true)
 		if err != nil {
-			return "", "", fmt.Errorf("failed to generate ECDSA key: %w", err)
+			return "", "", err
 		}
-		privateKey = ecdsaKey
-		publicKey = &ecdsaKey.PublicKey
-	} else {
-		rsaKey, err := rsa.GenerateKey(rand.Reader, cfg.DefaultKeySize)
-		if err != nil {
-			return "", "", fmt.Errorf("failed to generate RSA key: %w", err)
-		}
-		privateKey = rsaKey
-		publicKey = &rsaKey.PublicKey
 	}
 
-	// Get serial number
-	serial, err := getSerialNumber()
+	// Load the issuing intermediate CA and check it may issue these usages
+	explicitIssuer := opts.Issuer
+	if explicitIssuer == "" {
+		explicitIssuer = profile.Issuer
+	}
+	issuer, err := selectIssuer(certType, explicitIssuer, cfg)
+	if err != nil {
+		return "", "", err
+	}
+	caKey, caCert, err := loadIssuer(issuer)
 	if err != nil {
 		return "", "", err
 	}
+	if err := checkIssuerUsage(caCert, profile.extKeyUsage()); err != nil {
+		return "", "", err
+	}
+	warnIssuerExpiry(issuer, caCert, cfg)
+
+	// Generate key pair
+	privateKey, err := generatePrivateKey(keyType, keySize)
+	if err != nil {
+		return "", "", err
+	}
+	publicKey := privateKey.Public()
 
 	// Parse inputs into SANs
-	dnsNames, ipAddresses, emailAddresses := parseInputs(inputs)
+	dnsNames, ipAddresses, emailAddresses, uris, err := parseInputs(inputs)
+	if err != nil {
+		return "", "", err
+	}
 
-	// Determine common name
+	// Determine common name and validity
 	commonName := determineCommonName(inputs, certType)
+	notBefore, notAfter, err := certValidity(opts, profile, caCert, cfg)
+	if err != nil {
+		return "", "", err
+	}
 
 	// Create certificate template
 	template := &x509.Certificate{
-		SerialNumber: big.NewInt(serial),
 		Subject: pkix.Name{
 			CommonName: commonName,
 		},
-		NotBefore:             time.Now().AddDate(0, 0, -1),
-		NotAfter:              time.Now().AddDate(0, 0, cfg.DefaultValidityDays),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
 		DNSNames:              dnsNames,
 		IPAddresses:           ipAddresses,
 		EmailAddresses:        emailAddresses,
+		URIs:                  uris,
+		KeyUsage:              leafKeyUsage(profile.keyUsage(), publicKey),
+		ExtKeyUsage:           profile.extKeyUsage(),
 		BasicConstraintsValid: true,
 		IsCA:                  false,
 	}
+	if err := buildSubject(template, opts, profile); err != nil {
+		return "", "", err
+	}
 
-	// Set key usage based on certificate type
-	switch certType {
-	case CertTypeTLS:
-		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
-		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
-	case CertTypeClient:
-		template.KeyUsage = x509.KeyUsageDigitalSignature
-		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
-	case CertTypeSMIME:
-		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
-		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	// Refuse names the profile does not allow and SPIFFE IDs outside the trust domains
+	if err := profile.checkAllowedSANs(template); err != nil {
+		return "", "", err
+	}
+	if err := checkSPIFFEIDs(template, profile, cfg); err != nil {
+		return "", "", err
 	}
 
+	// Add the issuer certificate URL and revocation endpoints if configured
+	template.IssuingCertificateURL = caIssuersURL(caCert, cfg)
+	setRevocationURLs(template, issuer, profile, cfg)
+
+	// Assert the certificate policies and add the profile extensions
+	if err := addPolicies(template, profile.policies(cfg)); err != nil {
+		return "", "", err
+	}
+	if err := profile.addExtensions(template); err != nil {
+		return "", "", err
+	}
+
+	// Refuse names the issuer may not certify
+	if err := checkNameConstraints(caCert, template); err != nil {
+		return "", "", err
+	}
+
+	// Get serial number
+	serial, err := getSerialNumber()
+	if err != nil {
+		return "", "", err
+	}
+	template.SerialNumber = big.NewInt(serial)
+
 	// Create certificate
 	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, publicKey, caKey)
 	if err != nil {
@@ -107,7 +176,7 @@ func generateCertificate(inputs []string, certType CertificateType, useECDSA boo
 	}
 
 	// Determine output file paths
-	certPath, keyPath := determineOutputPaths(inputs, certFile, keyFile)
+	certPath, keyPath := determineOutputPaths(inputs, opts.CertFile, opts.KeyFile)
 
 	// Save certificate
 	if err := saveCertificate(cert, certPath); err != nil {
@@ -115,20 +184,37 @@ func generateCertificate(inputs []string, certType CertificateType, useECDSA boo
 	}
 
 	// Save private key
-	if err := savePrivateKey(privateKey, keyPath); err != nil {
+	if err := savePrivateKey(privateKey, keyPath, passphrase); err != nil {
+		return "", "", err
+	}
+
+	// Record the issued certificate
+	if err := recordIssuedCertificate(cert); err != nil {
 		return "", "", err
 	}
 
 	return certPath, keyPath, nil
 }
 
-// parseInputs parses the inputs into DNS names, IP addresses, and email addresses
-func parseInputs(inputs []string) ([]string, []net.IP, []string) {
+// parseInputs parses the inputs into DNS names, IP addresses, email
+// addresses and URIs
+func parseInputs(inputs []string) ([]string, []net.IP, []string, []*url.URL, error) {
 	var dnsNames []string
 	var ipAddresses []net.IP
 	var emailAddresses []string
+	var uris []*url.URL
 
 	for _, input := range inputs {
+		// Check if it's a URI, e.g. a SPIFFE ID
+		if strings.Contains(input, "://") {
+			uri, err := url.Parse(input)
+			if err != nil || uri.Host == "" {
+				return nil, nil, nil, nil, fmt.Errorf("invalid URI %q", input)
+			}
+			uris = append(uris, uri)
+			continue
+		}
+
 		// Check if it's an IP address
 		if ip := net.ParseIP(input); ip != nil {
 			ipAddresses = append(ipAddresses, ip)
@@ -145,7 +231,7 @@ func parseInputs(inputs []string) ([]string, []net.IP, []string) {
 		dnsNames = append(dnsNames, input)
 	}
 
-	return dnsNames, ipAddresses, emailAddresses
+	return dnsNames, ipAddresses, emailAddresses, uris, nil
 }
 
 // determineCommonName determines the common name for the certificate
@@ -163,8 +249,13 @@ func determineCommonName(inputs []string, certType CertificateType) string {
 		}
 	}
 
-	// Use the first input as the common name
-	return inputs[0]
+	// Use the first input that is not a URI as the common name
+	for _, input := range inputs {
+		if !strings.Contains(input, "://") {
+			return input
+		}
+	}
+	return ""
 }
 
 // determineOutputPaths determines the output file paths for the certificate and key
@@ -231,8 +322,8 @@ func saveCertificate(cert *x509.Certificate, path string) error {
 	return nil
 }
 
-// savePrivateKey saves a private key to a PEM file
-func savePrivateKey(key interface{}, path string) error {
+// savePrivateKey saves a private key to a PEM file, encrypted when a passphrase is given
+func savePrivateKey(key crypto.Signer, path string, passphrase []byte) error {
 	// Ensure directory exists
 	dir := filepath.Dir(path)
 	if dir != "." && dir != "" {
@@ -241,33 +332,17 @@ func savePrivateKey(key interface{}, path string) error {
 		}
 	}
 
+	keyPEM, err := encodePrivateKeyPEM(key, passphrase)
+	if err != nil {
+		return err
+	}
+
 	keyFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to create key file: %w", err)
 	}
 	defer keyFile.Close()
 
-	var keyPEM *pem.Block
-
-	switch k := key.(type) {
-	case *rsa.PrivateKey:
-		keyPEM = &pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(k),
-		}
-	case *ecdsa.PrivateKey:
-		keyBytes, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			return fmt.Errorf("failed to marshal ECDSA key: %w", err)
-		}
-		keyPEM = &pem.Block{
-			Type:  "EC PRIVATE KEY",
-			Bytes: keyBytes,
-		}
-	default:
-		return fmt.Errorf("unsupported key type")
-	}
-
 	if err := pem.Encode(keyFile, keyPEM); err != nil {
 		return fmt.Errorf("failed to write key file: %w", err)
 	}
@@ -275,8 +350,28 @@ func savePrivateKey(key interface{}, path string) error {
 	return nil
 }
 
-// generateFromCSR generates a certificate from a CSR file
-func generateFromCSR(csrPath, certFile string, cfg *Config) (string, error) {
+// buildSubject sets the subject attributes given in opts on the template,
+// fills the missing ones from the profile and removes the common name when
+// requested. A certificate without a common name must have SANs.
+func buildSubject(template *x509.Certificate, opts CertOptions, profile ProfileConfig) error {
+	if err := validateSubject("subject", opts.Subject, false); err != nil {
+		return err
+	}
+	opts.Subject.applyTo(&template.Subject, true)
+	profile.applySubjectDefaults(&template.Subject)
+
+	if opts.OmitCommonName || profile.OmitCommonName {
+		template.Subject.CommonName = ""
+		if len(template.DNSNames)+len(template.IPAddresses)+len(template.EmailAddresses)+len(template.URIs) == 0 {
+			return fmt.Errorf("a certificate without a common name needs at least one subject alternative name")
+		}
+	}
+	return nil
+}
+
+// generateFromCSR generates a certificate from a CSR file. The KeySpec,
+// KeyFile and EncryptKey options do not apply.
+func generateFromCSR(csrPath string, opts CertOptions, cfg *Config) (string, error) {
 	// Load CSR
 	csrData, err := os.ReadFile(csrPath)
 	if err != nil {
@@ -298,32 +393,104 @@ func generateFromCSR(csrPath, certFile string, cfg *Config) (string, error) {
 		return "", fmt.Errorf("invalid CSR signature: %w", err)
 	}
 
-	// Load intermediate CA
-	caKey, caCert, err := loadIntermediateCA()
-	if err != nil {
-		return "", err
+	// Select the profile and check the requested key against it
+	var profile ProfileConfig
+	if opts.Profile != "" {
+		if profile, err = findProfile(cfg, opts.Profile); err != nil {
+			return "", err
+		}
+		if err := profile.checkPublicKey(csr.PublicKey, cfg); err != nil {
+			return "", err
+		}
 	}
 
-	// Get serial number
-	serial, err := getSerialNumber()
+	// Load the issuing intermediate CA: the main one unless -issuer is
+	// given, or the one routed by the profile's usages
+	explicitIssuer := opts.Issuer
+	if explicitIssuer == "" {
+		explicitIssuer = profile.Issuer
+	}
+	issuer := defaultIssuerName
+	switch {
+	case opts.Profile != "":
+		if issuer, err = selectIssuer(profile.certType(), explicitIssuer, cfg); err != nil {
+			return "", err
+		}
+	case explicitIssuer != "" && explicitIssuer != defaultIssuerName:
+		if _, err := findIssuerConfig(cfg, explicitIssuer); err != nil {
+			return "", err
+		}
+		issuer = explicitIssuer
+	}
+	caKey, caCert, err := loadIssuer(issuer)
 	if err != nil {
 		return "", err
 	}
+	warnIssuerExpiry(issuer, caCert, cfg)
+
+	// Use the profile usages, or TLS server and client limited to those the issuer may grant
+	keyUsage := profile.keyUsage()
+	extKeyUsage := profile.extKeyUsage()
+	if opts.Profile != "" {
+		if err := checkIssuerUsage(caCert, extKeyUsage); err != nil {
+			return "", err
+		}
+	} else {
+		keyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		extKeyUsage = restrictToIssuerUsage(caCert, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth})
+		if len(extKeyUsage) == 0 {
+			return "", fmt.Errorf("issuer %q cannot issue TLS server or client certificates", caCert.Subject.CommonName)
+		}
+	}
+	keyUsage = leafKeyUsage(keyUsage, csr.PublicKey)
 
 	// Create certificate template from CSR
+	notBefore, notAfter, err := certValidity(opts, profile, caCert, cfg)
+	if err != nil {
+		return "", err
+	}
 	template := &x509.Certificate{
-		SerialNumber:          big.NewInt(serial),
 		Subject:               csr.Subject,
-		NotBefore:             time.Now().AddDate(0, 0, -1),
-		NotAfter:              time.Now().AddDate(0, 0, cfg.DefaultValidityDays),
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
 		DNSNames:              csr.DNSNames,
 		IPAddresses:           csr.IPAddresses,
 		EmailAddresses:        csr.EmailAddresses,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:                  csr.URIs,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		IssuingCertificateURL: caIssuersURL(caCert, cfg),
 		BasicConstraintsValid: true,
 		IsCA:                  false,
 	}
+	if err := buildSubject(template, opts, profile); err != nil {
+		return "", err
+	}
+	if err := profile.checkAllowedSANs(template); err != nil {
+		return "", err
+	}
+	if err := checkSPIFFEIDs(template, profile, cfg); err != nil {
+		return "", err
+	}
+	setRevocationURLs(template, issuer, profile, cfg)
+	if err := addPolicies(template, profile.policies(cfg)); err != nil {
+		return "", err
+	}
+	if err := profile.addExtensions(template); err != nil {
+		return "", err
+	}
+
+	// Refuse names the issuer may not certify
+	if err := checkNameConstraints(caCert, template); err != nil {
+		return "", err
+	}
+
+	// Get serial number
+	serial, err := getSerialNumber()
+	if err != nil {
+		return "", err
+	}
+	template.SerialNumber = big.NewInt(serial)
 
 	// Create certificate
 	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
@@ -338,7 +505,7 @@ func generateFromCSR(csrPath, certFile string, cfg *Config) (string, error) {
 	}
 
 	// Determine output path
-	certPath := certFile
+	certPath := opts.CertFile
 	if certPath == "" {
 		// Use CSR filename with .pem extension
 		base := strings.TrimSuffix(filepath.Base(csrPath), filepath.Ext(csrPath))
@@ -350,5 +517,10 @@ func generateFromCSR(csrPath, certFile string, cfg *Config) (string, error) {
 		return "", err
 	}
 
+	// Record the issued certificate
+	if err := recordIssuedCertificate(cert); err != nil {
+		return "", err
+	}
+
 	return certPath, nil
 }
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"os"
 	"path/filepath"
@@ -15,6 +22,7 @@ func TestParseInputs(t *testing.T) {
 		expectedDNS    []string
 		expectedIPs    int
 		expectedEmails []string
+		expectedURIs   []string
 	}{
 		{
 			name:           "single domain",
@@ -58,11 +66,30 @@ func TestParseInputs(t *testing.T) {
 			expectedIPs:    2,
 			expectedEmails: []string{"user@example.com"},
 		},
+		{
+			name:           "SPIFFE ID",
+			inputs:         []string{"spiffe://prod.example/ns/web/sa/api", "api.example.com"},
+			expectedDNS:    []string{"api.example.com"},
+			expectedIPs:    0,
+			expectedEmails: []string{},
+			expectedURIs:   []string{"spiffe://prod.example/ns/web/sa/api"},
+		},
+		{
+			name:           "URI with user info",
+			inputs:         []string{"https://user@example.com/path"},
+			expectedDNS:    []string{},
+			expectedIPs:    0,
+			expectedEmails: []string{},
+			expectedURIs:   []string{"https://user@example.com/path"},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			dnsNames, ipAddresses, emailAddresses := parseInputs(tt.inputs)
+			dnsNames, ipAddresses, emailAddresses, uris, err := parseInputs(tt.inputs)
+			if err != nil {
+				t.Fatalf("Failed to parse inputs: %v", err)
+			}
 
 			if len(dnsNames) != len(tt.expectedDNS) {
 				t.Errorf("Expected %d DNS names, got %d", len(tt.expectedDNS), len(dnsNames))
@@ -85,6 +112,15 @@ func TestParseInputs(t *testing.T) {
 					t.Errorf("Expected email %s, got %s", email, emailAddresses[i])
 				}
 			}
+
+			if len(uris) != len(tt.expectedURIs) {
+				t.Errorf("Expected %d URIs, got %d", len(tt.expectedURIs), len(uris))
+			}
+			for i, uri := range tt.expectedURIs {
+				if uris[i].String() != uri {
+					t.Errorf("Expected URI %s, got %s", uri, uris[i])
+				}
+			}
 		})
 	}
 }
@@ -120,6 +156,18 @@ func TestDetermineCommonName(t *testing.T) {
 			certType: CertTypeTLS,
 			expected: "example.com",
 		},
+		{
+			name:     "URI before domain",
+			inputs:   []string{"spiffe://prod.example/api", "api.example.com"},
+			certType: CertTypeTLS,
+			expected: "api.example.com",
+		},
+		{
+			name:     "URI only",
+			inputs:   []string{"spiffe://prod.example/api"},
+			certType: CertTypeTLS,
+			expected: "",
+		},
 	}
 
 	for _, tt := range tests {
@@ -336,14 +384,14 @@ func TestGenerateCertificate(t *testing.T) {
 		name         string
 		inputs       []string
 		certType     CertificateType
-		useECDSA     bool
+		keyType      string
 		validateFunc func(*testing.T, *x509.Certificate)
 	}{
 		{
 			name:     "TLS certificate with RSA",
 			inputs:   []string{"example.com", "*.example.com"},
 			certType: CertTypeTLS,
-			useECDSA: false,
+			keyType:  "rsa",
 			validateFunc: func(t *testing.T, cert *x509.Certificate) {
 				if !contains(cert.ExtKeyUsage, x509.ExtKeyUsageServerAuth) {
 					t.Error("Missing ServerAuth extended key usage")
@@ -357,7 +405,7 @@ func TestGenerateCertificate(t *testing.T) {
 			name:     "Client certificate with ECDSA",
 			inputs:   []string{"client.example.com"},
 			certType: CertTypeClient,
-			useECDSA: true,
+			keyType:  "ecdsa",
 			validateFunc: func(t *testing.T, cert *x509.Certificate) {
 				if !contains(cert.ExtKeyUsage, x509.ExtKeyUsageClientAuth) {
 					t.Error("Missing ClientAuth extended key usage")
@@ -371,7 +419,7 @@ func TestGenerateCertificate(t *testing.T) {
 			name:     "S/MIME certificate",
 			inputs:   []string{"user@example.com"},
 			certType: CertTypeSMIME,
-			useECDSA: false,
+			keyType:  "rsa",
 			validateFunc: func(t *testing.T, cert *x509.Certificate) {
 				if !contains(cert.ExtKeyUsage, x509.ExtKeyUsageEmailProtection) {
 					t.Error("Missing EmailProtection extended key usage")
@@ -385,7 +433,7 @@ func TestGenerateCertificate(t *testing.T) {
 			name:     "Multiple SANs with IPs",
 			inputs:   []string{"example.com", "127.0.0.1", "::1"},
 			certType: CertTypeTLS,
-			useECDSA: false,
+			keyType:  "rsa",
 			validateFunc: func(t *testing.T, cert *x509.Certificate) {
 				if len(cert.IPAddresses) != 2 {
 					t.Errorf("Expected 2 IP addresses, got %d", len(cert.IPAddresses))
@@ -396,7 +444,7 @@ func TestGenerateCertificate(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			certPath, keyPath, err := generateCertificate(tt.inputs, tt.certType, tt.useECDSA, "", "", cfg)
+			certPath, keyPath, err := generateCertificate(tt.inputs, tt.certType, CertOptions{KeySpec: tt.keyType}, cfg)
 			if err != nil {
 				t.Fatalf("Failed to generate certificate: %v", err)
 			}
@@ -446,6 +494,143 @@ func TestGenerateCertificate(t *testing.T) {
 	}
 }
 
+func TestGenerateCertificateKeyTypes(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Configure ECDSA P-384 as the default for leaf certificates
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cfg.DefaultKeyType = "ecdsa"
+	cfg.DefaultKeySize = 384
+
+	tests := []struct {
+		keySpec      string
+		expectedAlgo x509.PublicKeyAlgorithm
+		expectedBits int
+	}{
+		{"", x509.ECDSA, 384},
+		{"rsa3072", x509.RSA, 3072},
+		{"p256", x509.ECDSA, 256},
+		{"p521", x509.ECDSA, 521},
+		{"ed25519", x509.Ed25519, 0},
+	}
+
+	for _, tt := range tests {
+		name := tt.keySpec
+		if name == "" {
+			name = "config default"
+		}
+		t.Run(name, func(t *testing.T) {
+			certPath, keyPath, err := generateCertificate([]string{"mixed.example.com"}, CertTypeTLS, CertOptions{KeySpec: tt.keySpec}, cfg)
+			if err != nil {
+				t.Fatalf("Failed to generate certificate: %v", err)
+			}
+			defer os.Remove(certPath)
+			defer os.Remove(keyPath)
+
+			cert := loadCertFromFile(t, certPath)
+			if cert.PublicKeyAlgorithm != tt.expectedAlgo {
+				t.Errorf("Expected %v, got %v", tt.expectedAlgo, cert.PublicKeyAlgorithm)
+			}
+
+			switch pub := cert.PublicKey.(type) {
+			case *rsa.PublicKey:
+				if pub.N.BitLen() != tt.expectedBits {
+					t.Errorf("Expected %d-bit RSA key, got %d", tt.expectedBits, pub.N.BitLen())
+				}
+			case *ecdsa.PublicKey:
+				if pub.Curve.Params().BitSize != tt.expectedBits {
+					t.Errorf("Expected P-%d key, got %s", tt.expectedBits, pub.Curve.Params().Name)
+				}
+			}
+		})
+	}
+
+	// Invalid key types are rejected before anything is issued
+	if _, _, err := generateCertificate([]string{"bad.example.com"}, CertTypeTLS, CertOptions{KeySpec: "dsa"}, cfg); err == nil {
+		t.Error("Expected error for unsupported key type")
+	}
+}
+
+func TestKeyEnciphermentOnlyForRSA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	cfg := DefaultConfig()
+
+	// Generated keys get key encipherment for TLS and S/MIME only with RSA
+	tests := []struct {
+		keySpec  string
+		certType CertificateType
+		input    string
+		wantKE   bool
+	}{
+		{"rsa2048", CertTypeTLS, "rsa.example.com", true},
+		{"p256", CertTypeTLS, "ecdsa.example.com", false},
+		{"ed25519", CertTypeTLS, "ed25519.example.com", false},
+		{"rsa2048", CertTypeSMIME, "rsa@example.com", true},
+		{"p256", CertTypeSMIME, "ecdsa@example.com", false},
+		{"ed25519", CertTypeSMIME, "ed25519@example.com", false},
+	}
+	for _, tt := range tests {
+		opts := CertOptions{KeySpec: tt.keySpec, CertFile: filepath.Join(tmpDir, "leaf.pem"), KeyFile: filepath.Join(tmpDir, "leaf-key.pem")}
+		if _, _, err := generateCertificate([]string{tt.input}, tt.certType, opts, cfg); err != nil {
+			t.Fatalf("Failed to generate certificate for %s: %v", tt.input, err)
+		}
+		cert := loadCertFromFile(t, opts.CertFile)
+		if cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+			t.Errorf("%s: expected digital signature, got %v", tt.input, cert.KeyUsage)
+		}
+		if got := cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0; got != tt.wantKE {
+			t.Errorf("%s: expected key encipherment %v, got %v", tt.input, tt.wantKE, got)
+		}
+	}
+
+	// CSRs are treated the same way by the key they carry
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecdsaKey, "ed25519": ed25519Key} {
+		csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name + ".example.com"}}, key)
+		if err != nil {
+			t.Fatalf("Failed to create CSR: %v", err)
+		}
+		csrPath := filepath.Join(tmpDir, name+".csr")
+		if err := os.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 0644); err != nil {
+			t.Fatalf("Failed to write CSR: %v", err)
+		}
+		certPath, err := generateFromCSR(csrPath, CertOptions{CertFile: filepath.Join(tmpDir, name+".pem")}, cfg)
+		if err != nil {
+			t.Fatalf("Failed to sign %s CSR: %v", name, err)
+		}
+		cert := loadCertFromFile(t, certPath)
+		if cert.KeyUsage != x509.KeyUsageDigitalSignature {
+			t.Errorf("Expected only digital signature for a %s CSR, got %v", name, cert.KeyUsage)
+		}
+	}
+}
+
 // Helper function
 func contains(slice []x509.ExtKeyUsage, item x509.ExtKeyUsage) bool {
 	for _, s := range slice {
@@ -455,3 +640,164 @@ func contains(slice []x509.ExtKeyUsage, item x509.ExtKeyUsage) bool {
 	}
 	return false
 }
+
+func TestGenerateCertificateSubject(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure a profile with subject defaults
+	cfg := DefaultConfig()
+	cfg.Profiles = []ProfileConfig{{
+		Name:    "acme",
+		Subject: SubjectConfig{Organization: "Acme Corp", Country: "US", Locality: "Austin"},
+	}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Attributes from the command line override the profile defaults
+	certPath := filepath.Join(tmpDir, "subject.pem")
+	opts := CertOptions{
+		CertFile: certPath,
+		KeyFile:  filepath.Join(tmpDir, "subject-key.pem"),
+		Profile:  "acme",
+		Subject: SubjectConfig{
+			Organization:       "Example Inc",
+			OrganizationalUnit: "Platform",
+			Province:           "Texas",
+			SerialNumber:       "HRB 12345",
+			Attributes:         []AttributeConfig{{OID: "2.5.4.97", Value: "VATUS-123"}},
+		},
+	}
+	if _, _, err := generateCertificate([]string{"example.com"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	cert := loadCertFromFile(t, certPath)
+
+	subject := cert.Subject
+	if subject.CommonName != "example.com" {
+		t.Errorf("Expected common name example.com, got %q", subject.CommonName)
+	}
+	checks := map[string][]string{
+		"organization":        subject.Organization,
+		"organizational unit": subject.OrganizationalUnit,
+		"country":             subject.Country,
+		"province":            subject.Province,
+		"locality":            subject.Locality,
+	}
+	want := map[string]string{
+		"organization":        "Example Inc",
+		"organizational unit": "Platform",
+		"country":             "US",
+		"province":            "Texas",
+		"locality":            "Austin",
+	}
+	for attr, values := range checks {
+		if len(values) != 1 || values[0] != want[attr] {
+			t.Errorf("Expected %s %q, got %v", attr, want[attr], values)
+		}
+	}
+	if subject.SerialNumber != "HRB 12345" {
+		t.Errorf("Expected subject serial number HRB 12345, got %q", subject.SerialNumber)
+	}
+	found := false
+	for _, name := range subject.Names {
+		if name.Type.String() == "2.5.4.97" && name.Value == "VATUS-123" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected attribute 2.5.4.97 in the subject, got %v", subject.Names)
+	}
+
+	// Invalid attributes are refused
+	opts.Subject = SubjectConfig{Country: "usa"}
+	if _, _, err := generateCertificate([]string{"example.com"}, CertTypeTLS, opts, cfg); err == nil {
+		t.Error("Expected error for an invalid country")
+	}
+}
+
+func TestOmitCommonName(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure a profile that omits the common name
+	cfg := DefaultConfig()
+	cfg.Profiles = []ProfileConfig{{Name: "san-only", OmitCommonName: true}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		opts CertOptions
+	}{
+		{"flag", CertOptions{OmitCommonName: true}},
+		{"profile", CertOptions{Profile: "san-only"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.CertFile = filepath.Join(tmpDir, tt.name+".pem")
+			tt.opts.KeyFile = filepath.Join(tmpDir, tt.name+"-key.pem")
+			if _, _, err := generateCertificate([]string{"example.com"}, CertTypeTLS, tt.opts, cfg); err != nil {
+				t.Fatalf("Failed to generate certificate: %v", err)
+			}
+			cert := loadCertFromFile(t, tt.opts.CertFile)
+			if cert.Subject.CommonName != "" || len(cert.Subject.Names) != 0 {
+				t.Errorf("Expected an empty subject, got %q", cert.Subject.String())
+			}
+
+			// The SANs carry the identity, so the extension must be critical
+			for _, ext := range cert.Extensions {
+				if ext.Id.String() == "2.5.29.17" && !ext.Critical {
+					t.Error("Expected a critical SAN extension with an empty subject")
+				}
+			}
+		})
+	}
+
+	// A CSR without SANs cannot omit the common name
+	csrPath := filepath.Join(tmpDir, "no-sans.csr")
+	writeTestCSR(t, csrPath, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "legacy"}})
+	serialBefore, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	opts := CertOptions{CertFile: filepath.Join(tmpDir, "no-sans.pem"), OmitCommonName: true}
+	if _, err := generateFromCSR(csrPath, opts, cfg); err == nil {
+		t.Error("Expected error omitting the common name of a CSR without SANs")
+	}
+	serialAfter, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	if serialAfter != serialBefore+1 {
+		t.Errorf("Expected the refused CSR not to consume a serial number")
+	}
+}
+
+func TestParseAttributeFlags(t *testing.T) {
+	attributes, err := parseAttributeFlags([]string{"2.5.4.97=VATUS-123", " 1.3.6.1.4.1.99999.1 =a=b"})
+	if err != nil {
+		t.Fatalf("Failed to parse attributes: %v", err)
+	}
+	want := []AttributeConfig{{OID: "2.5.4.97", Value: "VATUS-123"}, {OID: "1.3.6.1.4.1.99999.1", Value: "a=b"}}
+	if len(attributes) != len(want) || attributes[0] != want[0] || attributes[1] != want[1] {
+		t.Errorf("Expected %v, got %v", want, attributes)
+	}
+
+	if _, err := parseAttributeFlags([]string{"2.5.4.97"}); err == nil {
+		t.Error("Expected error for a value without '='")
+	}
+}
@@ -2,21 +2,142 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the certy configuration
 type Config struct {
-	DefaultValidityDays int    `yaml:"default_validity_days"`
-	RootCAValidityDays  int    `yaml:"root_ca_validity_days"`
-	IntCAValidityDays   int    `yaml:"intermediate_ca_validity_days"`
-	DefaultKeyType      string `yaml:"default_key_type"`
-	DefaultKeySize      int    `yaml:"default_key_size"`
-	CRLURL              string `yaml:"crl_url"`  // CRL distribution point URL
-	OCSPURL             string `yaml:"ocsp_url"` // OCSP responder URL
+	DefaultValidityDays int             `yaml:"default_validity_days"`
+	RootCAValidityDays  int             `yaml:"root_ca_validity_days"`
+	IntCAValidityDays   int             `yaml:"intermediate_ca_validity_days"`
+	DefaultKeyType      string          `yaml:"default_key_type"`
+	DefaultKeySize      int             `yaml:"default_key_size"`
+	Backdate            string          `yaml:"backdate"`                       // How far issued certificates start in the past, as a Go duration (default: 24h)
+	IssuerExpiryPolicy  string          `yaml:"issuer_expiry_policy"`           // "clamp" or "refuse" certificates that would outlive their issuer
+	ExpiryWarningDays   int             `yaml:"issuer_expiry_warning_days"`     // Warn when the issuer expires within this many days (0 disables)
+	CRLURL              string          `yaml:"crl_url"`                        // CRL distribution point URL of issued certificates
+	RootCRLURL          string          `yaml:"root_crl_url"`                   // CRL distribution point URL of CAs signed by the root (default: none)
+	OCSPURL             string          `yaml:"ocsp_url"`                       // OCSP responder URL
+	CAIssuersURL        string          `yaml:"ca_issuers_url"`                 // Base URL where issuer certificates are published (see -export-issuers)
+	CertificatePolicies []PolicyConfig  `yaml:"certificate_policies,omitempty"` // Policies asserted by the intermediates and issued certificates
+	Profiles            []ProfileConfig `yaml:"profiles,omitempty"`             // Named issuance profiles selected with -profile
+	SPIFFETrustDomains  []string        `yaml:"spiffe_trust_domains,omitempty"` // Trust domains of the SPIFFE IDs this CA may certify
+	KeyBackend          string          `yaml:"key_backend"`                    // Where CA keys are kept: "file" or "pkcs11"
+	EncryptCAKeys       bool            `yaml:"encrypt_ca_keys"`                // Store CA keys as passphrase-protected PKCS#8 (file backend, default: true)
+	PKCS11              PKCS11Config    `yaml:"pkcs11,omitempty"`               // PKCS#11 token settings (pkcs11 backend)
+	CA                  CAConfig        `yaml:"ca"`                             // Root and intermediate CA subjects
+}
+
+// CAConfig configures the distinguished names of the CA certificates
+type CAConfig struct {
+	Root            SubjectConfig         `yaml:"root"`
+	Intermediate    SubjectConfig         `yaml:"intermediate"`
+	UniqueSuffix    bool                  `yaml:"unique_suffix"`              // Append a random per-install suffix to the CA common names
+	Issuers         []IssuerConfig        `yaml:"issuers,omitempty"`          // Additional purpose-specific intermediate CAs
+	Hierarchy       []TierConfig          `yaml:"hierarchy,omitempty"`        // CA tiers between the root and the intermediates, top-down
+	NameConstraints NameConstraintsConfig `yaml:"name_constraints,omitempty"` // Names the intermediate CAs may issue for
+}
+
+// NameConstraintsConfig lists the names written to the intermediate CAs as a
+// critical name constraints extension. A domain matches itself and its
+// subdomains; a leading "." matches subdomains only.
+type NameConstraintsConfig struct {
+	PermittedDNSDomains     []string `yaml:"permitted_dns_domains,omitempty"`
+	ExcludedDNSDomains      []string `yaml:"excluded_dns_domains,omitempty"`
+	PermittedIPRanges       []string `yaml:"permitted_ip_ranges,omitempty"` // CIDR notation, e.g. 10.0.0.0/8
+	ExcludedIPRanges        []string `yaml:"excluded_ip_ranges,omitempty"`
+	PermittedEmailAddresses []string `yaml:"permitted_email_addresses,omitempty"` // Mailbox, domain or .domain
+	ExcludedEmailAddresses  []string `yaml:"excluded_email_addresses,omitempty"`
+	PermittedURIDomains     []string `yaml:"permitted_uri_domains,omitempty"`
+	ExcludedURIDomains      []string `yaml:"excluded_uri_domains,omitempty"`
+}
+
+// IssuerConfig describes an additional intermediate CA that only issues
+// certificates for the listed purposes
+type IssuerConfig struct {
+	Name     string        `yaml:"name"`
+	Purposes []string      `yaml:"purposes"`           // Certificate types it issues: tls, client, smime
+	Subject  SubjectConfig `yaml:"subject"`            // Empty common name for "Certy Intermediate CA <name>"
+	CRLURL   string        `yaml:"crl_url,omitempty"`  // CRL distribution point of its certificates (default: crl_url)
+	OCSPURL  string        `yaml:"ocsp_url,omitempty"` // OCSP responder of its certificates (default: ocsp_url)
+}
+
+// TierConfig describes a CA between the root and the issuing intermediate
+// CAs, such as a policy CA in a three-tier hierarchy
+type TierConfig struct {
+	Name         string        `yaml:"name"`
+	Subject      SubjectConfig `yaml:"subject"`                 // Empty common name for "Certy Sub CA <name>"
+	ValidityDays int           `yaml:"validity_days,omitempty"` // Default: intermediate_ca_validity_days
+	KeyType      string        `yaml:"key_type,omitempty"`      // Default: default_key_type
+	KeySize      int           `yaml:"key_size,omitempty"`      // Default: default_key_size, or 2048/256 for another key type
+	MaxPathLen   *int          `yaml:"max_path_len,omitempty"`  // CA certificates allowed below it (default: the tiers below plus one)
+}
+
+// ProfileConfig describes a named issuance profile. Empty fields fall back to
+// the certy defaults for the certificate type.
+type ProfileConfig struct {
+	Name                string            `yaml:"name"`
+	KeyUsage            []string          `yaml:"key_usage,omitempty"`            // e.g. digital_signature, key_encipherment
+	ExtKeyUsage         []string          `yaml:"ext_key_usage,omitempty"`        // e.g. server_auth, client_auth, email_protection
+	ValidityDays        int               `yaml:"validity_days,omitempty"`        // Default: default_validity_days
+	Validity            string            `yaml:"validity,omitempty"`             // Go duration or days, e.g. 12h or 30d (instead of validity_days)
+	KeyType             string            `yaml:"key_type,omitempty"`             // As for -key-type; CSRs must use this key type
+	Subject             SubjectConfig     `yaml:"subject,omitempty"`              // Defaults for subject attributes missing from the request
+	OmitCommonName      bool              `yaml:"omit_common_name,omitempty"`     // Issue without a subject common name, relying on the SANs
+	SPIFFE              bool              `yaml:"spiffe,omitempty"`               // Issue X.509-SVIDs: a single spiffe:// URI SAN and no common name
+	AllowedSANs         []string          `yaml:"allowed_sans,omitempty"`         // Patterns every SAN must match ('*' wildcards, CIDR ranges for IPs)
+	Issuer              string            `yaml:"issuer,omitempty"`               // Issuer name (default: routed by extended key usage)
+	CRLURL              string            `yaml:"crl_url,omitempty"`              // Overrides crl_url and the issuer's crl_url
+	OCSPURL             string            `yaml:"ocsp_url,omitempty"`             // Overrides ocsp_url and the issuer's ocsp_url
+	CertificatePolicies []PolicyConfig    `yaml:"certificate_policies,omitempty"` // Replaces the top-level certificate_policies
+	Extensions          []ExtensionConfig `yaml:"extensions,omitempty"`           // Additional custom extensions
+}
+
+// ExtensionConfig describes a custom certificate extension
+type ExtensionConfig struct {
+	OID      string `yaml:"oid"`
+	Critical bool   `yaml:"critical,omitempty"`
+	Value    string `yaml:"value"` // Hex-encoded DER value
+}
+
+// PolicyConfig describes a certificate policy and its optional qualifiers
+type PolicyConfig struct {
+	OID        string   `yaml:"oid"`                   // Dotted policy OID, e.g. 1.3.6.1.4.1.99999.1
+	CPS        []string `yaml:"cps,omitempty"`         // URLs of the certification practice statement
+	UserNotice string   `yaml:"user_notice,omitempty"` // Explicit text shown to relying parties
+}
+
+// SubjectConfig describes a certificate subject distinguished name
+type SubjectConfig struct {
+	CommonName         string            `yaml:"common_name"` // Empty for the certy default
+	Organization       string            `yaml:"organization,omitempty"`
+	OrganizationalUnit string            `yaml:"organizational_unit,omitempty"`
+	Country            string            `yaml:"country,omitempty"`  // Two-letter ISO 3166 code
+	Province           string            `yaml:"province,omitempty"` // State or province
+	Locality           string            `yaml:"locality,omitempty"`
+	SerialNumber       string            `yaml:"serial_number,omitempty"` // Subject serialNumber attribute, not the certificate serial
+	Attributes         []AttributeConfig `yaml:"attributes,omitempty"`    // Additional attributes by OID
+}
+
+// AttributeConfig describes a subject attribute identified by its OID
+type AttributeConfig struct {
+	OID   string `yaml:"oid"` // Dotted OID, e.g. 2.5.4.97 (organizationIdentifier)
+	Value string `yaml:"value"`
+}
+
+// PKCS11Config configures the PKCS#11 key backend
+type PKCS11Config struct {
+	Module     string `yaml:"module"`               // Path to the PKCS#11 module (e.g. libsofthsm2.so)
+	TokenLabel string `yaml:"token_label"`          // Label of the token holding the CA keys
+	Slot       *int   `yaml:"slot,omitempty"`       // Slot number, as an alternative to token_label
+	PinFile    string `yaml:"pin_file"`             // File containing the user PIN (default: $CERTY_PKCS11_PIN or prompt)
+	KeyPrefix  string `yaml:"key_prefix,omitempty"` // Prefix for CA key labels inside the token
 }
 
 // DefaultConfig returns the default configuration
@@ -27,13 +148,38 @@ func DefaultConfig() *Config {
 		IntCAValidityDays:   1825,
 		DefaultKeyType:      "rsa",
 		DefaultKeySize:      2048,
+		Backdate:            "24h",
+		IssuerExpiryPolicy:  issuerExpiryClamp,
+		ExpiryWarningDays:   90,
 		CRLURL:              "http://crl.local/intermediate.crl", // Default CRL distribution point
 		OCSPURL:             "http://ocsp.local",                 // Default OCSP responder URL
+		KeyBackend:          "file",
+		EncryptCAKeys:       true,
+		PKCS11:              PKCS11Config{KeyPrefix: "certy-"},
+		CA: CAConfig{
+			Root:         SubjectConfig{CommonName: defaultRootCN, Organization: "Certy"},
+			Intermediate: SubjectConfig{CommonName: defaultIntermediateCN, Organization: "Certy"},
+		},
 	}
 }
 
-// getCertyDir returns the directory where certy stores its files
+// getCertyDir returns the directory of the selected CA. This is the certy
+// home itself unless a named CA is selected (see selectedCAName).
 func getCertyDir() (string, error) {
+	home, err := getCertyHome()
+	if err != nil {
+		return "", err
+	}
+
+	name, err := selectedCAName(home)
+	if err != nil {
+		return "", err
+	}
+	return namedCADir(home, name), nil
+}
+
+// getCertyHome returns the directory where certy stores its files
+func getCertyHome() (string, error) {
 	// Priority 1: Use custom directory if specified via -ca-dir flag
 	if customCADir != "" {
 		absPath, err := filepath.Abs(customCADir)
@@ -93,6 +239,20 @@ func loadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	// CAs installed before encrypt_ca_keys existed have unencrypted keys and
+	// a config without the setting. Keep them unencrypted until the keys are
+	// migrated with -encrypt-ca-keys, rather than mixing encrypted new keys
+	// with the existing ones.
+	var explicit struct {
+		EncryptCAKeys *bool `yaml:"encrypt_ca_keys"`
+	}
+	if err := yaml.Unmarshal(data, &explicit); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if explicit.EncryptCAKeys == nil && slices.ContainsFunc(caKeyNames(cfg), func(name string) bool { return caFileExists(name + "-key.pem") }) {
+		cfg.EncryptCAKeys = false
+	}
+
 	// Validate configuration
 	if err := validateConfig(cfg); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -125,12 +285,22 @@ func validateConfig(cfg *Config) error {
 		return fmt.Errorf("intermediate_ca_validity_days cannot exceed 3650 (10 years), got %d", cfg.IntCAValidityDays)
 	}
 
+	if _, err := cfg.backdate(); err != nil {
+		return err
+	}
+	if cfg.IssuerExpiryPolicy != "" && cfg.IssuerExpiryPolicy != issuerExpiryClamp && cfg.IssuerExpiryPolicy != issuerExpiryRefuse {
+		return fmt.Errorf("issuer_expiry_policy must be 'clamp' or 'refuse', got '%s'", cfg.IssuerExpiryPolicy)
+	}
+	if cfg.ExpiryWarningDays < 0 || cfg.ExpiryWarningDays > 3650 {
+		return fmt.Errorf("issuer_expiry_warning_days must be between 0 and 3650, got %d", cfg.ExpiryWarningDays)
+	}
+
 	// Validate key type
-	if cfg.DefaultKeyType != "rsa" && cfg.DefaultKeyType != "ecdsa" {
-		return fmt.Errorf("default_key_type must be 'rsa' or 'ecdsa', got '%s'", cfg.DefaultKeyType)
+	if cfg.DefaultKeyType != "rsa" && cfg.DefaultKeyType != "ecdsa" && cfg.DefaultKeyType != "ed25519" {
+		return fmt.Errorf("default_key_type must be 'rsa', 'ecdsa' or 'ed25519', got '%s'", cfg.DefaultKeyType)
 	}
 
-	// Validate key size
+	// Validate key size (Ed25519 keys have a fixed size, so it is not checked)
 	if cfg.DefaultKeyType == "rsa" {
 		// RSA key sizes must be 2048, 3072, or 4096
 		if cfg.DefaultKeySize != 2048 && cfg.DefaultKeySize != 3072 && cfg.DefaultKeySize != 4096 {
@@ -143,6 +313,60 @@ func validateConfig(cfg *Config) error {
 		}
 	}
 
+	// Validate the issuer publication URL
+	if cfg.CAIssuersURL != "" {
+		u, err := url.Parse(cfg.CAIssuersURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("ca_issuers_url must be an http or https URL, got '%s'", cfg.CAIssuersURL)
+		}
+	}
+
+	// Validate key backend (empty means the file backend)
+	switch cfg.KeyBackend {
+	case "", "file":
+	case "pkcs11":
+		if cfg.PKCS11.Module == "" {
+			return fmt.Errorf("pkcs11.module is required when key_backend is 'pkcs11'")
+		}
+		if (cfg.PKCS11.TokenLabel == "") == (cfg.PKCS11.Slot == nil) {
+			return fmt.Errorf("exactly one of pkcs11.token_label or pkcs11.slot must be set")
+		}
+		if cfg.DefaultKeyType == "ed25519" {
+			return fmt.Errorf("default_key_type 'ed25519' is not supported with key_backend 'pkcs11'")
+		}
+	default:
+		return fmt.Errorf("key_backend must be 'file' or 'pkcs11', got '%s'", cfg.KeyBackend)
+	}
+
+	// Validate CA subjects
+	if err := validateSubject("ca.root", cfg.CA.Root, cfg.CA.UniqueSuffix); err != nil {
+		return err
+	}
+	if err := validateSubject("ca.intermediate", cfg.CA.Intermediate, cfg.CA.UniqueSuffix); err != nil {
+		return err
+	}
+	if cfg.CA.Root.pkixName(defaultRootCN, "").CommonName == cfg.CA.Intermediate.pkixName(defaultIntermediateCN, "").CommonName {
+		return fmt.Errorf("ca.root.common_name and ca.intermediate.common_name must differ")
+	}
+	if err := validateIssuers(cfg); err != nil {
+		return err
+	}
+	if err := validateHierarchy(cfg); err != nil {
+		return err
+	}
+	if err := validatePolicies("certificate_policies", cfg.CertificatePolicies); err != nil {
+		return err
+	}
+	if err := validateSPIFFETrustDomains(cfg.SPIFFETrustDomains); err != nil {
+		return err
+	}
+	if err := validateProfiles(cfg); err != nil {
+		return err
+	}
+	if err := cfg.CA.NameConstraints.validate(); err != nil {
+		return err
+	}
+
 	// Validate intermediate CA validity is less than root CA
 	if cfg.IntCAValidityDays >= cfg.RootCAValidityDays {
 		return fmt.Errorf("intermediate_ca_validity_days (%d) must be less than root_ca_validity_days (%d)",
@@ -193,19 +417,57 @@ func getCAFilePath(filename string) (string, error) {
 	return filepath.Join(dir, filename), nil
 }
 
-// caExists checks if the CA infrastructure is installed
+// CAState describes how far the CA in the certy directory has been set up
+type CAState int
+
+const (
+	CAMissing CAState = iota // No usable CA
+	CAPending                // Intermediate key and CSR exist, waiting for the signed certificate
+	CAReady                  // Root and intermediate certificates and the intermediate key exist
+)
+
+// caStatus reports the state of the CA in the certy directory
+func caStatus() CAState {
+	// CA keys are looked up through the configured key backend
+	cfg, err := loadConfig()
+	if err != nil {
+		cfg = DefaultConfig()
+	}
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return CAMissing
+	}
+
+	// The root key is optional, e.g. for an imported or externally signed
+	// intermediate. If the backend cannot be searched, the certificate files
+	// decide, so the error surfaces when the key is used instead of the CA
+	// being taken for missing.
+	if has, err := backend.HasKey("intermediateCA"); err == nil && !has {
+		return CAMissing
+	}
+
+	if caFileExists("rootCA.pem") && caFileExists("intermediateCA.pem") {
+		return CAReady
+	}
+	if caFileExists("intermediateCA.csr") {
+		return CAPending
+	}
+	return CAMissing
+}
+
+// caExists checks if the CA is ready to issue certificates
 func caExists() bool {
-	files := []string{"rootCA.pem", "rootCA-key.pem", "intermediateCA.pem", "intermediateCA-key.pem"}
-	for _, file := range files {
-		path, err := getCAFilePath(file)
-		if err != nil {
-			return false
-		}
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			return false
-		}
+	return caStatus() == CAReady
+}
+
+// caFileExists reports whether a file exists in the certy directory
+func caFileExists(name string) bool {
+	path, err := getCAFilePath(name)
+	if err != nil {
+		return false
 	}
-	return true
+	_, err = os.Stat(path)
+	return err == nil
 }
 
 // getSerialNumber reads and increments the serial number
@@ -242,3 +504,66 @@ func getSerialNumber() (int64, error) {
 
 	return serial, nil
 }
+
+// validateSubject checks a subject against the X.520 upper bounds (RFC 5280 Appendix A)
+func validateSubject(section string, subject SubjectConfig, uniqueSuffix bool) error {
+	maxCN := 64
+	if uniqueSuffix {
+		maxCN -= len(" ") + caSuffixLength
+	}
+	if subject.CommonName != "" && strings.TrimSpace(subject.CommonName) == "" {
+		return fmt.Errorf("%s.common_name must not be blank", section)
+	}
+	if len(subject.CommonName) > maxCN {
+		return fmt.Errorf("%s.common_name cannot exceed %d characters, got %d", section, maxCN, len(subject.CommonName))
+	}
+	if len(subject.Organization) > 64 {
+		return fmt.Errorf("%s.organization cannot exceed 64 characters, got %d", section, len(subject.Organization))
+	}
+	if len(subject.OrganizationalUnit) > 64 {
+		return fmt.Errorf("%s.organizational_unit cannot exceed 64 characters, got %d", section, len(subject.OrganizationalUnit))
+	}
+	if len(subject.Province) > 128 {
+		return fmt.Errorf("%s.province cannot exceed 128 characters, got %d", section, len(subject.Province))
+	}
+	if len(subject.Locality) > 128 {
+		return fmt.Errorf("%s.locality cannot exceed 128 characters, got %d", section, len(subject.Locality))
+	}
+	if subject.Country != "" {
+		if len(subject.Country) != 2 || !isUpperASCII(subject.Country[0]) || !isUpperASCII(subject.Country[1]) {
+			return fmt.Errorf("%s.country must be a two-letter uppercase ISO 3166 code, got '%s'", section, subject.Country)
+		}
+	}
+	if len(subject.SerialNumber) > 64 {
+		return fmt.Errorf("%s.serial_number cannot exceed 64 characters, got %d", section, len(subject.SerialNumber))
+	}
+	for _, attr := range subject.Attributes {
+		if _, err := parseOID(attr.OID); err != nil {
+			return fmt.Errorf("%s.attributes: %w", section, err)
+		}
+		if field, ok := subjectAttributeFields[attr.OID]; ok {
+			return fmt.Errorf("%s.attributes: use %s instead of %s", section, field, attr.OID)
+		}
+		if attr.Value == "" || len(attr.Value) > 256 {
+			return fmt.Errorf("%s.attributes: value of %s must be 1 to 256 characters", section, attr.OID)
+		}
+	}
+	return nil
+}
+
+// subjectAttributeFields maps the OIDs of the subject attributes with their
+// own setting to the name of that setting
+var subjectAttributeFields = map[string]string{
+	"2.5.4.3":  "common_name",
+	"2.5.4.5":  "serial_number",
+	"2.5.4.6":  "country",
+	"2.5.4.7":  "locality",
+	"2.5.4.8":  "province",
+	"2.5.4.10": "organization",
+	"2.5.4.11": "organizational_unit",
+}
+
+// isUpperASCII reports whether c is an ASCII uppercase letter
+func isUpperASCII(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
@@ -189,6 +189,37 @@ func TestCAExists(t *testing.T) {
 	}
 }
 
+func TestCAStatus(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if caStatus() != CAMissing {
+		t.Error("Expected missing CA in empty directory")
+	}
+
+	// Intermediate key with a CSR is pending
+	for _, file := range []string{"intermediateCA-key.pem", "intermediateCA.csr"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, file), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if caStatus() != CAPending {
+		t.Error("Expected pending CA with intermediate key and CSR")
+	}
+
+	// Certificates without a root key make the CA ready
+	for _, file := range []string{"rootCA.pem", "intermediateCA.pem"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, file), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if caStatus() != CAReady {
+		t.Error("Expected ready CA once the certificates exist")
+	}
+}
+
 func TestGetCAFilePath(t *testing.T) {
 	// Create temp directory
 	tmpDir := t.TempDir()
@@ -335,7 +366,7 @@ func TestValidateConfig(t *testing.T) {
 				DefaultKeySize:      2048,
 			},
 			wantErr: true,
-			errMsg:  "default_key_type must be 'rsa' or 'ecdsa'",
+			errMsg:  "default_key_type must be 'rsa', 'ecdsa' or 'ed25519'",
 		},
 		{
 			name: "invalid RSA key size",
@@ -416,6 +447,171 @@ func TestValidateConfig(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "invalid key backend",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				KeyBackend:          "hsm",
+			},
+			wantErr: true,
+			errMsg:  "key_backend must be",
+		},
+		{
+			name: "valid CA subjects",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				CA: CAConfig{
+					Root:         SubjectConfig{CommonName: "Acme Root CA", Organization: "Acme", Country: "US", Province: "Texas", Locality: "Austin"},
+					Intermediate: SubjectConfig{CommonName: "Acme Issuing CA", OrganizationalUnit: "Platform"},
+					UniqueSuffix: true,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid CA country",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				CA:                  CAConfig{Root: SubjectConfig{Country: "USA"}},
+			},
+			wantErr: true,
+			errMsg:  "ca.root.country must be a two-letter",
+		},
+		{
+			name: "subject attribute with a dedicated setting",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				CA:                  CAConfig{Root: SubjectConfig{Attributes: []AttributeConfig{{OID: "2.5.4.10", Value: "Acme"}}}},
+			},
+			wantErr: true,
+			errMsg:  "use organization instead of 2.5.4.10",
+		},
+		{
+			name: "invalid subject attribute OID",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				CA:                  CAConfig{Root: SubjectConfig{Attributes: []AttributeConfig{{OID: "organizationIdentifier", Value: "x"}}}},
+			},
+			wantErr: true,
+			errMsg:  "invalid OID",
+		},
+		{
+			name: "identical CA common names",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				CA: CAConfig{
+					Root:         SubjectConfig{CommonName: "Acme CA"},
+					Intermediate: SubjectConfig{CommonName: "Acme CA"},
+				},
+			},
+			wantErr: true,
+			errMsg:  "must differ",
+		},
+		{
+			name: "CA common name too long for suffix",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				CA: CAConfig{
+					Intermediate: SubjectConfig{CommonName: strings.Repeat("a", 60)},
+					UniqueSuffix: true,
+				},
+			},
+			wantErr: true,
+			errMsg:  "ca.intermediate.common_name cannot exceed 55 characters",
+		},
+		{
+			name: "valid pkcs11 backend",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "ecdsa",
+				DefaultKeySize:      256,
+				KeyBackend:          "pkcs11",
+				PKCS11:              PKCS11Config{Module: "/usr/lib/softhsm/libsofthsm2.so", TokenLabel: "certy"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "pkcs11 backend without module",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				KeyBackend:          "pkcs11",
+				PKCS11:              PKCS11Config{TokenLabel: "certy"},
+			},
+			wantErr: true,
+			errMsg:  "pkcs11.module is required",
+		},
+		{
+			name: "pkcs11 backend without token",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "rsa",
+				DefaultKeySize:      2048,
+				KeyBackend:          "pkcs11",
+				PKCS11:              PKCS11Config{Module: "/usr/lib/softhsm/libsofthsm2.so"},
+			},
+			wantErr: true,
+			errMsg:  "exactly one of pkcs11.token_label or pkcs11.slot",
+		},
+		{
+			name: "pkcs11 backend with ed25519",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "ed25519",
+				KeyBackend:          "pkcs11",
+				PKCS11:              PKCS11Config{Module: "/usr/lib/softhsm/libsofthsm2.so", TokenLabel: "certy"},
+			},
+			wantErr: true,
+			errMsg:  "not supported with key_backend 'pkcs11'",
+		},
+		{
+			name: "valid Ed25519 ignores key size",
+			config: &Config{
+				DefaultValidityDays: 365,
+				RootCAValidityDays:  3650,
+				IntCAValidityDays:   1825,
+				DefaultKeyType:      "ed25519",
+				DefaultKeySize:      2048,
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -475,7 +671,7 @@ intermediate_ca_validity_days: 1825
 default_key_type: dsa
 default_key_size: 2048`,
 			wantErr: true,
-			errMsg:  "default_key_type must be 'rsa' or 'ecdsa'",
+			errMsg:  "default_key_type must be 'rsa', 'ecdsa' or 'ed25519'",
 		},
 	}
 
@@ -541,3 +737,69 @@ func TestSaveConfigWithValidation(t *testing.T) {
 		}
 	})
 }
+
+func TestLegacyConfigKeepsCAKeysUnencrypted(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// A config without encrypt_ca_keys and no CA yet encrypts new keys
+	configPath := filepath.Join(tmpDir, "config.yml")
+	if err := os.WriteFile(configPath, []byte("default_key_type: ecdsa\ndefault_key_size: 256\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.EncryptCAKeys {
+		t.Error("Expected encrypt_ca_keys to default to true for a new CA")
+	}
+
+	// Simulate a CA installed before the setting existed
+	cfg.EncryptCAKeys = false
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	var legacy []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "encrypt_ca_keys:") {
+			legacy = append(legacy, line)
+		}
+	}
+	if err := os.WriteFile(configPath, []byte(strings.Join(legacy, "\n")), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	// Its keys stay unencrypted across rotations and reinstalls
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.EncryptCAKeys {
+		t.Error("Expected an existing CA without encrypt_ca_keys to keep unencrypted keys")
+	}
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	if _, err := reinstallCA(); err != nil {
+		t.Fatalf("Failed to reinstall CA: %v", err)
+	}
+	for _, name := range []string{"rootCA", "intermediateCA"} {
+		encrypted, err := caKeyEncrypted(name)
+		if err != nil {
+			t.Fatalf("Failed to read %s key: %v", name, err)
+		}
+		if encrypted {
+			t.Errorf("Expected the %s key to stay unencrypted", name)
+		}
+	}
+}
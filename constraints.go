@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// validate checks the configured name constraints
+func (nc NameConstraintsConfig) validate() error {
+	for _, list := range []struct {
+		field   string
+		domains []string
+	}{
+		{"permitted_dns_domains", nc.PermittedDNSDomains},
+		{"excluded_dns_domains", nc.ExcludedDNSDomains},
+		{"permitted_email_addresses", nc.PermittedEmailAddresses},
+		{"excluded_email_addresses", nc.ExcludedEmailAddresses},
+		{"permitted_uri_domains", nc.PermittedURIDomains},
+		{"excluded_uri_domains", nc.ExcludedURIDomains},
+	} {
+		for _, domain := range list.domains {
+			if domain == "" || strings.ContainsAny(domain, "*/: ") {
+				return fmt.Errorf("ca.name_constraints.%s: invalid entry %q", list.field, domain)
+			}
+		}
+	}
+
+	if _, err := parseIPRanges(nc.PermittedIPRanges); err != nil {
+		return fmt.Errorf("ca.name_constraints.permitted_ip_ranges: %w", err)
+	}
+	if _, err := parseIPRanges(nc.ExcludedIPRanges); err != nil {
+		return fmt.Errorf("ca.name_constraints.excluded_ip_ranges: %w", err)
+	}
+	return nil
+}
+
+// apply writes the name constraints to an intermediate CA template, marking
+// the extension critical. Nothing is written if no constraints are configured.
+func (nc NameConstraintsConfig) apply(template *x509.Certificate) error {
+	permittedIPs, err := parseIPRanges(nc.PermittedIPRanges)
+	if err != nil {
+		return err
+	}
+	excludedIPs, err := parseIPRanges(nc.ExcludedIPRanges)
+	if err != nil {
+		return err
+	}
+
+	template.PermittedDNSDomains = nc.PermittedDNSDomains
+	template.ExcludedDNSDomains = nc.ExcludedDNSDomains
+	template.PermittedIPRanges = permittedIPs
+	template.ExcludedIPRanges = excludedIPs
+	template.PermittedEmailAddresses = nc.PermittedEmailAddresses
+	template.ExcludedEmailAddresses = nc.ExcludedEmailAddresses
+	template.PermittedURIDomains = nc.PermittedURIDomains
+	template.ExcludedURIDomains = nc.ExcludedURIDomains
+	template.PermittedDNSDomainsCritical = hasNameConstraints(template)
+	return nil
+}
+
+// parseIPRanges parses a list of CIDR ranges
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q (use CIDR notation, e.g. 10.0.0.0/8)", r)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// hasNameConstraints reports whether a CA certificate carries any name constraints
+func hasNameConstraints(ca *x509.Certificate) bool {
+	return len(ca.PermittedDNSDomains) > 0 || len(ca.ExcludedDNSDomains) > 0 ||
+		len(ca.PermittedIPRanges) > 0 || len(ca.ExcludedIPRanges) > 0 ||
+		len(ca.PermittedEmailAddresses) > 0 || len(ca.ExcludedEmailAddresses) > 0 ||
+		len(ca.PermittedURIDomains) > 0 || len(ca.ExcludedURIDomains) > 0
+}
+
+// checkNameConstraints returns an error if any subject alternative name of
+// template is not permitted by the name constraints of the issuing CA, so a
+// certificate that clients would reject is never signed
+func checkNameConstraints(issuer *x509.Certificate, template *x509.Certificate) error {
+	if !hasNameConstraints(issuer) {
+		return nil
+	}
+
+	for _, name := range template.DNSNames {
+		if err := checkNameLists("DNS name", name, issuer.PermittedDNSDomains, issuer.ExcludedDNSDomains, matchDomainConstraint); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range template.IPAddresses {
+		if err := checkIPRanges(ip, issuer.PermittedIPRanges, issuer.ExcludedIPRanges); err != nil {
+			return err
+		}
+	}
+
+	for _, email := range template.EmailAddresses {
+		if err := checkNameLists("email address", email, issuer.PermittedEmailAddresses, issuer.ExcludedEmailAddresses, matchEmailConstraint); err != nil {
+			return err
+		}
+	}
+
+	for _, uri := range template.URIs {
+		host := uri.Hostname()
+		if host == "" || net.ParseIP(host) != nil {
+			if len(issuer.PermittedURIDomains) > 0 || len(issuer.ExcludedURIDomains) > 0 {
+				return fmt.Errorf("URI %q has no domain name and cannot satisfy the issuer's name constraints", uri)
+			}
+			continue
+		}
+		if err := checkNameLists("URI", host, issuer.PermittedURIDomains, issuer.ExcludedURIDomains, matchDomainConstraint); err != nil {
+			return fmt.Errorf("%w (%s)", err, uri)
+		}
+	}
+
+	return nil
+}
+
+// checkNameLists checks a name against permitted and excluded constraint lists
+func checkNameLists(kind, name string, permitted, excluded []string, match func(name, constraint string) bool) error {
+	for _, constraint := range excluded {
+		if match(name, constraint) {
+			return fmt.Errorf("%s %q is excluded by the issuer's name constraints (%s)", kind, name, constraint)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil
+	}
+	for _, constraint := range permitted {
+		if match(name, constraint) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q is not permitted by the issuer's name constraints", kind, name)
+}
+
+// checkIPRanges checks an IP address against permitted and excluded ranges
+func checkIPRanges(ip net.IP, permitted, excluded []*net.IPNet) error {
+	for _, ipNet := range excluded {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("IP address %s is excluded by the issuer's name constraints (%s)", ip, ipNet)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil
+	}
+	for _, ipNet := range permitted {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("IP address %s is not permitted by the issuer's name constraints", ip)
+}
+
+// matchDomainConstraint reports whether domain matches a domain constraint.
+// A constraint matches itself and its subdomains; with a leading "." it
+// matches subdomains only.
+func matchDomainConstraint(domain, constraint string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	constraint = strings.ToLower(constraint)
+	if sub, ok := strings.CutPrefix(constraint, "."); ok {
+		return strings.HasSuffix(domain, "."+sub)
+	}
+	return domain == constraint || strings.HasSuffix(domain, "."+constraint)
+}
+
+// matchEmailConstraint reports whether an email address matches a constraint,
+// which is either a full mailbox or a domain as in matchDomainConstraint
+func matchEmailConstraint(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	return matchDomainConstraint(email[at+1:], constraint)
+}
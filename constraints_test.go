@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchDomainConstraint(t *testing.T) {
+	tests := []struct {
+		domain     string
+		constraint string
+		want       bool
+	}{
+		{"internal.example.com", "internal.example.com", true},
+		{"api.internal.example.com", "internal.example.com", true},
+		{"*.internal.example.com", "internal.example.com", true},
+		{"API.Internal.Example.com", "internal.example.com", true},
+		{"notinternal.example.com", "internal.example.com", false},
+		{"example.com", "internal.example.com", false},
+		{"internal.example.com", ".internal.example.com", false},
+		{"api.internal.example.com", ".internal.example.com", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchDomainConstraint(tt.domain, tt.constraint); got != tt.want {
+			t.Errorf("matchDomainConstraint(%q, %q) = %v, expected %v", tt.domain, tt.constraint, got, tt.want)
+		}
+	}
+}
+
+func TestCheckNameConstraints(t *testing.T) {
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, badNet, _ := net.ParseCIDR("10.66.0.0/16")
+	issuer := &x509.Certificate{
+		PermittedDNSDomains:     []string{"internal.example.com"},
+		ExcludedDNSDomains:      []string{"secret.internal.example.com"},
+		PermittedIPRanges:       []*net.IPNet{tenNet},
+		ExcludedIPRanges:        []*net.IPNet{badNet},
+		PermittedEmailAddresses: []string{"example.com"},
+		PermittedURIDomains:     []string{".example.com"},
+	}
+
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+		wantErr  string
+	}{
+		{"permitted names", &x509.Certificate{
+			DNSNames:       []string{"api.internal.example.com", "*.internal.example.com"},
+			IPAddresses:    []net.IP{net.ParseIP("10.1.2.3")},
+			EmailAddresses: []string{"user@example.com"},
+			URIs:           []*url.URL{{Scheme: "spiffe", Host: "prod.example.com", Path: "/svc"}},
+		}, ""},
+		{"DNS outside permitted", &x509.Certificate{DNSNames: []string{"www.example.com"}}, "not permitted"},
+		{"DNS excluded", &x509.Certificate{DNSNames: []string{"db.secret.internal.example.com"}}, "excluded"},
+		{"IP outside permitted", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("192.168.1.1")}}, "not permitted"},
+		{"IP excluded", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.66.1.1")}}, "excluded"},
+		{"email outside permitted", &x509.Certificate{EmailAddresses: []string{"user@other.com"}}, "not permitted"},
+		{"URI outside permitted", &x509.Certificate{URIs: []*url.URL{{Scheme: "https", Host: "other.com"}}}, "not permitted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkNameConstraints(issuer, tt.template)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected names to be permitted, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// An issuer without constraints permits everything
+	if err := checkNameConstraints(&x509.Certificate{}, &x509.Certificate{DNSNames: []string{"anything.test"}}); err != nil {
+		t.Errorf("Expected unconstrained issuer to permit all names, got %v", err)
+	}
+}
+
+func TestValidateNameConstraints(t *testing.T) {
+	tests := []struct {
+		name        string
+		constraints NameConstraintsConfig
+		wantErr     bool
+	}{
+		{"valid", NameConstraintsConfig{PermittedDNSDomains: []string{"internal.example.com"}, PermittedIPRanges: []string{"10.0.0.0/8"}}, false},
+		{"wildcard domain", NameConstraintsConfig{PermittedDNSDomains: []string{"*.internal.example.com"}}, true},
+		{"empty domain", NameConstraintsConfig{ExcludedURIDomains: []string{""}}, true},
+		{"IP without prefix", NameConstraintsConfig{PermittedIPRanges: []string{"10.0.0.1"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.CA.NameConstraints = tt.constraints
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected valid config, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInstallCAWithNameConstraints(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Restrict the intermediate to internal names before installing
+	cfg := DefaultConfig()
+	cfg.CA.NameConstraints = NameConstraintsConfig{
+		PermittedDNSDomains: []string{"internal.example.com"},
+		PermittedIPRanges:   []string{"10.0.0.0/8"},
+	}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Verify the intermediate carries a critical name constraints extension
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	oidNameConstraints := asn1.ObjectIdentifier{2, 5, 29, 30}
+	found := false
+	for _, ext := range intCert.Extensions {
+		if ext.Id.Equal(oidNameConstraints) {
+			found = true
+			if !ext.Critical {
+				t.Error("Expected name constraints extension to be critical")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Expected name constraints extension on the intermediate CA")
+	}
+	if len(intCert.PermittedIPRanges) != 1 || intCert.PermittedIPRanges[0].String() != "10.0.0.0/8" {
+		t.Errorf("Unexpected permitted IP ranges %v", intCert.PermittedIPRanges)
+	}
+
+	// Permitted names are issued and verify against the chain
+	certPath := filepath.Join(tmpDir, "ok.pem")
+	opts := CertOptions{CertFile: certPath, KeyFile: filepath.Join(tmpDir, "ok-key.pem")}
+	if _, _, err := generateCertificate([]string{"*.internal.example.com", "10.1.2.3"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate permitted certificate: %v", err)
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intCert)
+	if _, err := loadCertFromFile(t, certPath).Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Failed to verify certificate chain: %v", err)
+	}
+
+	// Names outside the constraints are refused without using a serial
+	serialBefore, err := readSerialFile()
+	if err != nil {
+		t.Fatalf("Failed to read serial: %v", err)
+	}
+	opts = CertOptions{CertFile: filepath.Join(tmpDir, "bad.pem"), KeyFile: filepath.Join(tmpDir, "bad-key.pem")}
+	if _, _, err := generateCertificate([]string{"www.example.com"}, CertTypeTLS, opts, cfg); err == nil {
+		t.Error("Expected error issuing a certificate outside the name constraints")
+	}
+	if _, _, err := generateCertificate([]string{"api.internal.example.com", "192.168.1.1"}, CertTypeTLS, opts, cfg); err == nil {
+		t.Error("Expected error issuing a certificate for an IP outside the name constraints")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "bad.pem")); !os.IsNotExist(err) {
+		t.Error("Expected no certificate to be written")
+	}
+	serialAfter, err := readSerialFile()
+	if err != nil {
+		t.Fatalf("Failed to read serial: %v", err)
+	}
+	if serialAfter != serialBefore {
+		t.Errorf("Expected serial to stay at %d, got %d", serialBefore, serialAfter)
+	}
+
+	// CSRs are checked too
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"www.example.com"}}, csrKey)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+	csrPath := filepath.Join(tmpDir, "bad.csr")
+	if err := os.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 0644); err != nil {
+		t.Fatalf("Failed to write CSR: %v", err)
+	}
+	if _, err := generateFromCSR(csrPath, CertOptions{CertFile: filepath.Join(tmpDir, "csr.pem")}, cfg); err == nil {
+		t.Error("Expected error issuing a CSR outside the name constraints")
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
+	"io/fs"
 	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -20,12 +25,98 @@ type RevokedCertificate struct {
 
 // generateCRL generates a Certificate Revocation List (CRL)
 func generateCRL(crlFile string) error {
+	return generateIssuerCRL(crlFile, "")
+}
+
+// generateIssuerCRL generates a CRL signed by the named issuer (see
+// issuerBaseName), listing the revoked certificates it issued
+func generateIssuerCRL(crlFile, issuer string) error {
 	// Load intermediate CA
-	intKey, intCert, err := loadIntermediateCA()
+	intKey, intCert, err := loadIssuer(issuer)
 	if err != nil {
 		return fmt.Errorf("failed to load intermediate CA: %w", err)
 	}
 
+	return writeCRL(crlFile, issuerCRLName(issuer), intKey, intCert)
+}
+
+// generateArchivedCRL generates a CRL signed by an intermediate archived by
+// -rotate-intermediate, so the certificates it issued can still be revoked.
+// archiveName is the archive directory relative to the certy directory (the
+// archive/ prefix may be omitted) and issuer names an archived issuer. The
+// CRL is written to crlFile, or next to the archived certificate.
+func generateArchivedCRL(crlFile, archiveName, issuer string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the archive directory, which must stay inside archive/
+	archiveName = filepath.Clean(archiveName)
+	if !strings.HasPrefix(archiveName, archiveDirName+string(filepath.Separator)) {
+		archiveName = filepath.Join(archiveDirName, archiveName)
+	}
+	if !filepath.IsLocal(archiveName) || filepath.Dir(archiveName) != archiveDirName {
+		return fmt.Errorf("%s is not a directory in %s", archiveName, archiveDirName)
+	}
+
+	// Load the archived intermediate CA
+	baseName := filepath.Join(archiveName, issuerBaseName(issuer))
+	intCert, err := loadCACertificate(baseName)
+	if err != nil {
+		return fmt.Errorf("failed to load archived intermediate CA: %w", err)
+	}
+	has, err := backend.HasKey(baseName)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("%s has no key for %s", archiveName, issuerBaseName(issuer))
+	}
+	intKey, err := backend.Signer(baseName)
+	if err != nil {
+		return err
+	}
+	if findCertificateForKey([]*x509.Certificate{intCert}, intKey) == nil {
+		return fmt.Errorf("archived key does not match the archived certificate in %s", archiveName)
+	}
+
+	return writeCRL(crlFile, filepath.Join(archiveName, issuerCRLName(issuer)), intKey, intCert)
+}
+
+// generateRootCRL generates a CRL signed by the root CA, which may be offline
+// and given with -root-key. Intermediates are revoked with revokeCertificate
+// like any other certificate; the root CRL lists those the root signed.
+func generateRootCRL(crlFile string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Load root CA
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		return err
+	}
+	rootKey, err := loadRootKey(backend, rootCert)
+	if err != nil {
+		return err
+	}
+
+	return writeCRL(crlFile, "rootCA-crl.pem", rootKey, rootCert)
+}
+
+// writeCRL signs a CRL of the revoked certificates issued by the given CA and
+// writes it to crlFile, or to defaultName in the CA directory
+func writeCRL(crlFile, defaultName string, caKey crypto.Signer, caCert *x509.Certificate) error {
 	// Load revoked certificates list (if exists)
 	revokedCerts, err := loadRevokedCertificates()
 	if err != nil {
@@ -33,9 +124,20 @@ func generateCRL(crlFile string) error {
 		revokedCerts = []RevokedCertificate{}
 	}
 
-	// Create revoked certificate list for CRL
+	// Look up who issued each serial number
+	issuers, err := loadCertificateIssuers()
+	if err != nil {
+		return err
+	}
+	caID, isRoot := caKeyID(caCert), isSelfSigned(caCert)
+
+	// Create revoked certificate list for CRL. Serials of unknown origin
+	// (never issued by this CA directory) stay on the intermediate CRLs.
 	var revokedCertList []pkix.RevokedCertificate
 	for _, rc := range revokedCerts {
+		if issuer, ok := issuers[rc.SerialNumber.String()]; (ok && issuer != caID) || (!ok && isRoot) {
+			continue
+		}
 		revokedCertList = append(revokedCertList, pkix.RevokedCertificate{
 			SerialNumber:   rc.SerialNumber,
 			RevocationTime: rc.RevokedAt,
@@ -52,7 +154,7 @@ func generateCRL(crlFile string) error {
 	}
 
 	// Generate CRL
-	crlDER, err := x509.CreateRevocationList(rand.Reader, crlTemplate, intCert, intKey)
+	crlDER, err := x509.CreateRevocationList(rand.Reader, crlTemplate, caCert, caKey)
 	if err != nil {
 		return fmt.Errorf("failed to create CRL: %w", err)
 	}
@@ -67,7 +169,7 @@ func generateCRL(crlFile string) error {
 	outputPath := crlFile
 	if outputPath == "" {
 		// Default to CA directory
-		outputPath, err = getCAFilePath("crl.pem")
+		outputPath, err = getCAFilePath(defaultName)
 		if err != nil {
 			return err
 		}
@@ -81,6 +183,81 @@ func generateCRL(crlFile string) error {
 	return nil
 }
 
+// loadCertificateIssuers maps serial numbers to the key ID of the CA that
+// issued them, from issued.db and the CA certificates in the CA directory,
+// including archived ones
+func loadCertificateIssuers() (map[string]string, error) {
+	issuers := map[string]string{}
+
+	issued, err := loadIssuedCertificates()
+	if err != nil {
+		return nil, err
+	}
+	for _, ic := range issued {
+		if ic.Issuer != "" {
+			issuers[ic.SerialNumber.String()] = ic.Issuer
+		}
+	}
+
+	caDir, err := getCertyDir()
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(caDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != caDir && d.Name() == casDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".pem") || strings.HasSuffix(d.Name(), "-key.pem") {
+			return nil
+		}
+
+		cert := readCACertificateFile(path)
+		if cert != nil && len(cert.AuthorityKeyId) > 0 && !isSelfSigned(cert) {
+			issuers[cert.SerialNumber.String()] = hex.EncodeToString(cert.AuthorityKeyId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+
+	return issuers, nil
+}
+
+// setRevocationURLs adds the CRL distribution point and OCSP responder to a
+// leaf certificate template. Each issuer signs its own CRL, so issuers can
+// override crl_url and ocsp_url; the profile overrides both.
+func setRevocationURLs(template *x509.Certificate, issuer string, profile ProfileConfig, cfg *Config) {
+	crlURL, ocspURL := cfg.CRLURL, cfg.OCSPURL
+	if ic, err := findIssuerConfig(cfg, issuer); err == nil {
+		if ic.CRLURL != "" {
+			crlURL = ic.CRLURL
+		}
+		if ic.OCSPURL != "" {
+			ocspURL = ic.OCSPURL
+		}
+	}
+	if profile.CRLURL != "" {
+		crlURL = profile.CRLURL
+	}
+	if profile.OCSPURL != "" {
+		ocspURL = profile.OCSPURL
+	}
+
+	if crlURL != "" {
+		template.CRLDistributionPoints = []string{crlURL}
+	}
+	if ocspURL != "" {
+		template.OCSPServer = []string{ocspURL}
+	}
+}
+
 // loadRevokedCertificates loads the list of revoked certificates
 func loadRevokedCertificates() ([]RevokedCertificate, error) {
 	revokedPath, err := getCAFilePath("revoked.db")
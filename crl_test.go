@@ -6,6 +6,8 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -262,13 +264,19 @@ func TestCRLWithConfiguredURL(t *testing.T) {
 		t.Fatalf("Failed to parse intermediate CA cert: %v", err)
 	}
 
-	// Verify CRL distribution point
-	if len(cert.CRLDistributionPoints) != 1 {
-		t.Fatalf("Expected 1 CRL distribution point, got %d", len(cert.CRLDistributionPoints))
+	// The intermediate signs the CRL at crl_url, so it does not point to it
+	if len(cert.CRLDistributionPoints) != 0 {
+		t.Fatalf("Expected no CRL distribution point without root_crl_url, got %v", cert.CRLDistributionPoints)
 	}
 
-	if cert.CRLDistributionPoints[0] != cfg.CRLURL {
-		t.Errorf("Expected CRL URL '%s', got '%s'", cfg.CRLURL, cert.CRLDistributionPoints[0])
+	// Verify CRL distribution point of an issued certificate
+	leaf := issueTestLeaf(t, tmpDir, "leaf", cfg)
+	if len(leaf.CRLDistributionPoints) != 1 {
+		t.Fatalf("Expected 1 CRL distribution point, got %d", len(leaf.CRLDistributionPoints))
+	}
+
+	if leaf.CRLDistributionPoints[0] != cfg.CRLURL {
+		t.Errorf("Expected CRL URL '%s', got '%s'", cfg.CRLURL, leaf.CRLDistributionPoints[0])
 	}
 }
 
@@ -321,3 +329,253 @@ func TestLoadRevokedCertificatesNonexistent(t *testing.T) {
 		t.Errorf("Expected 0 revoked certificates from nonexistent file, got %d", len(revoked))
 	}
 }
+
+func TestLeafRevocationURLs(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure revocation URLs, with overrides for a client issuer
+	cfg := DefaultConfig()
+	cfg.CRLURL = "http://crl.example.com/intermediate.crl"
+	cfg.RootCRLURL = "http://crl.example.com/root.crl"
+	cfg.OCSPURL = "http://ocsp.example.com"
+	cfg.CA.Issuers = []IssuerConfig{{
+		Name:     "clients",
+		Purposes: []string{"client"},
+		CRLURL:   "http://crl.example.com/clients.crl",
+	}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// The intermediate points to the root CRL
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	if len(intCert.CRLDistributionPoints) != 1 || intCert.CRLDistributionPoints[0] != cfg.RootCRLURL {
+		t.Errorf("Expected intermediate CRL URL %q, got %v", cfg.RootCRLURL, intCert.CRLDistributionPoints)
+	}
+
+	tests := []struct {
+		name     string
+		certType CertificateType
+		wantCRL  string
+	}{
+		{"server", CertTypeTLS, cfg.CRLURL},
+		{"client", CertTypeClient, "http://crl.example.com/clients.crl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPath := filepath.Join(tmpDir, tt.name+".pem")
+			opts := CertOptions{CertFile: certPath, KeyFile: filepath.Join(tmpDir, tt.name+"-key.pem")}
+			if _, _, err := generateCertificate([]string{tt.name + ".example.com"}, tt.certType, opts, cfg); err != nil {
+				t.Fatalf("Failed to generate certificate: %v", err)
+			}
+			cert := loadCertFromFile(t, certPath)
+
+			if len(cert.CRLDistributionPoints) != 1 || cert.CRLDistributionPoints[0] != tt.wantCRL {
+				t.Errorf("Expected CRL URL %q, got %v", tt.wantCRL, cert.CRLDistributionPoints)
+			}
+			if len(cert.OCSPServer) != 1 || cert.OCSPServer[0] != cfg.OCSPURL {
+				t.Errorf("Expected OCSP URL %q, got %v", cfg.OCSPURL, cert.OCSPServer)
+			}
+		})
+	}
+}
+
+func TestCACRLDistributionPoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		rootCRLURL string
+		hierarchy  []TierConfig
+		wantTier   []string
+		wantInt    []string
+	}{
+		{"no root CRL URL", "", nil, nil, nil},
+		{"root CRL URL", "http://crl.example.com/root.crl", nil, nil, []string{"http://crl.example.com/root.crl"}},
+		{"below a tier", "http://crl.example.com/root.crl", []TierConfig{{Name: "policy"}}, []string{"http://crl.example.com/root.crl"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create temp directory
+			tmpDir := t.TempDir()
+			customCADir = tmpDir
+			defer func() { customCADir = "" }()
+
+			// The leaf CRL URL is never used for CA certificates
+			cfg := DefaultConfig()
+			cfg.CRLURL = "http://crl.example.com/intermediate.crl"
+			cfg.RootCRLURL = tt.rootCRLURL
+			cfg.CA.Hierarchy = tt.hierarchy
+			if err := saveConfig(cfg); err != nil {
+				t.Fatalf("Failed to save config: %v", err)
+			}
+			if err := installCA(); err != nil {
+				t.Fatalf("Failed to install CA: %v", err)
+			}
+
+			intCert, err := loadCACertificate("intermediateCA")
+			if err != nil {
+				t.Fatalf("Failed to load intermediate CA: %v", err)
+			}
+			if !slices.Equal(intCert.CRLDistributionPoints, tt.wantInt) {
+				t.Errorf("Expected intermediate CRL URLs %v, got %v", tt.wantInt, intCert.CRLDistributionPoints)
+			}
+			if len(tt.hierarchy) > 0 {
+				tierCert, err := loadCACertificate(tierBaseName(tt.hierarchy[0].Name))
+				if err != nil {
+					t.Fatalf("Failed to load CA tier: %v", err)
+				}
+				if !slices.Equal(tierCert.CRLDistributionPoints, tt.wantTier) {
+					t.Errorf("Expected tier CRL URLs %v, got %v", tt.wantTier, tierCert.CRLDistributionPoints)
+				}
+			}
+		})
+	}
+}
+
+func TestCRLScopedToIssuer(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA with a client issuer
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cfg.CA.Issuers = []IssuerConfig{{Name: "mtls", Purposes: []string{"client"}}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := addIssuer("mtls"); err != nil {
+		t.Fatalf("Failed to add issuer: %v", err)
+	}
+
+	// Issue from both intermediates and revoke everything, including the
+	// default intermediate and a serial certy never issued
+	tlsLeaf := issueTestLeaf(t, tmpDir, "tls", cfg)
+	clientPath := filepath.Join(tmpDir, "client.pem")
+	opts := CertOptions{CertFile: clientPath, KeyFile: filepath.Join(tmpDir, "client-key.pem"), Issuer: "mtls"}
+	if _, _, err := generateCertificate([]string{"client.example.com"}, CertTypeClient, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	clientLeaf := loadCertFromFile(t, clientPath)
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	for _, serial := range []string{tlsLeaf.SerialNumber.String(), clientLeaf.SerialNumber.String(), intCert.SerialNumber.String(), "999999"} {
+		if err := revokeCertificate(serial, 0); err != nil {
+			t.Fatalf("Failed to revoke certificate %s: %v", serial, err)
+		}
+	}
+
+	// Each CRL lists only the certificates its CA issued
+	tests := []struct {
+		name     string
+		generate func(string) error
+		expected []string
+	}{
+		{"intermediate", generateCRL, []string{tlsLeaf.SerialNumber.String(), "999999"}},
+		{"issuer", func(path string) error { return generateIssuerCRL(path, "mtls") }, []string{clientLeaf.SerialNumber.String(), "999999"}},
+		{"root", generateRootCRL, []string{intCert.SerialNumber.String()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crlPath := filepath.Join(tmpDir, tt.name+".crl")
+			if err := tt.generate(crlPath); err != nil {
+				t.Fatalf("Failed to generate CRL: %v", err)
+			}
+			crlData, err := os.ReadFile(crlPath)
+			if err != nil {
+				t.Fatalf("Failed to read CRL: %v", err)
+			}
+			block, _ := pem.Decode(crlData)
+			if block == nil {
+				t.Fatal("Failed to decode CRL PEM")
+			}
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				t.Fatalf("Failed to parse CRL: %v", err)
+			}
+
+			var serials []string
+			for _, entry := range crl.RevokedCertificateEntries {
+				serials = append(serials, entry.SerialNumber.String())
+			}
+			if !slices.Equal(serials, tt.expected) {
+				t.Errorf("Expected revoked serials %v, got %v", tt.expected, serials)
+			}
+		})
+	}
+}
+
+func TestArchivedIntermediateCRL(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA, issue a certificate and rotate its intermediate away
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	leaf := issueTestLeaf(t, tmpDir, "old", DefaultConfig())
+	oldInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	archiveName, err := rotateIntermediateCA("")
+	if err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	if err := revokeCertificate(leaf.SerialNumber.String(), 0); err != nil {
+		t.Fatalf("Failed to revoke certificate: %v", err)
+	}
+
+	// The archived intermediate signs the CRL listing its certificate,
+	// written next to it by default
+	if err := generateArchivedCRL("", strings.TrimPrefix(archiveName, archiveDirName+string(filepath.Separator)), ""); err != nil {
+		t.Fatalf("Failed to generate archived CRL: %v", err)
+	}
+	crlData, err := os.ReadFile(filepath.Join(tmpDir, archiveName, "crl.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read archived CRL: %v", err)
+	}
+	block, _ := pem.Decode(crlData)
+	if block == nil {
+		t.Fatal("Failed to decode CRL PEM")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse CRL: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(oldInt); err != nil {
+		t.Errorf("Expected CRL signed by the archived intermediate: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Errorf("Expected the revoked certificate on the archived CRL, got %v", crl.RevokedCertificateEntries)
+	}
+
+	// Only archive directories are accepted
+	for _, dir := range []string{"../" + filepath.Base(tmpDir), filepath.Join(archiveDirName, "missing"), "."} {
+		if err := generateArchivedCRL(filepath.Join(tmpDir, "bad.crl"), dir, ""); err == nil {
+			t.Errorf("Expected error for archive %q", dir)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -60,7 +62,7 @@ func TestGenerateFromCSR(t *testing.T) {
 
 	// Generate certificate from CSR
 	cfg, _ := loadConfig()
-	certPath, err := generateFromCSR(csrPath, "", cfg)
+	certPath, err := generateFromCSR(csrPath, CertOptions{}, cfg)
 	if err != nil {
 		t.Fatalf("Failed to generate certificate from CSR: %v", err)
 	}
@@ -150,7 +152,7 @@ func TestGenerateFromCSRWithCustomOutputPath(t *testing.T) {
 	// Generate certificate with custom output path
 	customCertPath := filepath.Join(tmpDir, "custom-cert.pem")
 	cfg, _ := loadConfig()
-	certPath, err := generateFromCSR(csrPath, customCertPath, cfg)
+	certPath, err := generateFromCSR(csrPath, CertOptions{CertFile: customCertPath}, cfg)
 	if err != nil {
 		t.Fatalf("Failed to generate certificate from CSR: %v", err)
 	}
@@ -186,7 +188,7 @@ func TestGenerateFromCSRWithInvalidCSR(t *testing.T) {
 
 	// Try to generate certificate
 	cfg, _ := loadConfig()
-	_, err := generateFromCSR(csrPath, "", cfg)
+	_, err := generateFromCSR(csrPath, CertOptions{}, cfg)
 	if err == nil {
 		t.Error("Expected error for invalid CSR, got nil")
 	}
@@ -242,7 +244,7 @@ func TestGenerateFromCSRWithIPsAndEmails(t *testing.T) {
 
 	// Generate certificate from CSR
 	cfg, _ := loadConfig()
-	certPath, err := generateFromCSR(csrPath, "", cfg)
+	certPath, err := generateFromCSR(csrPath, CertOptions{}, cfg)
 	if err != nil {
 		t.Fatalf("Failed to generate certificate from CSR: %v", err)
 	}
@@ -265,3 +267,19 @@ func TestGenerateFromCSRWithIPsAndEmails(t *testing.T) {
 		t.Errorf("Expected 1 email address, got %d", len(cert.EmailAddresses))
 	}
 }
+
+// writeTestCSR writes a PEM CSR for the template, signed by a new ECDSA key
+func writeTestCSR(t *testing.T, path string, template *x509.CertificateRequest) {
+	t.Helper()
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, csrKey)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 0644); err != nil {
+		t.Fatalf("Failed to write CSR: %v", err)
+	}
+}
@@ -3,8 +3,16 @@ module github.com/chriskacerguis/certy
 go 1.23.0
 
 require (
+	github.com/ThalesIgnite/crypto11 v1.2.5
+	github.com/miekg/pkcs11 v1.1.1
+	golang.org/x/crypto v0.35.0
+	golang.org/x/term v0.29.0
 	gopkg.in/yaml.v3 v3.0.1
 	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
 
-require golang.org/x/crypto v0.35.0 // indirect
+require (
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/thales-e-security/pool v0.0.2 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+)
+
+// defaultTierCN is the common name prefix of tiers without a configured one
+const defaultTierCN = "Certy Sub CA"
+
+// validateHierarchy checks the CA tiers configured in ca.hierarchy
+func validateHierarchy(cfg *Config) error {
+	names := map[string]bool{}
+	commonNames := map[string]bool{
+		cfg.CA.Root.pkixName(defaultRootCN, "").CommonName:                 true,
+		cfg.CA.Intermediate.pkixName(defaultIntermediateCN, "").CommonName: true,
+	}
+	for _, ic := range cfg.CA.Issuers {
+		commonNames[ic.subject().CommonName] = true
+	}
+
+	pathLens := tierPathLens(cfg)
+	for i, tc := range cfg.CA.Hierarchy {
+		section := fmt.Sprintf("ca.hierarchy[%d]", i)
+		if err := validateCAName(tc.Name); err != nil {
+			return fmt.Errorf("%s: %w", section, err)
+		}
+		if names[tc.Name] {
+			return fmt.Errorf("%s: duplicate tier name '%s'", section, tc.Name)
+		}
+		names[tc.Name] = true
+
+		if err := validateSubject(section+".subject", tc.subject(), cfg.CA.UniqueSuffix); err != nil {
+			return err
+		}
+		cn := tc.subject().CommonName
+		if commonNames[cn] {
+			return fmt.Errorf("%s: common name '%s' is already used by another CA", section, cn)
+		}
+		commonNames[cn] = true
+
+		if tc.ValidityDays != 0 && (tc.ValidityDays < 365 || tc.ValidityDays > cfg.RootCAValidityDays) {
+			return fmt.Errorf("%s.validity_days must be between 365 and root_ca_validity_days (%d), got %d", section, cfg.RootCAValidityDays, tc.ValidityDays)
+		}
+
+		// A tier must not expire before the CAs it signs
+		validity := tc.validityDays(cfg)
+		if validity < cfg.IntCAValidityDays {
+			return fmt.Errorf("%s.validity_days must be at least intermediate_ca_validity_days (%d), got %d", section, cfg.IntCAValidityDays, validity)
+		}
+		if i+1 < len(cfg.CA.Hierarchy) {
+			below := cfg.CA.Hierarchy[i+1]
+			if validity < below.validityDays(cfg) {
+				return fmt.Errorf("%s.validity_days must be at least that of %s (%d), got %d", section, below.Name, below.validityDays(cfg), validity)
+			}
+		}
+
+		// Validate the tier key
+		keyType, keySize := tc.keySpec(cfg)
+		switch keyType {
+		case "rsa":
+			if keySize != 2048 && keySize != 3072 && keySize != 4096 {
+				return fmt.Errorf("%s.key_size for RSA must be 2048, 3072, or 4096, got %d", section, keySize)
+			}
+		case "ecdsa":
+			if keySize != 256 && keySize != 384 && keySize != 521 {
+				return fmt.Errorf("%s.key_size for ECDSA must be 256, 384, or 521, got %d", section, keySize)
+			}
+		case "ed25519":
+			if cfg.KeyBackend == "pkcs11" {
+				return fmt.Errorf("%s.key_type 'ed25519' is not supported with key_backend 'pkcs11'", section)
+			}
+		default:
+			return fmt.Errorf("%s.key_type must be 'rsa', 'ecdsa' or 'ed25519', got '%s'", section, keyType)
+		}
+
+		// Each tier must leave room for the CAs below it
+		if minPathLen := len(cfg.CA.Hierarchy) - i; pathLens[i] < minPathLen {
+			return fmt.Errorf("%s.max_path_len must be at least %d to allow the CAs below it, got %d", section, minPathLen, pathLens[i])
+		}
+		if i > 0 && pathLens[i] >= pathLens[i-1] {
+			return fmt.Errorf("%s.max_path_len must be lower than that of %s (%d), got %d", section, cfg.CA.Hierarchy[i-1].Name, pathLens[i-1], pathLens[i])
+		}
+	}
+	return nil
+}
+
+// subject returns the tier subject, defaulting the common name to
+// "Certy Sub CA <name>"
+func (tc TierConfig) subject() SubjectConfig {
+	subject := tc.Subject
+	if subject.CommonName == "" {
+		subject.CommonName = defaultTierCN + " " + tc.Name
+	}
+	return subject
+}
+
+// keySpec returns the key type and size of the tier. Without a key size, a
+// tier using another key type than default_key_type gets RSA 2048 or P-256.
+func (tc TierConfig) keySpec(cfg *Config) (string, int) {
+	keyType, keySize := tc.KeyType, tc.KeySize
+	if keyType == "" {
+		keyType = cfg.DefaultKeyType
+	}
+	if keySize == 0 {
+		switch {
+		case keyType == cfg.DefaultKeyType:
+			keySize = cfg.DefaultKeySize
+		case keyType == "ecdsa":
+			keySize = 256
+		default:
+			keySize = 2048
+		}
+	}
+	return keyType, keySize
+}
+
+// validityDays returns the validity of the tier certificate in days,
+// defaulting to the validity of the root CA
+func (tc TierConfig) validityDays(cfg *Config) int {
+	if tc.ValidityDays == 0 {
+		return cfg.RootCAValidityDays
+	}
+	return tc.ValidityDays
+}
+
+// tierBaseName returns the file and key name of a hierarchy tier
+func tierBaseName(name string) string {
+	return "subCA-" + name
+}
+
+// tierPathLens returns the path length of each tier, top-down. By default a
+// tier allows exactly the tiers below it plus the intermediate CAs.
+func tierPathLens(cfg *Config) []int {
+	pathLens := make([]int, len(cfg.CA.Hierarchy))
+	for i, tc := range cfg.CA.Hierarchy {
+		pathLens[i] = len(cfg.CA.Hierarchy) - i
+		if tc.MaxPathLen != nil {
+			pathLens[i] = *tc.MaxPathLen
+		}
+	}
+	return pathLens
+}
+
+// hierarchyPathLen returns the path length the root CA must allow on top of
+// its own intermediate CA for the configured tiers
+func hierarchyPathLen(cfg *Config) int {
+	if len(cfg.CA.Hierarchy) == 0 {
+		return 0
+	}
+	return tierPathLens(cfg)[0]
+}
+
+// createHierarchy generates the configured tiers top-down, each signed by the
+// one above it. It returns the signer and certificate of the lowest tier,
+// which signs the intermediate CAs, or the root CA if there are no tiers.
+func createHierarchy(backend KeyBackend, rootKey crypto.Signer, rootCert *x509.Certificate, suffix string, cfg *Config) (crypto.Signer, *x509.Certificate, error) {
+	parentKey, parentCert := rootKey, rootCert
+	pathLens := tierPathLens(cfg)
+	for i, tc := range cfg.CA.Hierarchy {
+		fmt.Printf("Generating %s CA tier...\n", tc.Name)
+		baseName := tierBaseName(tc.Name)
+		keyType, keySize := tc.keySpec(cfg)
+		key, err := backend.CreateKey(baseName, keyType, keySize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate %s CA tier key: %w", tc.Name, err)
+		}
+		cert, err := signCA(key.Public(), tc.subject().pkixName(defaultTierCN, suffix), tc.validityDays(cfg), pathLens[i], nil, parentKey, parentCert, cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate %s CA tier: %w", tc.Name, err)
+		}
+		if err := saveCACertificate(cert, baseName); err != nil {
+			return nil, nil, fmt.Errorf("failed to save %s CA tier: %w", tc.Name, err)
+		}
+		parentKey, parentCert = key, cert
+	}
+	return parentKey, parentCert, nil
+}
+
+// loadIssuingParent returns the CA that signs the intermediate CAs: the
+// lowest configured tier, or the root CA, which may be offline and given
+// with -root-key
+func loadIssuingParent(backend KeyBackend, cfg *Config) (crypto.Signer, *x509.Certificate, error) {
+	if len(cfg.CA.Hierarchy) == 0 {
+		rootCert, err := loadCACertificate("rootCA")
+		if err != nil {
+			return nil, nil, err
+		}
+		rootKey, err := loadRootKey(backend, rootCert)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rootKey, rootCert, nil
+	}
+
+	tc := cfg.CA.Hierarchy[len(cfg.CA.Hierarchy)-1]
+	baseName := tierBaseName(tc.Name)
+	if !caFileExists(baseName + ".pem") {
+		return nil, nil, fmt.Errorf("CA tier %s is not installed (ca.hierarchy changed since the CA was created; use -reinstall)", tc.Name)
+	}
+	cert, err := loadCACertificate(baseName)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := backend.Signer(baseName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// installedTierBaseName returns the base name of the installed tier whose
+// certificate is cert, or an empty string if there is none
+func installedTierBaseName(cert *x509.Certificate, cfg *Config) string {
+	for _, tc := range cfg.CA.Hierarchy {
+		baseName := tierBaseName(tc.Name)
+		if !caFileExists(baseName + ".pem") {
+			continue
+		}
+		if tier, err := loadCACertificate(baseName); err == nil && tier.Equal(cert) {
+			return baseName
+		}
+	}
+	return ""
+}
+
+// tierChain returns the installed tier certificates above cert, nearest
+// first, following the signatures up to the root CA
+func tierChain(cert *x509.Certificate, cfg *Config) ([]*x509.Certificate, error) {
+	var tiers []*x509.Certificate
+	for _, tc := range cfg.CA.Hierarchy {
+		baseName := tierBaseName(tc.Name)
+		if !caFileExists(baseName + ".pem") {
+			continue
+		}
+		tier, err := loadCACertificate(baseName)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+
+	var chain []*x509.Certificate
+	for parent := findIssuer(tiers, cert); parent != nil && len(chain) < len(tiers); parent = findIssuer(tiers, parent) {
+		chain = append(chain, parent)
+	}
+	return chain, nil
+}
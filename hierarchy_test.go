@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThreeTierHierarchy(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure a policy CA between the root and the issuing CA
+	cfg := DefaultConfig()
+	cfg.CA.Hierarchy = []TierConfig{{Name: "policy", ValidityDays: 3000, KeyType: "ecdsa", KeySize: 384}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	tierCert, err := loadCACertificate("subCA-policy")
+	if err != nil {
+		t.Fatalf("Failed to load policy CA: %v", err)
+	}
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	// Check the path lengths, keys and signatures of each tier
+	if rootCert.MaxPathLen != 2 {
+		t.Errorf("Expected root MaxPathLen 2, got %d", rootCert.MaxPathLen)
+	}
+	if tierCert.MaxPathLen != 1 {
+		t.Errorf("Expected policy CA MaxPathLen 1, got %d", tierCert.MaxPathLen)
+	}
+	if intCert.MaxPathLen != 0 || !intCert.MaxPathLenZero {
+		t.Errorf("Expected intermediate MaxPathLen 0, got %d", intCert.MaxPathLen)
+	}
+	if key, ok := tierCert.PublicKey.(*ecdsa.PublicKey); !ok || key.Curve.Params().BitSize != 384 {
+		t.Errorf("Expected a P-384 policy CA key, got %T", tierCert.PublicKey)
+	}
+	if days := time.Until(tierCert.NotAfter).Hours() / 24; days < 2998 || days > 3001 {
+		t.Errorf("Expected policy CA validity of 3000 days, got %.0f", days)
+	}
+	if tierCert.Subject.CommonName != "Certy Sub CA policy" {
+		t.Errorf("Expected default policy CA common name, got %q", tierCert.Subject.CommonName)
+	}
+	if err := tierCert.CheckSignatureFrom(rootCert); err != nil {
+		t.Errorf("Expected policy CA signed by the root: %v", err)
+	}
+	if err := intCert.CheckSignatureFrom(tierCert); err != nil {
+		t.Errorf("Expected intermediate signed by the policy CA: %v", err)
+	}
+	if tierCert.NotAfter.After(rootCert.NotAfter) || intCert.NotAfter.After(tierCert.NotAfter) {
+		t.Error("Expected each CA to expire no later than its parent")
+	}
+
+	// Leaves validate through the fullchain bundle
+	leaf := issueTestLeaf(t, tmpDir, "leaf", cfg)
+	verifyWithBundle(t, leaf, rootCert, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+
+	// A rotated intermediate is signed by the policy CA again
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	newIntCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	if err := newIntCert.CheckSignatureFrom(tierCert); err != nil {
+		t.Errorf("Expected rotated intermediate signed by the policy CA: %v", err)
+	}
+	rotatedLeaf := issueTestLeaf(t, tmpDir, "rotated", cfg)
+	verifyWithBundle(t, rotatedLeaf, rootCert, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+
+	// After a root rollover, the policy CA is signed by the new root and
+	// keeps its certificate from the old root for the previous bundle
+	if _, err := rolloverRoot(); err != nil {
+		t.Fatalf("Failed to roll over root CA: %v", err)
+	}
+	newRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	if newRoot.MaxPathLen != rolloverRootMaxPathLen+1 {
+		t.Errorf("Expected new root MaxPathLen %d, got %d", rolloverRootMaxPathLen+1, newRoot.MaxPathLen)
+	}
+	movedTier, err := loadCACertificate("subCA-policy")
+	if err != nil {
+		t.Fatalf("Failed to load policy CA: %v", err)
+	}
+	if err := movedTier.CheckSignatureFrom(newRoot); err != nil {
+		t.Errorf("Expected policy CA signed by the new root: %v", err)
+	}
+	tierCross, err := loadCACertificate("subCA-policy-cross")
+	if err != nil {
+		t.Fatalf("Failed to load policy CA cross certificate: %v", err)
+	}
+	if !tierCross.Equal(tierCert) {
+		t.Error("Expected the policy CA certificate from the old root as cross certificate")
+	}
+	verifyWithBundle(t, rotatedLeaf, newRoot, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+	verifyWithBundle(t, rotatedLeaf, rootCert, filepath.Join(tmpDir, "intermediateCA-fullchain-previous.pem"))
+
+	// The tiers are under the new root, so the root can be rolled over again
+	if _, err := rolloverRoot(); err != nil {
+		t.Fatalf("Failed to roll over root CA again: %v", err)
+	}
+	thirdRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	verifyWithBundle(t, rotatedLeaf, thirdRoot, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+	verifyWithBundle(t, rotatedLeaf, newRoot, filepath.Join(tmpDir, "intermediateCA-fullchain-previous.pem"))
+
+	// A reinstall archives the tier and recreates it
+	archiveName, err := reinstallCA()
+	if err != nil {
+		t.Fatalf("Failed to reinstall CA: %v", err)
+	}
+	if !caFileExists(filepath.Join(archiveName, "subCA-policy-key.pem")) {
+		t.Error("Expected the policy CA key in the archive")
+	}
+	reinstalledTier, err := loadCACertificate("subCA-policy")
+	if err != nil {
+		t.Fatalf("Failed to load policy CA: %v", err)
+	}
+	if reinstalledTier.Equal(tierCert) {
+		t.Error("Expected a new policy CA after reinstall")
+	}
+}
+
+func TestFourTierHierarchyWithPathLengths(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Two tiers, the top one leaving room for one more CA
+	topPathLen := 3
+	cfg := DefaultConfig()
+	cfg.CA.Hierarchy = []TierConfig{
+		{Name: "policy", MaxPathLen: &topPathLen},
+		{Name: "region"},
+	}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA and issue a certificate
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	tests := []struct {
+		baseName   string
+		maxPathLen int
+	}{
+		{"rootCA", 4},
+		{"subCA-policy", 3},
+		{"subCA-region", 1},
+		{"intermediateCA", 0},
+	}
+	for _, tt := range tests {
+		cert, err := loadCACertificate(tt.baseName)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", tt.baseName, err)
+		}
+		if cert.MaxPathLen != tt.maxPathLen {
+			t.Errorf("Expected %s MaxPathLen %d, got %d", tt.baseName, tt.maxPathLen, cert.MaxPathLen)
+		}
+	}
+
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	leaf := issueTestLeaf(t, tmpDir, "leaf", cfg)
+	verifyWithBundle(t, leaf, rootCert, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+}
+
+func TestValidateHierarchy(t *testing.T) {
+	zero, one, three := 0, 1, 3
+	tests := []struct {
+		name    string
+		tiers   []TierConfig
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"one tier", []TierConfig{{Name: "policy"}}, ""},
+		{"other key type", []TierConfig{{Name: "policy", KeyType: "ecdsa"}}, ""},
+		{"invalid name", []TierConfig{{Name: "../policy"}}, "invalid CA name"},
+		{"duplicate name", []TierConfig{{Name: "policy"}, {Name: "policy"}}, "duplicate tier name"},
+		{"duplicate common name", []TierConfig{{Name: "policy", Subject: SubjectConfig{CommonName: defaultRootCN}}}, "already used"},
+		{"short validity", []TierConfig{{Name: "policy", ValidityDays: 30}}, "validity_days"},
+		{"outlives root", []TierConfig{{Name: "policy", ValidityDays: 5000}}, "validity_days"},
+		{"shorter than intermediates", []TierConfig{{Name: "policy", ValidityDays: 1000}}, "at least intermediate_ca_validity_days"},
+		{"shorter than tier below", []TierConfig{{Name: "policy", ValidityDays: 2000}, {Name: "region", ValidityDays: 3000}}, "at least that of region"},
+		{"shorter than default tier below", []TierConfig{{Name: "policy", ValidityDays: 2000}, {Name: "region"}}, "at least that of region"},
+		{"bad key type", []TierConfig{{Name: "policy", KeyType: "dsa"}}, "key_type"},
+		{"bad key size", []TierConfig{{Name: "policy", KeyType: "ecdsa", KeySize: 1024}}, "key_size"},
+		{"path length too short", []TierConfig{{Name: "policy", MaxPathLen: &zero}}, "max_path_len must be at least 1"},
+		{"path length too short above a tier", []TierConfig{{Name: "policy", MaxPathLen: &one}, {Name: "region"}}, "max_path_len must be at least 2"},
+		{"path length not decreasing", []TierConfig{{Name: "policy", MaxPathLen: &three}, {Name: "region", MaxPathLen: &three}}, "must be lower"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.CA.Hierarchy = tt.tiers
+			err := validateConfig(cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
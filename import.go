@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// importPassphrase supplies the password of imported PKCS#12 files and encrypted keys
+var importPassphrase = &passphraseSource{name: "import passphrase", envVar: "CERTY_IMPORT_PASSPHRASE"}
+
+// ImportOptions lists the files making up an existing CA. Each file may be
+// PEM, DER or PKCS#12; PEM and PKCS#12 files may also carry the key and chain.
+type ImportOptions struct {
+	RootFile            string // Root CA certificate (optional if included in IntermediateFile)
+	RootKeyFile         string // Root CA key (optional)
+	IntermediateFile    string // Intermediate CA certificate
+	IntermediateKeyFile string // Intermediate CA key (optional if included in IntermediateFile)
+	Replace             bool   // Back up and replace an existing CA
+}
+
+// importCA validates an existing root and intermediate CA and stores them in
+// the certy directory as if they had been created by installCA. An existing
+// CA is backed up with backupCA once the import and the key backend have been
+// validated, and restored if storing the imported CA fails; the archive path
+// is returned in that case.
+func importCA(opts ImportOptions) (string, error) {
+	// Read intermediate certificate, key and chain
+	intCerts, intKey, err := readImportFile(opts.IntermediateFile)
+	if err != nil {
+		return "", err
+	}
+	if opts.IntermediateKeyFile != "" {
+		if _, intKey, err = readImportFile(opts.IntermediateKeyFile); err != nil {
+			return "", err
+		}
+	}
+	if intKey == nil {
+		return "", fmt.Errorf("no intermediate CA private key found (use -import-intermediate-key)")
+	}
+	intCert := findCertificateForKey(intCerts, intKey)
+	if intCert == nil {
+		return "", fmt.Errorf("intermediate CA private key does not match the intermediate certificate")
+	}
+
+	// Read root certificate and optional key
+	var rootCerts []*x509.Certificate
+	var rootKey crypto.Signer
+	if opts.RootFile != "" {
+		if rootCerts, rootKey, err = readImportFile(opts.RootFile); err != nil {
+			return "", err
+		}
+	} else {
+		rootCerts = intCerts
+	}
+	if opts.RootKeyFile != "" {
+		if _, rootKey, err = readImportFile(opts.RootKeyFile); err != nil {
+			return "", err
+		}
+	}
+	rootCert := findIssuer(rootCerts, intCert)
+	if rootCert == nil {
+		return "", fmt.Errorf("no root CA certificate that signed the intermediate was found (use -import-root)")
+	}
+	if rootKey != nil && findCertificateForKey([]*x509.Certificate{rootCert}, rootKey) == nil {
+		return "", fmt.Errorf("root CA private key does not match the root certificate")
+	}
+
+	if err := validateImportedChain(rootCert, intCert); err != nil {
+		return "", err
+	}
+
+	// Imported CAs have no hierarchy tiers
+	if cfg, err := loadConfig(); err == nil && len(cfg.CA.Hierarchy) > 0 {
+		return "", fmt.Errorf("ca.hierarchy cannot be used with -import; remove it from config.yml first")
+	}
+
+	// An existing CA is only replaced with -force
+	replacing := caStatus() != CAMissing
+	if replacing && !opts.Replace {
+		return "", fmt.Errorf("a CA already exists; use -force to replace it (the current CA is backed up first)")
+	}
+
+	// Ensure certy directory and config exist
+	cfg, err := initCertyDir()
+	if err != nil {
+		return "", err
+	}
+
+	// Make sure the key backend can take the keys before touching the current CA
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return "", err
+	}
+	if !backend.CanImport() {
+		return "", fmt.Errorf("key_backend %s does not support importing CA keys", cfg.KeyBackend)
+	}
+	if cfg.EncryptCAKeys {
+		if _, err := caPassphrase.get(true); err != nil {
+			return "", err
+		}
+	}
+
+	// Back up the CA being replaced
+	archiveName := ""
+	if replacing {
+		if archiveName, err = backupCA("import"); err != nil {
+			return "", err
+		}
+	}
+
+	if err := storeImportedCA(backend, rootKey, rootCert, intKey, intCert); err != nil {
+		if archiveName != "" {
+			if restoreErr := restoreCA(archiveName); restoreErr != nil {
+				return "", fmt.Errorf("%w (restoring the previous CA from %s also failed: %v)", err, archiveName, restoreErr)
+			}
+			return "", fmt.Errorf("%w (the previous CA was restored)", err)
+		}
+		return "", err
+	}
+
+	return archiveName, nil
+}
+
+// storeImportedCA stores the imported keys and certificates and initializes
+// the serial number
+func storeImportedCA(backend KeyBackend, rootKey crypto.Signer, rootCert *x509.Certificate, intKey crypto.Signer, intCert *x509.Certificate) error {
+	// Store keys and certificates
+	if rootKey != nil {
+		if err := backend.ImportKey("rootCA", rootKey); err != nil {
+			return fmt.Errorf("failed to import root CA key: %w", err)
+		}
+	}
+	if err := saveCACertificate(rootCert, "rootCA"); err != nil {
+		return fmt.Errorf("failed to save root CA: %w", err)
+	}
+	if err := backend.ImportKey("intermediateCA", intKey); err != nil {
+		return fmt.Errorf("failed to import intermediate CA key: %w", err)
+	}
+	if err := saveCACertificate(intCert, "intermediateCA"); err != nil {
+		return fmt.Errorf("failed to save intermediate CA: %w", err)
+	}
+	if err := saveFullChain("intermediateCA", intCert, rootCert); err != nil {
+		return fmt.Errorf("failed to save intermediate CA fullchain: %w", err)
+	}
+
+	// Initialize serial number file, never going below already issued serials
+	return initSerialNumber()
+}
+
+// validateImportedChain checks that the root and intermediate form a usable CA
+func validateImportedChain(rootCert, intCert *x509.Certificate) error {
+	// Root must be a self-signed CA
+	if !rootCert.IsCA {
+		return fmt.Errorf("root certificate %q is not a CA certificate", rootCert.Subject.CommonName)
+	}
+	if err := rootCert.CheckSignatureFrom(rootCert); err != nil {
+		return fmt.Errorf("root certificate %q is not self-signed: %w", rootCert.Subject.CommonName, err)
+	}
+
+	// Intermediate must be able to issue certificates
+	if !intCert.BasicConstraintsValid || !intCert.IsCA {
+		return fmt.Errorf("intermediate certificate %q is not a CA certificate", intCert.Subject.CommonName)
+	}
+	if intCert.KeyUsage != 0 && intCert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("intermediate certificate %q does not allow certificate signing", intCert.Subject.CommonName)
+	}
+
+	// Intermediate must chain to the root and be currently valid
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	_, err := intCert.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: time.Now(),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("intermediate certificate does not chain to the root: %w", err)
+	}
+
+	return nil
+}
+
+// findCertificateForKey returns the certificate whose public key matches key
+func findCertificateForKey(certs []*x509.Certificate, key crypto.Signer) *x509.Certificate {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil
+	}
+	for _, cert := range certs {
+		if pub.Equal(cert.PublicKey) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// findIssuer returns the certificate in certs that signed cert
+func findIssuer(certs []*x509.Certificate, cert *x509.Certificate) *x509.Certificate {
+	for _, candidate := range certs {
+		if candidate.Equal(cert) {
+			continue
+		}
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// readImportFile reads the certificates and private key contained in a PEM,
+// DER or PKCS#12 file
+func readImportFile(path string) ([]*x509.Certificate, crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var certs []*x509.Certificate
+	var key crypto.Signer
+
+	switch {
+	case bytes.Contains(data, []byte("-----BEGIN")):
+		// PEM: any number of certificates and at most one key
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to parse certificate in %s: %w", path, err)
+				}
+				certs = append(certs, cert)
+			case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+				if key != nil {
+					return nil, nil, fmt.Errorf("%s contains more than one private key", path)
+				}
+				if key, err = loadPrivateKeyPEM(block, importPassphrase); err != nil {
+					return nil, nil, fmt.Errorf("failed to parse private key in %s: %w", path, err)
+				}
+			}
+		}
+	case isDERCertificate(data):
+		cert, _ := x509.ParseCertificate(data)
+		certs = append(certs, cert)
+	case isDERPrivateKey(data):
+		if key, err = parseDERPrivateKey(data); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse private key in %s: %w", path, err)
+		}
+	default:
+		if certs, key, err = readPKCS12(data); err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	if len(certs) == 0 && key == nil {
+		return nil, nil, fmt.Errorf("no certificates or private keys found in %s", path)
+	}
+	return certs, key, nil
+}
+
+// readPKCS12 decodes a PKCS#12 file, trying an empty password before asking
+// for the import passphrase
+func readPKCS12(data []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	certs, key, err := decodePKCS12(data, "")
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		password, perr := importPassphrase.get(false)
+		if perr != nil {
+			return nil, nil, perr
+		}
+		certs, key, err = decodePKCS12(data, string(password))
+	}
+	return certs, key, err
+}
+
+// decodePKCS12 decodes a PKCS#12 file with a key and chain, or a trust store
+// holding only certificates
+func decodePKCS12(data []byte, password string) ([]*x509.Certificate, crypto.Signer, error) {
+	privateKey, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		certs, tsErr := pkcs12.DecodeTrustStore(data, password)
+		if tsErr != nil {
+			return nil, nil, err
+		}
+		return certs, nil, nil
+	}
+
+	key, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	return append([]*x509.Certificate{cert}, caCerts...), key, nil
+}
+
+// isDERCertificate reports whether data is a DER encoded certificate
+func isDERCertificate(data []byte) bool {
+	_, err := x509.ParseCertificate(data)
+	return err == nil
+}
+
+// isDERPrivateKey reports whether data is a DER encoded private key
+func isDERPrivateKey(data []byte) bool {
+	_, err := parseDERPrivateKey(data)
+	return err == nil
+}
+
+// parseDERPrivateKey parses a PKCS#8, PKCS#1 or SEC 1 DER private key
+func parseDERPrivateKey(data []byte) (crypto.Signer, error) {
+	for _, blockType := range []string{"PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY"} {
+		if key, err := parsePrivateKeyPEM(&pem.Block{Type: blockType, Bytes: data}); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized DER private key")
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// writeImportFixture writes a certificate and/or key to path as PEM
+func writeImportFixture(t *testing.T, path string, certs []*x509.Certificate, key crypto.Signer) {
+	t.Helper()
+
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	if key != nil {
+		block, err := marshalPrivateKeyPEM(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// verifyImportedCA checks the files written by importCA and that the CA issues certificates
+func verifyImportedCA(t *testing.T, dir string, rootCert, intCert *x509.Certificate, expectRootKey bool) {
+	t.Helper()
+
+	if !caExists() {
+		t.Fatal("CA should exist after import")
+	}
+
+	gotRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	if !gotRoot.Equal(rootCert) {
+		t.Error("Imported root CA does not match")
+	}
+	gotInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	if !gotInt.Equal(intCert) {
+		t.Error("Imported intermediate CA does not match")
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "rootCA-key.pem"))
+	if expectRootKey && err != nil {
+		t.Errorf("Expected root CA key: %v", err)
+	}
+	if !expectRootKey && !os.IsNotExist(err) {
+		t.Error("Root CA key should not exist")
+	}
+
+	// Fullchain is intermediate followed by root
+	chainData, err := os.ReadFile(filepath.Join(dir, "intermediateCA-fullchain.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read fullchain: %v", err)
+	}
+	first, rest := pem.Decode(chainData)
+	second, _ := pem.Decode(rest)
+	if first == nil || second == nil || string(first.Bytes) != string(intCert.Raw) || string(second.Bytes) != string(rootCert.Raw) {
+		t.Error("Fullchain should contain the intermediate followed by the root")
+	}
+
+	// Issue a certificate with the imported intermediate
+	certPath, keyPath, err := generateCertificate([]string{"import.example.com"}, CertTypeTLS, CertOptions{}, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intCert)
+	if _, err := loadCertFromFile(t, certPath).Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Certificate from imported CA does not verify: %v", err)
+	}
+}
+
+func TestImportCA(t *testing.T) {
+	cfg := DefaultConfig()
+	rootKey, rootCert, err := generateRootCA(cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate root CA: %v", err)
+	}
+	intKey, intCert, err := generateIntermediateCA(rootKey, rootCert, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediate CA: %v", err)
+	}
+	srcDir := t.TempDir()
+
+	t.Run("PEM with root key", func(t *testing.T) {
+		writeImportFixture(t, filepath.Join(srcDir, "root.pem"), []*x509.Certificate{rootCert}, rootKey)
+		writeImportFixture(t, filepath.Join(srcDir, "int.pem"), []*x509.Certificate{intCert}, nil)
+		writeImportFixture(t, filepath.Join(srcDir, "int-key.pem"), nil, intKey)
+
+		customCADir = t.TempDir()
+		defer func() { customCADir = "" }()
+
+		_, err := importCA(ImportOptions{
+			RootFile:            filepath.Join(srcDir, "root.pem"),
+			IntermediateFile:    filepath.Join(srcDir, "int.pem"),
+			IntermediateKeyFile: filepath.Join(srcDir, "int-key.pem"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to import CA: %v", err)
+		}
+		verifyImportedCA(t, customCADir, rootCert, intCert, true)
+	})
+
+	t.Run("DER without root key", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(srcDir, "root.der"), rootCert.Raw, 0644); err != nil {
+			t.Fatalf("Failed to write root: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(srcDir, "int.der"), intCert.Raw, 0644); err != nil {
+			t.Fatalf("Failed to write intermediate: %v", err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(intKey)
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(srcDir, "int-key.der"), keyDER, 0600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+
+		customCADir = t.TempDir()
+		defer func() { customCADir = "" }()
+
+		_, err = importCA(ImportOptions{
+			RootFile:            filepath.Join(srcDir, "root.der"),
+			IntermediateFile:    filepath.Join(srcDir, "int.der"),
+			IntermediateKeyFile: filepath.Join(srcDir, "int-key.der"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to import CA: %v", err)
+		}
+		verifyImportedCA(t, customCADir, rootCert, intCert, false)
+
+		// Rotation needs the root key
+		if _, err := rotateIntermediateCA(""); err == nil {
+			t.Error("Expected rotation to fail without the root key")
+		}
+	})
+
+	t.Run("PKCS#12 with chain", func(t *testing.T) {
+		pfx, err := pkcs12.Modern.Encode(intKey, intCert, []*x509.Certificate{rootCert}, "secret")
+		if err != nil {
+			t.Fatalf("Failed to encode PKCS#12: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(srcDir, "int.p12"), pfx, 0600); err != nil {
+			t.Fatalf("Failed to write PKCS#12: %v", err)
+		}
+		t.Setenv("CERTY_IMPORT_PASSPHRASE", "secret")
+
+		customCADir = t.TempDir()
+		defer func() { customCADir = "" }()
+
+		_, err = importCA(ImportOptions{IntermediateFile: filepath.Join(srcDir, "int.p12")})
+		if err != nil {
+			t.Fatalf("Failed to import CA: %v", err)
+		}
+		verifyImportedCA(t, customCADir, rootCert, intCert, false)
+	})
+}
+
+func TestImportCAValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	rootKey, rootCert, err := generateRootCA(cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate root CA: %v", err)
+	}
+	intKey, intCert, err := generateIntermediateCA(rootKey, rootCert, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediate CA: %v", err)
+	}
+	otherKey, otherRoot, err := generateRootCA(cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate second root CA: %v", err)
+	}
+
+	srcDir := t.TempDir()
+	writeImportFixture(t, filepath.Join(srcDir, "root.pem"), []*x509.Certificate{rootCert}, nil)
+	writeImportFixture(t, filepath.Join(srcDir, "root-with-wrong-key.pem"), []*x509.Certificate{rootCert}, otherKey)
+	writeImportFixture(t, filepath.Join(srcDir, "other-root.pem"), []*x509.Certificate{otherRoot}, nil)
+	writeImportFixture(t, filepath.Join(srcDir, "int.pem"), []*x509.Certificate{intCert}, intKey)
+	writeImportFixture(t, filepath.Join(srcDir, "int-cert.pem"), []*x509.Certificate{intCert}, nil)
+	writeImportFixture(t, filepath.Join(srcDir, "int-wrong-key.pem"), []*x509.Certificate{intCert}, otherKey)
+
+	tests := []struct {
+		name   string
+		opts   ImportOptions
+		errMsg string
+	}{
+		{
+			name:   "missing intermediate key",
+			opts:   ImportOptions{RootFile: "root.pem", IntermediateFile: "int-cert.pem"},
+			errMsg: "no intermediate CA private key",
+		},
+		{
+			name:   "intermediate key mismatch",
+			opts:   ImportOptions{RootFile: "root.pem", IntermediateFile: "int-wrong-key.pem"},
+			errMsg: "does not match the intermediate certificate",
+		},
+		{
+			name:   "root key mismatch",
+			opts:   ImportOptions{RootFile: "root-with-wrong-key.pem", IntermediateFile: "int.pem"},
+			errMsg: "does not match the root certificate",
+		},
+		{
+			name:   "root did not sign intermediate",
+			opts:   ImportOptions{RootFile: "other-root.pem", IntermediateFile: "int.pem"},
+			errMsg: "no root CA certificate that signed the intermediate",
+		},
+		{
+			name:   "missing root",
+			opts:   ImportOptions{IntermediateFile: "int.pem"},
+			errMsg: "no root CA certificate that signed the intermediate",
+		},
+		{
+			name:   "intermediate used as root",
+			opts:   ImportOptions{RootFile: "int-cert.pem", IntermediateFile: "int.pem"},
+			errMsg: "no root CA certificate that signed the intermediate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			customCADir = t.TempDir()
+			defer func() { customCADir = "" }()
+
+			opts := tt.opts
+			if opts.RootFile != "" {
+				opts.RootFile = filepath.Join(srcDir, opts.RootFile)
+			}
+			opts.IntermediateFile = filepath.Join(srcDir, opts.IntermediateFile)
+
+			_, err := importCA(opts)
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got %q", tt.errMsg, err.Error())
+			}
+			if caExists() {
+				t.Error("CA should not exist after a failed import")
+			}
+		})
+	}
+}
+
+func TestImportCAReplacesExisting(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	rootKey, rootCert, err := generateRootCA(cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate root CA: %v", err)
+	}
+	intKey, intCert, err := generateIntermediateCA(rootKey, rootCert, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediate CA: %v", err)
+	}
+	srcDir := t.TempDir()
+	writeImportFixture(t, filepath.Join(srcDir, "bundle.pem"), []*x509.Certificate{intCert, rootCert}, intKey)
+	opts := ImportOptions{IntermediateFile: filepath.Join(srcDir, "bundle.pem")}
+
+	// Refused without Replace
+	if _, err := importCA(opts); err == nil {
+		t.Fatal("Expected error importing over an existing CA")
+	}
+
+	// Replaced with a backup
+	opts.Replace = true
+	archiveName, err := importCA(opts)
+	if err != nil {
+		t.Fatalf("Failed to import CA: %v", err)
+	}
+	if archiveName == "" {
+		t.Fatal("Expected the previous CA to be backed up")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, archiveName, "rootCA-key.pem")); err != nil {
+		t.Errorf("Expected previous root key in backup: %v", err)
+	}
+	verifyImportedCA(t, tmpDir, rootCert, intCert, false)
+}
+
+func TestImportCAFailureKeepsExistingCA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	oldRoot, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	oldIntKey, _ := os.ReadFile(filepath.Join(tmpDir, "intermediateCA-key.pem"))
+
+	// Switch to a key backend that cannot take the imported keys
+	cfg := DefaultConfig()
+	cfg.KeyBackend = "pkcs11"
+	cfg.PKCS11 = PKCS11Config{Module: filepath.Join(tmpDir, "missing.so"), TokenLabel: "certy"}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	rootKey, rootCert, err := generateRootCA(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to generate root CA: %v", err)
+	}
+	intKey, intCert, err := generateIntermediateCA(rootKey, rootCert, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to generate intermediate CA: %v", err)
+	}
+	srcDir := t.TempDir()
+	writeImportFixture(t, filepath.Join(srcDir, "bundle.pem"), []*x509.Certificate{intCert, rootCert}, intKey)
+	if _, err := importCA(ImportOptions{IntermediateFile: filepath.Join(srcDir, "bundle.pem"), Replace: true}); err == nil {
+		t.Fatal("Expected the import to fail")
+	}
+
+	// Nothing was backed up or replaced
+	if _, err := os.Stat(filepath.Join(tmpDir, archiveDirName)); !os.IsNotExist(err) {
+		t.Error("Expected no backup for a refused import")
+	}
+	newRoot, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	newIntKey, _ := os.ReadFile(filepath.Join(tmpDir, "intermediateCA-key.pem"))
+	if string(newRoot) != string(oldRoot) || string(newIntKey) != string(oldIntKey) {
+		t.Error("Expected the existing CA to be left in place")
+	}
+}
@@ -34,9 +34,7 @@ func TestIntegration_FullWorkflow(t *testing.T) {
 		certPath, keyPath, err := generateCertificate(
 			[]string{"example.com", "*.example.com", "127.0.0.1", "::1"},
 			CertTypeTLS,
-			false,
-			"",
-			"",
+			CertOptions{},
 			cfg,
 		)
 		if err != nil {
@@ -55,9 +53,7 @@ func TestIntegration_FullWorkflow(t *testing.T) {
 		certPath, keyPath, err := generateCertificate(
 			[]string{"user@example.com"},
 			CertTypeSMIME,
-			false,
-			"",
-			"",
+			CertOptions{},
 			cfg,
 		)
 		if err != nil {
@@ -75,9 +71,7 @@ func TestIntegration_FullWorkflow(t *testing.T) {
 		certPath, keyPath, err := generateCertificate(
 			[]string{"client.example.com"},
 			CertTypeClient,
-			false,
-			"",
-			"",
+			CertOptions{},
 			cfg,
 		)
 		if err != nil {
@@ -95,9 +89,7 @@ func TestIntegration_FullWorkflow(t *testing.T) {
 		certPath, keyPath, err := generateCertificate(
 			[]string{"ecdsa.example.com"},
 			CertTypeTLS,
-			true,
-			"",
-			"",
+			CertOptions{KeySpec: "ecdsa"},
 			cfg,
 		)
 		if err != nil {
@@ -115,9 +107,7 @@ func TestIntegration_FullWorkflow(t *testing.T) {
 		certPath, keyPath, err := generateCertificate(
 			[]string{"pkcs12.example.com"},
 			CertTypeTLS,
-			false,
-			"",
-			"",
+			CertOptions{},
 			cfg,
 		)
 		if err != nil {
@@ -155,9 +145,7 @@ func TestIntegration_CertificateChainValidation(t *testing.T) {
 	certPath, keyPath, err := generateCertificate(
 		[]string{"example.com"},
 		CertTypeTLS,
-		false,
-		"",
-		"",
+		CertOptions{},
 		cfg,
 	)
 	if err != nil {
@@ -233,9 +221,7 @@ func TestIntegration_SerialNumberIncrement(t *testing.T) {
 		certPath, keyPath, err := generateCertificate(
 			[]string{domain},
 			CertTypeTLS,
-			false,
-			"",
-			"",
+			CertOptions{},
 			cfg,
 		)
 		if err != nil {
@@ -278,9 +264,10 @@ func TestIntegration_CustomOutputPaths(t *testing.T) {
 	certPath, keyPath, err := generateCertificate(
 		[]string{"example.com"},
 		CertTypeTLS,
-		false,
-		customCertPath,
-		customKeyPath,
+		CertOptions{
+			CertFile: customCertPath,
+			KeyFile:  customKeyPath,
+		},
 		cfg,
 	)
 	if err != nil {
@@ -359,9 +346,7 @@ func TestIntegration_OpenSSLCompatibility(t *testing.T) {
 	certPath, keyPath, err := generateCertificate(
 		[]string{"example.com"},
 		CertTypeTLS,
-		false,
-		"",
-		"",
+		CertOptions{},
 		cfg,
 	)
 	if err != nil {
@@ -472,3 +457,24 @@ func loadCertFromFile(t *testing.T, path string) *x509.Certificate {
 
 	return cert
 }
+
+func loadCRLFromFile(t *testing.T, path string) *x509.RevocationList {
+	t.Helper()
+
+	crlData, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read CRL: %v", err)
+	}
+
+	block, _ := pem.Decode(crlData)
+	if block == nil {
+		t.Fatal("Failed to decode CRL PEM")
+	}
+
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse CRL: %v", err)
+	}
+
+	return crl
+}
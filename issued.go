@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// IssuedCertificate represents an entry in the issued certificate index
+type IssuedCertificate struct {
+	SerialNumber *big.Int
+	NotAfter     time.Time
+	Issuer       string // Authority key ID of the certificate, naming the issuing CA
+	Subject      string
+}
+
+// recordIssuedCertificate appends a certificate to issued.db.
+// The index records every serial number handed out, so serials are never
+// reused even if serial.txt is lost or the CA is reinstalled.
+func recordIssuedCertificate(cert *x509.Certificate) error {
+	issuedPath, err := getCAFilePath("issued.db")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(issuedPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open issued certificate index: %w", err)
+	}
+	defer f.Close()
+
+	// Format: serial,notAfter,issuer,subject (subject last, as it may contain
+	// commas). The issuer is the authority key ID in hex.
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(cert.Subject.String())
+	issuer := hex.EncodeToString(cert.AuthorityKeyId)
+	if _, err := fmt.Fprintf(f, "%s,%d,%s,%s\n", cert.SerialNumber.String(), cert.NotAfter.Unix(), issuer, subject); err != nil {
+		return fmt.Errorf("failed to update issued certificate index: %w", err)
+	}
+
+	return nil
+}
+
+// loadIssuedCertificates loads the issued certificate index
+func loadIssuedCertificates() ([]IssuedCertificate, error) {
+	issuedPath, err := getCAFilePath("issued.db")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(issuedPath)
+	if os.IsNotExist(err) {
+		return []IssuedCertificate{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read issued certificate index: %w", err)
+	}
+
+	var issued []IssuedCertificate
+	for _, line := range splitLines(string(data)) {
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ",", 4)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid issued certificate entry: %s", line)
+		}
+
+		serial := new(big.Int)
+		if _, ok := serial.SetString(parts[0], 10); !ok {
+			return nil, fmt.Errorf("invalid serial number in issued.db: %s", parts[0])
+		}
+
+		var notAfter int64
+		if _, err := fmt.Sscanf(parts[1], "%d", &notAfter); err != nil {
+			return nil, fmt.Errorf("invalid expiry in issued.db: %s", parts[1])
+		}
+
+		issued = append(issued, IssuedCertificate{
+			SerialNumber: serial,
+			NotAfter:     time.Unix(notAfter, 0),
+			Issuer:       parts[2],
+			Subject:      parts[3],
+		})
+	}
+
+	return issued, nil
+}
+
+// highestIssuedSerial returns the highest serial number known to be in use,
+// taking the issued index, revoked.db and serial.txt into account
+func highestIssuedSerial() (int64, error) {
+	var highest int64
+
+	issued, err := loadIssuedCertificates()
+	if err != nil {
+		return 0, err
+	}
+	for _, ic := range issued {
+		if ic.SerialNumber.IsInt64() && ic.SerialNumber.Int64() > highest {
+			highest = ic.SerialNumber.Int64()
+		}
+	}
+
+	revoked, err := loadRevokedCertificates()
+	if err != nil {
+		return 0, err
+	}
+	for _, rc := range revoked {
+		if rc.SerialNumber.IsInt64() && rc.SerialNumber.Int64() > highest {
+			highest = rc.SerialNumber.Int64()
+		}
+	}
+
+	// serial.txt holds the next serial to be issued
+	next, err := readSerialFile()
+	if err != nil {
+		return 0, err
+	}
+	if next-1 > highest {
+		highest = next - 1
+	}
+
+	return highest, nil
+}
+
+// initSerialNumber initializes serial.txt for a new or reinstalled CA.
+// The counter is never moved below the highest serial already issued.
+func initSerialNumber() error {
+	highest, err := highestIssuedSerial()
+	if err != nil {
+		return err
+	}
+
+	serialPath, err := getCAFilePath("serial.txt")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(serialPath, []byte(fmt.Sprintf("%d", highest+1)), 0644); err != nil {
+		return fmt.Errorf("failed to initialize serial file: %w", err)
+	}
+
+	return nil
+}
+
+// readSerialFile returns the next serial number from serial.txt, or 0 if it does not exist
+func readSerialFile() (int64, error) {
+	serialPath, err := getCAFilePath("serial.txt")
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := os.ReadFile(serialPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read serial file: %w", err)
+	}
+
+	var serial int64
+	if _, err := fmt.Sscanf(string(data), "%d", &serial); err != nil {
+		return 0, fmt.Errorf("failed to parse serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndLoadIssuedCertificates(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Empty index
+	issued, err := loadIssuedCertificates()
+	if err != nil {
+		t.Fatalf("Failed to load empty index: %v", err)
+	}
+	if len(issued) != 0 {
+		t.Errorf("Expected empty index, got %d entries", len(issued))
+	}
+
+	notAfter := time.Unix(1900000000, 0)
+	certs := []*x509.Certificate{
+		{SerialNumber: big.NewInt(7), NotAfter: notAfter, Subject: pkix.Name{CommonName: "example.com"}, AuthorityKeyId: []byte{0xab, 0xcd}},
+		{SerialNumber: big.NewInt(8), NotAfter: notAfter, Subject: pkix.Name{CommonName: "a,b", Organization: []string{"Acme"}}},
+	}
+	for _, cert := range certs {
+		if err := recordIssuedCertificate(cert); err != nil {
+			t.Fatalf("Failed to record certificate: %v", err)
+		}
+	}
+
+	issued, err = loadIssuedCertificates()
+	if err != nil {
+		t.Fatalf("Failed to load index: %v", err)
+	}
+	if len(issued) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(issued))
+	}
+	if issued[0].SerialNumber.Int64() != 7 || !issued[0].NotAfter.Equal(notAfter) || issued[0].Issuer != "abcd" || issued[0].Subject != "CN=example.com" {
+		t.Errorf("Unexpected first entry: %+v", issued[0])
+	}
+	if issued[1].Issuer != "" || issued[1].Subject != certs[1].Subject.String() {
+		t.Errorf("Expected subject %q without issuer, got %+v", certs[1].Subject.String(), issued[1])
+	}
+}
+
+func TestInitSerialNumber(t *testing.T) {
+	tests := []struct {
+		name     string
+		serial   string // serial.txt contents, empty for none
+		issued   []int64
+		expected int64
+	}{
+		{"fresh CA", "", nil, 1},
+		{"keeps counter", "10", []int64{3, 9}, 10},
+		{"counter behind index", "2", []int64{5, 17}, 18},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create temp directory
+			tmpDir := t.TempDir()
+			customCADir = tmpDir
+			defer func() { customCADir = "" }()
+
+			if tt.serial != "" {
+				if err := os.WriteFile(filepath.Join(tmpDir, "serial.txt"), []byte(tt.serial), 0644); err != nil {
+					t.Fatalf("Failed to write serial file: %v", err)
+				}
+			}
+			for _, s := range tt.issued {
+				cert := &x509.Certificate{SerialNumber: big.NewInt(s), NotAfter: time.Now()}
+				if err := recordIssuedCertificate(cert); err != nil {
+					t.Fatalf("Failed to record certificate: %v", err)
+				}
+			}
+
+			if err := initSerialNumber(); err != nil {
+				t.Fatalf("Failed to initialize serial number: %v", err)
+			}
+
+			serial, err := getSerialNumber()
+			if err != nil {
+				t.Fatalf("Failed to get serial number: %v", err)
+			}
+			if serial != tt.expected {
+				t.Errorf("Expected serial %d, got %d", tt.expected, serial)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"slices"
+)
+
+// defaultIssuerName selects the main intermediate CA with -issuer
+const defaultIssuerName = "default"
+
+// issuerPurposes maps the purposes of an issuer to the extended key usage
+// placed on its certificate
+var issuerPurposes = map[string]x509.ExtKeyUsage{
+	"tls":    x509.ExtKeyUsageServerAuth,
+	"client": x509.ExtKeyUsageClientAuth,
+	"smime":  x509.ExtKeyUsageEmailProtection,
+}
+
+// validateIssuers validates the purpose-specific issuers in ca.issuers
+func validateIssuers(cfg *Config) error {
+	names := map[string]bool{}
+	commonNames := map[string]bool{
+		cfg.CA.Root.pkixName(defaultRootCN, "").CommonName:                 true,
+		cfg.CA.Intermediate.pkixName(defaultIntermediateCN, "").CommonName: true,
+	}
+	for i, ic := range cfg.CA.Issuers {
+		section := fmt.Sprintf("ca.issuers[%d]", i)
+		if err := validateCAName(ic.Name); err != nil {
+			return fmt.Errorf("%s: %w", section, err)
+		}
+		if ic.Name == defaultIssuerName {
+			return fmt.Errorf("%s: name '%s' is reserved for the main intermediate CA", section, defaultIssuerName)
+		}
+		if names[ic.Name] {
+			return fmt.Errorf("%s: duplicate issuer name '%s'", section, ic.Name)
+		}
+		names[ic.Name] = true
+
+		if len(ic.Purposes) == 0 {
+			return fmt.Errorf("%s: at least one purpose is required", section)
+		}
+		for _, purpose := range ic.Purposes {
+			if _, ok := issuerPurposes[purpose]; !ok {
+				return fmt.Errorf("%s: purpose must be 'tls', 'client' or 'smime', got '%s'", section, purpose)
+			}
+		}
+
+		if err := validateSubject(section+".subject", ic.subject(), cfg.CA.UniqueSuffix); err != nil {
+			return err
+		}
+		cn := ic.subject().CommonName
+		if commonNames[cn] {
+			return fmt.Errorf("%s: common name '%s' is already used by another CA", section, cn)
+		}
+		commonNames[cn] = true
+	}
+	return nil
+}
+
+// subject returns the issuer subject, defaulting the common name to
+// "Certy Intermediate CA <name>"
+func (ic IssuerConfig) subject() SubjectConfig {
+	subject := ic.Subject
+	if subject.CommonName == "" {
+		subject.CommonName = defaultIntermediateCN + " " + ic.Name
+	}
+	return subject
+}
+
+// extKeyUsage returns the extended key usages that restrict the issuer
+func (ic IssuerConfig) extKeyUsage() []x509.ExtKeyUsage {
+	var usages []x509.ExtKeyUsage
+	for _, purpose := range ic.Purposes {
+		usages = append(usages, issuerPurposes[purpose])
+	}
+	return usages
+}
+
+// issuerBaseName returns the file and key name of an issuer. The empty name
+// and "default" refer to the main intermediate CA.
+func issuerBaseName(name string) string {
+	if name == "" || name == defaultIssuerName {
+		return "intermediateCA"
+	}
+	return "intermediateCA-" + name
+}
+
+// issuerCRLName returns the default CRL file name of an issuer
+func issuerCRLName(name string) string {
+	if name == "" || name == defaultIssuerName {
+		return "crl.pem"
+	}
+	return "crl-" + name + ".pem"
+}
+
+// findIssuerConfig returns the configured issuer with the given name
+func findIssuerConfig(cfg *Config, name string) (IssuerConfig, error) {
+	for _, ic := range cfg.CA.Issuers {
+		if ic.Name == name {
+			return ic, nil
+		}
+	}
+	return IssuerConfig{}, fmt.Errorf("issuer %s is not defined in ca.issuers", name)
+}
+
+// certTypePurpose returns the issuer purpose matching a certificate type
+func certTypePurpose(certType CertificateType) string {
+	switch certType {
+	case CertTypeClient:
+		return "client"
+	case CertTypeSMIME:
+		return "smime"
+	default:
+		return "tls"
+	}
+}
+
+// selectIssuer returns the name of the issuer for a certificate type: the
+// explicit issuer if given, otherwise the first configured issuer whose
+// purposes include the type, otherwise the main intermediate CA
+func selectIssuer(certType CertificateType, explicit string, cfg *Config) (string, error) {
+	if explicit != "" {
+		if explicit != defaultIssuerName {
+			if _, err := findIssuerConfig(cfg, explicit); err != nil {
+				return "", err
+			}
+		}
+		return explicit, nil
+	}
+
+	purpose := certTypePurpose(certType)
+	for _, ic := range cfg.CA.Issuers {
+		if slices.Contains(ic.Purposes, purpose) {
+			if !caFileExists(issuerBaseName(ic.Name) + ".pem") {
+				return "", fmt.Errorf("issuer %s for %s certificates is not installed (run: certy -add-issuer %s)", ic.Name, purpose, ic.Name)
+			}
+			return ic.Name, nil
+		}
+	}
+	return defaultIssuerName, nil
+}
+
+// loadIssuer loads the key and certificate of an issuer
+func loadIssuer(name string) (crypto.Signer, *x509.Certificate, error) {
+	return loadCA(issuerBaseName(name))
+}
+
+// checkIssuerUsage returns an error unless the issuer certificate permits all
+// of the given extended key usages. An issuer without extended key usages is
+// unrestricted.
+func checkIssuerUsage(issuer *x509.Certificate, usages []x509.ExtKeyUsage) error {
+	if len(issuer.ExtKeyUsage) == 0 || slices.Contains(issuer.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		return nil
+	}
+	for _, usage := range usages {
+		if !slices.Contains(issuer.ExtKeyUsage, usage) {
+			return fmt.Errorf("issuer %q is not allowed to issue certificates for this purpose", issuer.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+// restrictToIssuerUsage returns the usages permitted by the issuer
+// certificate, or all of them if the issuer is unrestricted
+func restrictToIssuerUsage(issuer *x509.Certificate, usages []x509.ExtKeyUsage) []x509.ExtKeyUsage {
+	if len(issuer.ExtKeyUsage) == 0 || slices.Contains(issuer.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		return usages
+	}
+	var permitted []x509.ExtKeyUsage
+	for _, usage := range usages {
+		if slices.Contains(issuer.ExtKeyUsage, usage) {
+			permitted = append(permitted, usage)
+		}
+	}
+	return permitted
+}
+
+// createIssuer generates the key and certificate of a purpose-specific issuer
+// signed by the parent CA and saves it with its cross certificate and
+// fullchain
+func createIssuer(ic IssuerConfig, backend KeyBackend, parentKey crypto.Signer, parentCert *x509.Certificate, suffix string, cfg *Config) error {
+	baseName := issuerBaseName(ic.Name)
+	key, err := backend.CreateKey(baseName, cfg.DefaultKeyType, cfg.DefaultKeySize)
+	if err != nil {
+		return fmt.Errorf("failed to generate %s issuer key: %w", ic.Name, err)
+	}
+	cert, err := signIntermediateCA(key.Public(), ic.subject().pkixName(defaultIntermediateCN, suffix), ic.extKeyUsage(), parentKey, parentCert, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to generate %s issuer: %w", ic.Name, err)
+	}
+
+	if err := saveCACertificate(cert, baseName); err != nil {
+		return fmt.Errorf("failed to save %s issuer: %w", ic.Name, err)
+	}
+	if err := savePreviousRootCross(backend, baseName, cert, cfg); err != nil {
+		return err
+	}
+	if err := saveChainBundles(baseName, cert); err != nil {
+		return fmt.Errorf("failed to save %s issuer fullchain: %w", ic.Name, err)
+	}
+	return nil
+}
+
+// addIssuer creates an issuer defined in ca.issuers for an installed CA
+func addIssuer(name string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	ic, err := findIssuerConfig(cfg, name)
+	if err != nil {
+		return err
+	}
+	if caFileExists(issuerBaseName(name) + ".pem") {
+		return fmt.Errorf("issuer %s already exists (use -rotate-intermediate -issuer %s to replace it)", name, name)
+	}
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Load the signing CA and the root for its install suffix
+	parentKey, parentCert, err := loadIssuingParent(backend, cfg)
+	if err != nil {
+		return err
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		return err
+	}
+
+	return createIssuer(ic, backend, parentKey, parentCert, rootSuffix(rootCert, cfg), cfg)
+}
+
+// installedIssuers returns the names of the main intermediate CA and the
+// configured issuers whose certificates exist
+func installedIssuers(cfg *Config) []string {
+	var installed []string
+	names := []string{defaultIssuerName}
+	for _, ic := range cfg.CA.Issuers {
+		names = append(names, ic.Name)
+	}
+	for _, name := range names {
+		if caFileExists(issuerBaseName(name) + ".pem") {
+			installed = append(installed, name)
+		}
+	}
+	return installed
+}
+
+// loadIntermediateCertificates returns the certificates of the main
+// intermediate CA and all installed purpose-specific issuers
+func loadIntermediateCertificates(cfg *Config) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, name := range installedIssuers(cfg) {
+		cert, err := loadCACertificate(issuerBaseName(name))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateIssuers(t *testing.T) {
+	tests := []struct {
+		name    string
+		issuers []IssuerConfig
+		wantErr string
+	}{
+		{
+			name: "valid issuers",
+			issuers: []IssuerConfig{
+				{Name: "server", Purposes: []string{"tls"}},
+				{Name: "mail", Purposes: []string{"smime", "client"}},
+			},
+		},
+		{
+			name:    "invalid name",
+			issuers: []IssuerConfig{{Name: "../server", Purposes: []string{"tls"}}},
+			wantErr: "invalid CA name",
+		},
+		{
+			name:    "reserved name",
+			issuers: []IssuerConfig{{Name: "default", Purposes: []string{"tls"}}},
+			wantErr: "reserved",
+		},
+		{
+			name: "duplicate name",
+			issuers: []IssuerConfig{
+				{Name: "server", Purposes: []string{"tls"}},
+				{Name: "server", Purposes: []string{"client"}},
+			},
+			wantErr: "duplicate issuer name",
+		},
+		{
+			name:    "no purposes",
+			issuers: []IssuerConfig{{Name: "server"}},
+			wantErr: "at least one purpose",
+		},
+		{
+			name:    "unknown purpose",
+			issuers: []IssuerConfig{{Name: "server", Purposes: []string{"codesigning"}}},
+			wantErr: "purpose must be",
+		},
+		{
+			name:    "common name of the intermediate",
+			issuers: []IssuerConfig{{Name: "server", Purposes: []string{"tls"}, Subject: SubjectConfig{CommonName: defaultIntermediateCN}}},
+			wantErr: "already used",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.CA.Issuers = tt.issuers
+			err := validateConfig(cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected valid config, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIssuersRouteByCertificateType(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure a server and an S/MIME issuer before installing
+	cfg := DefaultConfig()
+	cfg.CA.Issuers = []IssuerConfig{
+		{Name: "server", Purposes: []string{"tls"}},
+		{Name: "mail", Purposes: []string{"smime"}, Subject: SubjectConfig{CommonName: "Certy Mail CA"}},
+	}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+
+	// Verify the issuers carry their EKU restrictions
+	serverCA, err := loadCACertificate("intermediateCA-server")
+	if err != nil {
+		t.Fatalf("Failed to load server issuer: %v", err)
+	}
+	if serverCA.Subject.CommonName != "Certy Intermediate CA server" {
+		t.Errorf("Unexpected server issuer common name %q", serverCA.Subject.CommonName)
+	}
+	if !slices.Equal(serverCA.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+		t.Errorf("Expected server issuer EKU [serverAuth], got %v", serverCA.ExtKeyUsage)
+	}
+	mailCA, err := loadCACertificate("intermediateCA-mail")
+	if err != nil {
+		t.Fatalf("Failed to load mail issuer: %v", err)
+	}
+	if !slices.Equal(mailCA.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}) {
+		t.Errorf("Expected mail issuer EKU [emailProtection], got %v", mailCA.ExtKeyUsage)
+	}
+	if !caFileExists("intermediateCA-server-fullchain.pem") {
+		t.Error("Expected server issuer fullchain to exist")
+	}
+
+	tests := []struct {
+		name     string
+		inputs   []string
+		certType CertificateType
+		issuer   *x509.Certificate
+	}{
+		{"TLS", []string{"example.com"}, CertTypeTLS, serverCA},
+		{"S/MIME", []string{"user@example.com"}, CertTypeSMIME, mailCA},
+		{"client falls back to intermediate", []string{"client@example.com"}, CertTypeClient, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPath := filepath.Join(tmpDir, "leaf.pem")
+			opts := CertOptions{CertFile: certPath, KeyFile: filepath.Join(tmpDir, "leaf-key.pem")}
+			if _, _, err := generateCertificate(tt.inputs, tt.certType, opts, cfg); err != nil {
+				t.Fatalf("Failed to generate certificate: %v", err)
+			}
+			cert := loadCertFromFile(t, certPath)
+
+			issuer := tt.issuer
+			if issuer == nil {
+				issuer, err = loadCACertificate("intermediateCA")
+				if err != nil {
+					t.Fatalf("Failed to load intermediate CA: %v", err)
+				}
+			}
+			if err := cert.CheckSignatureFrom(issuer); err != nil {
+				t.Errorf("Expected certificate issued by %q: %v", issuer.Subject.CommonName, err)
+			}
+
+			// Verify the chain validates for the certificate's own usage
+			roots := x509.NewCertPool()
+			roots.AddCert(rootCert)
+			intermediates := x509.NewCertPool()
+			intermediates.AddCert(issuer)
+			if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: cert.ExtKeyUsage}); err != nil {
+				t.Errorf("Failed to verify certificate chain: %v", err)
+			}
+		})
+	}
+
+	// An explicit issuer must allow the certificate type
+	opts := CertOptions{CertFile: filepath.Join(tmpDir, "bad.pem"), KeyFile: filepath.Join(tmpDir, "bad-key.pem"), Issuer: "mail"}
+	if _, _, err := generateCertificate([]string{"example.com"}, CertTypeTLS, opts, cfg); err == nil {
+		t.Error("Expected error issuing a TLS certificate from the S/MIME issuer")
+	}
+
+	// The main intermediate can still be selected explicitly
+	opts = CertOptions{CertFile: filepath.Join(tmpDir, "default.pem"), KeyFile: filepath.Join(tmpDir, "default-key.pem"), Issuer: "default"}
+	if _, _, err := generateCertificate([]string{"example.com"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate with the default issuer: %v", err)
+	}
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	if err := loadCertFromFile(t, filepath.Join(tmpDir, "default.pem")).CheckSignatureFrom(intCert); err != nil {
+		t.Errorf("Expected certificate issued by the intermediate CA: %v", err)
+	}
+}
+
+func TestAddIssuer(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Routing to a configured but missing issuer fails
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cfg.CA.Issuers = []IssuerConfig{{Name: "mtls", Purposes: []string{"client"}}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if _, err := selectIssuer(CertTypeClient, "", cfg); err == nil || !strings.Contains(err.Error(), "-add-issuer mtls") {
+		t.Errorf("Expected error pointing to -add-issuer, got %v", err)
+	}
+
+	// Unknown issuers are rejected
+	if err := addIssuer("unknown"); err == nil {
+		t.Error("Expected error adding an issuer missing from the config")
+	}
+
+	// Add the issuer
+	if err := addIssuer("mtls"); err != nil {
+		t.Fatalf("Failed to add issuer: %v", err)
+	}
+	if err := addIssuer("mtls"); err == nil {
+		t.Error("Expected error adding an existing issuer")
+	}
+	if name, err := selectIssuer(CertTypeClient, "", cfg); err != nil || name != "mtls" {
+		t.Errorf("Expected client certificates routed to mtls, got %q (%v)", name, err)
+	}
+
+	// CSRs signed by a client-only issuer get only clientAuth
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"client.example.com"}}, csrKey)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+	csrPath := filepath.Join(tmpDir, "client.csr")
+	if err := os.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 0644); err != nil {
+		t.Fatalf("Failed to write CSR: %v", err)
+	}
+	certPath, err := generateFromCSR(csrPath, CertOptions{CertFile: filepath.Join(tmpDir, "client.pem"), Issuer: "mtls"}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate from CSR: %v", err)
+	}
+	cert := loadCertFromFile(t, certPath)
+	if !slices.Equal(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("Expected EKU [clientAuth], got %v", cert.ExtKeyUsage)
+	}
+
+	// The issuer signs its own CRL
+	if err := generateIssuerCRL("", "mtls"); err != nil {
+		t.Fatalf("Failed to generate issuer CRL: %v", err)
+	}
+	if !caFileExists("crl-mtls.pem") {
+		t.Error("Expected crl-mtls.pem to exist")
+	}
+
+	// Rotating the issuer keeps its restrictions and archives the old one
+	oldCert, err := loadCACertificate("intermediateCA-mtls")
+	if err != nil {
+		t.Fatalf("Failed to load issuer: %v", err)
+	}
+	archiveName, err := rotateIntermediateCA("mtls")
+	if err != nil {
+		t.Fatalf("Failed to rotate issuer: %v", err)
+	}
+	if !strings.HasPrefix(archiveName, filepath.Join(archiveDirName, "intermediate-mtls-")) {
+		t.Errorf("Unexpected archive name %q", archiveName)
+	}
+	if !caFileExists(filepath.Join(archiveName, "intermediateCA-mtls.pem")) || !caFileExists(filepath.Join(archiveName, "intermediateCA-mtls-key.pem")) {
+		t.Error("Expected old issuer certificate and key to be archived")
+	}
+	newCert, err := loadCACertificate("intermediateCA-mtls")
+	if err != nil {
+		t.Fatalf("Failed to load rotated issuer: %v", err)
+	}
+	if newCert.Equal(oldCert) {
+		t.Error("Expected a new issuer certificate")
+	}
+	if !slices.Equal(newCert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("Expected rotated issuer EKU [clientAuth], got %v", newCert.ExtKeyUsage)
+	}
+}
+
+func TestReinstallCAReplacesIssuers(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA with an issuer
+	cfg := DefaultConfig()
+	cfg.CA.Issuers = []IssuerConfig{{Name: "server", Purposes: []string{"tls"}}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	oldKey, err := os.ReadFile(filepath.Join(tmpDir, "intermediateCA-server-key.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read issuer key: %v", err)
+	}
+
+	// Reinstall
+	archiveName, err := reinstallCA()
+	if err != nil {
+		t.Fatalf("Failed to reinstall CA: %v", err)
+	}
+
+	// The old issuer key is archived and the new issuer chains to the new root
+	archivedKey, err := os.ReadFile(filepath.Join(tmpDir, archiveName, "intermediateCA-server-key.pem"))
+	if err != nil || !bytes.Equal(archivedKey, oldKey) {
+		t.Errorf("Expected the previous issuer key in the archive: %v", err)
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	serverCA, err := loadCACertificate("intermediateCA-server")
+	if err != nil {
+		t.Fatalf("Failed to load server issuer: %v", err)
+	}
+	if err := serverCA.CheckSignatureFrom(rootCert); err != nil {
+		t.Errorf("Expected issuer signed by the new root: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// generatePrivateKey generates a private key of the given type and size.
+// For RSA keys keySize is the modulus length in bits, for ECDSA keys it
+// selects the curve (256, 384 or 521). Ed25519 keys ignore keySize.
+func generatePrivateKey(keyType string, keySize int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		}
+		return key, nil
+	case "ecdsa":
+		curve, err := ecdsaCurve(keySize)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+		}
+		return key, nil
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+}
+
+// resolveKeySpec translates a key specification such as "rsa3072", "p384" or
+// "ed25519" into a key type and size. An empty specification selects the
+// configured default. The bare names "rsa" and "ecdsa" use the configured
+// size when the configured type matches, otherwise RSA 2048 and P-256.
+func resolveKeySpec(spec string, cfg *Config) (string, int, error) {
+	switch strings.ToLower(spec) {
+	case "":
+		return cfg.DefaultKeyType, cfg.DefaultKeySize, nil
+	case "rsa":
+		if cfg.DefaultKeyType == "rsa" {
+			return "rsa", cfg.DefaultKeySize, nil
+		}
+		return "rsa", 2048, nil
+	case "ecdsa":
+		if cfg.DefaultKeyType == "ecdsa" {
+			return "ecdsa", cfg.DefaultKeySize, nil
+		}
+		return "ecdsa", 256, nil
+	case "rsa2048":
+		return "rsa", 2048, nil
+	case "rsa3072":
+		return "rsa", 3072, nil
+	case "rsa4096":
+		return "rsa", 4096, nil
+	case "p256":
+		return "ecdsa", 256, nil
+	case "p384":
+		return "ecdsa", 384, nil
+	case "p521":
+		return "ecdsa", 521, nil
+	case "ed25519":
+		return "ed25519", 0, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported key type %q (valid: rsa2048, rsa3072, rsa4096, p256, p384, p521, ed25519)", spec)
+	}
+}
+
+// ecdsaCurve returns the elliptic curve matching an ECDSA key size
+func ecdsaCurve(keySize int) (elliptic.Curve, error) {
+	switch keySize {
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported ECDSA key size: %d", keySize)
+	}
+}
+
+// marshalPrivateKeyPEM encodes a private key into a PEM block.
+// RSA keys are written as PKCS#1 and ECDSA keys as SEC 1 so that files
+// stay readable by tools expecting the traditional OpenSSL formats.
+// Ed25519 has no traditional format and is written as PKCS#8.
+func marshalPrivateKeyPEM(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}, nil
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ECDSA key: %w", err)
+		}
+		return &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: keyBytes,
+		}, nil
+	case ed25519.PrivateKey:
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal Ed25519 key: %w", err)
+		}
+		return &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: keyBytes,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type")
+	}
+}
+
+// parsePrivateKeyPEM decodes a private key from a PEM block
+func parsePrivateKeyPEM(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RSA private key: %w", err)
+		}
+		return key, nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EC private key: %w", err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PKCS#8 private key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported PKCS#8 key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %s", block.Type)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/pem"
+	"testing"
+)
+
+func TestGeneratePrivateKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyType string
+		keySize int
+		wantErr bool
+	}{
+		{"RSA 2048", "rsa", 2048, false},
+		{"ECDSA P-256", "ecdsa", 256, false},
+		{"ECDSA P-384", "ecdsa", 384, false},
+		{"ECDSA P-521", "ecdsa", 521, false},
+		{"Ed25519", "ed25519", 0, false},
+		{"ECDSA invalid curve", "ecdsa", 224, true},
+		{"unknown key type", "dsa", 2048, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := generatePrivateKey(tt.keyType, tt.keySize)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			switch k := key.(type) {
+			case *rsa.PrivateKey:
+				if tt.keyType != "rsa" || k.N.BitLen() != tt.keySize {
+					t.Errorf("Expected %s/%d, got RSA/%d", tt.keyType, tt.keySize, k.N.BitLen())
+				}
+			case *ecdsa.PrivateKey:
+				if tt.keyType != "ecdsa" || k.Curve.Params().BitSize != tt.keySize {
+					t.Errorf("Expected %s/%d, got ECDSA/%d", tt.keyType, tt.keySize, k.Curve.Params().BitSize)
+				}
+			case ed25519.PrivateKey:
+				if tt.keyType != "ed25519" {
+					t.Errorf("Expected %s, got Ed25519", tt.keyType)
+				}
+			default:
+				t.Errorf("Unexpected key type %T", key)
+			}
+		})
+	}
+}
+
+func TestResolveKeySpec(t *testing.T) {
+	rsaCfg := DefaultConfig()
+	ecdsaCfg := DefaultConfig()
+	ecdsaCfg.DefaultKeyType = "ecdsa"
+	ecdsaCfg.DefaultKeySize = 384
+
+	tests := []struct {
+		name         string
+		spec         string
+		cfg          *Config
+		expectedType string
+		expectedSize int
+		wantErr      bool
+	}{
+		{"empty uses RSA default", "", rsaCfg, "rsa", 2048, false},
+		{"empty uses ECDSA default", "", ecdsaCfg, "ecdsa", 384, false},
+		{"bare ecdsa follows config curve", "ecdsa", ecdsaCfg, "ecdsa", 384, false},
+		{"bare ecdsa with RSA config", "ecdsa", rsaCfg, "ecdsa", 256, false},
+		{"bare rsa with ECDSA config", "rsa", ecdsaCfg, "rsa", 2048, false},
+		{"rsa3072", "rsa3072", rsaCfg, "rsa", 3072, false},
+		{"rsa4096", "rsa4096", ecdsaCfg, "rsa", 4096, false},
+		{"p256", "p256", ecdsaCfg, "ecdsa", 256, false},
+		{"P521 uppercase", "P521", rsaCfg, "ecdsa", 521, false},
+		{"ed25519", "ed25519", rsaCfg, "ed25519", 0, false},
+		{"invalid", "rsa1024", rsaCfg, "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyType, keySize, err := resolveKeySpec(tt.spec, tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if keyType != tt.expectedType || keySize != tt.expectedSize {
+				t.Errorf("Expected %s/%d, got %s/%d", tt.expectedType, tt.expectedSize, keyType, keySize)
+			}
+		})
+	}
+}
+
+func TestMarshalAndParsePrivateKeyPEM(t *testing.T) {
+	tests := []struct {
+		keyType      string
+		keySize      int
+		expectedType string
+	}{
+		{"rsa", 2048, "RSA PRIVATE KEY"},
+		{"ecdsa", 256, "EC PRIVATE KEY"},
+		{"ed25519", 0, "PRIVATE KEY"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expectedType, func(t *testing.T) {
+			key, err := generatePrivateKey(tt.keyType, tt.keySize)
+			if err != nil {
+				t.Fatalf("Failed to generate key: %v", err)
+			}
+
+			block, err := marshalPrivateKeyPEM(key)
+			if err != nil {
+				t.Fatalf("Failed to marshal key: %v", err)
+			}
+			if block.Type != tt.expectedType {
+				t.Errorf("Expected %s, got %s", tt.expectedType, block.Type)
+			}
+
+			// Round-trip through PEM encoding
+			decoded, _ := pem.Decode(pem.EncodeToMemory(block))
+			parsed, err := parsePrivateKeyPEM(decoded)
+			if err != nil {
+				t.Fatalf("Failed to parse key: %v", err)
+			}
+
+			type equaler interface {
+				Equal(x crypto.PublicKey) bool
+			}
+			if !parsed.Public().(equaler).Equal(key.Public()) {
+				t.Error("Parsed key does not match original")
+			}
+		})
+	}
+}
+
+func TestParsePrivateKeyPEMUnsupported(t *testing.T) {
+	block := &pem.Block{Type: "DSA PRIVATE KEY", Bytes: []byte("invalid")}
+	if _, err := parsePrivateKeyPEM(block); err == nil {
+		t.Error("Expected error for unsupported key type")
+	}
+}
@@ -6,26 +6,68 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var version = "dev"
 var customCADir string // Global variable for custom CA directory
+var caName string      // Named CA selected via -ca flag
 
 func main() {
 	// Define flags
 	installFlag := flag.Bool("install", false, "Create a rootCA with an intermediateCA")
-	reinstallFlag := flag.Bool("reinstall", false, "Regenerate CA certificates (useful after config changes)")
+	reinstallFlag := flag.Bool("reinstall", false, "Regenerate CA certificates after backing up the CA directory (useful after config changes)")
+	forceFlag := flag.Bool("force", false, "Skip the -reinstall confirmation prompt, or replace an existing CA on import")
+	rotateIntermediateFlag := flag.Bool("rotate-intermediate", false, "Replace the intermediate CA, keeping the root CA and archiving the old intermediate")
+	addIssuerFlag := flag.String("add-issuer", "", "Create an issuer defined in ca.issuers for an installed CA")
+	issuerFlag := flag.String("issuer", "", "Intermediate CA to issue with, rotate or sign the CRL with (default: by certificate type)")
+	rolloverRootFlag := flag.Bool("rollover-root", false, "Replace the root CA, cross-signing the old and new roots so both stay trusted")
+	exportRootKeyFlag := flag.String("export-root-key", "", "Move the root CA key into an encrypted archive file, taking the root offline")
+	rootKeyFlag := flag.String("root-key", "", "Offline root CA key for this invocation (for -rotate-intermediate, -rollover-root, -add-issuer and -gen-root-crl)")
+	rootKeyPassphraseFileFlag := flag.String("root-key-passphrase-file", "", "File containing the root key archive passphrase (default: $CERTY_ROOT_KEY_PASSPHRASE or prompt)")
+	externalRootFlag := flag.Bool("external-root", false, "With -install, generate only the intermediate key and a CSR for signing by an external root")
+	finishIntermediateFlag := flag.String("finish-intermediate", "", "Complete an -external-root install with the signed intermediate certificate")
+	importIntermediateFlag := flag.String("import-intermediate", "", "Import an existing intermediate CA certificate (PEM, DER or PKCS#12) instead of generating one")
+	importIntermediateKeyFlag := flag.String("import-intermediate-key", "", "Private key of the imported intermediate CA, if not in the -import-intermediate file")
+	importRootFlag := flag.String("import-root", "", "Root CA certificate for -import-intermediate, if not in the -import-intermediate file")
+	importRootKeyFlag := flag.String("import-root-key", "", "Private key of the imported root CA (optional)")
+	importPassphraseFileFlag := flag.String("import-passphrase-file", "", "File containing the password of imported PKCS#12 files and encrypted keys (default: $CERTY_IMPORT_PASSPHRASE or prompt)")
+	caFlag := flag.String("ca", "", "Named CA to use (default: $CERTY_CA or the CA set with -set-default-ca)")
+	listCAsFlag := flag.Bool("list-cas", false, "List the CAs in the certy directory and exit")
+	setDefaultCAFlag := flag.String("set-default-ca", "", "Set the CA used when -ca is not given ('default' for the top-level CA)")
 	caDirFlag := flag.String("ca-dir", "", "Custom directory for CA files (default: ~/.certy or $CAROOT)")
 	carootFlag := flag.Bool("CAROOT", false, "Print the CA root directory path and exit")
 	certFileFlag := flag.String("cert-file", "", "Customize the certificate output path")
 	keyFileFlag := flag.String("key-file", "", "Customize the key output path")
+	encryptCAKeysFlag := flag.Bool("encrypt-ca-keys", false, "Encrypt the unencrypted CA keys of an existing install with the CA key passphrase")
+	caPassphraseFileFlag := flag.String("ca-passphrase-file", "", "File containing the CA key passphrase (default: $CERTY_CA_PASSPHRASE or prompt)")
+	encryptKeyFlag := flag.Bool("encrypt-key", false, "Encrypt the generated private key with a passphrase")
+	keyPassphraseFileFlag := flag.String("key-passphrase-file", "", "File containing the private key passphrase (default: $CERTY_KEY_PASSPHRASE or prompt)")
 	p12FileFlag := flag.String("p12-file", "", "Customize the PKCS#12 output path")
 	p12PasswordFlag := flag.String("p12-password", "", "Password for PKCS#12 file (empty for no password)")
 	clientFlag := flag.Bool("client", false, "Generate a certificate for client authentication")
+	profileFlag := flag.String("profile", "", "Issuance profile from config.yml for the certificate or -csr")
+	organizationFlag := flag.String("organization", "", "Subject organization (O) of the certificate or -csr")
+	organizationalUnitFlag := flag.String("organizational-unit", "", "Subject organizational unit (OU) of the certificate or -csr")
+	countryFlag := flag.String("country", "", "Subject two-letter country code (C) of the certificate or -csr")
+	provinceFlag := flag.String("province", "", "Subject state or province (ST) of the certificate or -csr")
+	localityFlag := flag.String("locality", "", "Subject locality (L) of the certificate or -csr")
+	subjectSerialFlag := flag.String("subject-serial", "", "Subject serialNumber attribute of the certificate or -csr (not the certificate serial)")
+	var rdnFlags stringList
+	flag.Var(&rdnFlags, "rdn", "Additional subject attribute as OID=VALUE, e.g. 2.5.4.97=VATDE-123 (repeatable)")
+	noCNFlag := flag.Bool("no-cn", false, "Leave the common name out of the subject, relying on the SANs")
+	validityFlag := flag.String("validity", "", "Validity of the certificate or -csr as a Go duration or in days, e.g. 12h or 30d (default from profile or config)")
+	notBeforeFlag := flag.String("not-before", "", "Start of the validity as an RFC 3339 timestamp, e.g. 2026-01-02T15:04:05Z (default: now minus backdate)")
+	notAfterFlag := flag.String("not-after", "", "End of the validity as an RFC 3339 timestamp (conflicts with -validity)")
 	ecdsaFlag := flag.Bool("ecdsa", false, "Generate a certificate with an ECDSA key")
+	ed25519Flag := flag.Bool("ed25519", false, "Generate a certificate with an Ed25519 key")
+	keyTypeFlag := flag.String("key-type", "", "Key algorithm: rsa2048, rsa3072, rsa4096, p256, p384, p521 or ed25519 (default from config)")
 	pkcs12Flag := flag.Bool("pkcs12", false, "Generate a PKCS#12 file")
 	csrFlag := flag.String("csr", "", "Generate a certificate based on the supplied CSR")
 	gencrlFlag := flag.String("gencrl", "", "Generate a CRL (Certificate Revocation List) file")
+	crlArchiveFlag := flag.String("crl-archive", "", "With -gencrl, sign the CRL with the intermediate archived in this directory, e.g. archive/intermediate-<timestamp>")
+	exportIssuersFlag := flag.String("export-issuers", "", "Write the CA certificates in DER to a directory for serving at ca_issuers_url")
+	genRootCRLFlag := flag.String("gen-root-crl", "", "Generate a CRL signed by the root CA (e.g. for revoked intermediates)")
 	revokeFlag := flag.String("revoke", "", "Revoke a certificate by serial number")
 
 	flag.Usage = func() {
@@ -34,11 +76,30 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  certy [options] [domains/IPs/email...]\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "  certy -install                                    # Initialize CA infrastructure\n")
-		fmt.Fprintf(os.Stderr, "  certy -reinstall                                  # Regenerate CA after config changes\n")
+		fmt.Fprintf(os.Stderr, "  certy -reinstall                                  # Back up and regenerate CA after config changes\n")
+		fmt.Fprintf(os.Stderr, "  certy -rotate-intermediate                        # Issue a new intermediate CA under the same root\n")
+		fmt.Fprintf(os.Stderr, "  certy -rollover-root                              # Replace the root CA with cross-signed roots\n")
+		fmt.Fprintf(os.Stderr, "  certy -export-root-key /media/usb/root.pem        # Take the root CA key offline\n")
+		fmt.Fprintf(os.Stderr, "  certy -rotate-intermediate -root-key /media/usb/root.pem  # Use it for one command\n")
+		fmt.Fprintf(os.Stderr, "  certy -encrypt-ca-keys                            # Encrypt the CA keys of an older install\n")
+		fmt.Fprintf(os.Stderr, "  certy -add-issuer smime                           # Create an issuer defined in ca.issuers\n")
+		fmt.Fprintf(os.Stderr, "  certy -issuer smime user@domain.com               # Issue with a specific intermediate CA\n")
+		fmt.Fprintf(os.Stderr, "  certy -install -external-root                     # Create an intermediate CSR for an external root\n")
+		fmt.Fprintf(os.Stderr, "  certy -finish-intermediate int.pem -import-root root.pem  # Complete it with the signed certificate\n")
+		fmt.Fprintf(os.Stderr, "  certy -import-intermediate int.p12 -import-root root.pem  # Use an existing CA\n")
+		fmt.Fprintf(os.Stderr, "  certy -ca staging -install                        # Create a named CA\n")
+		fmt.Fprintf(os.Stderr, "  certy -set-default-ca staging                     # Use it when -ca is not given\n")
 		fmt.Fprintf(os.Stderr, "  certy example.com \"*.example.com\" 127.0.0.1      # Generate TLS certificate\n")
 		fmt.Fprintf(os.Stderr, "  certy user@domain.com                             # Generate S/MIME certificate\n")
 		fmt.Fprintf(os.Stderr, "  certy -client user@domain.com                     # Generate client auth certificate\n")
+		fmt.Fprintf(os.Stderr, "  certy -profile grpc-both api.internal             # Generate certificate with a config profile\n")
+		fmt.Fprintf(os.Stderr, "  certy -no-cn -organization Example example.com    # Set the subject, without a common name\n")
+		fmt.Fprintf(os.Stderr, "  certy -profile spiffe spiffe://prod.example/ns/web/sa/api  # Generate an X.509-SVID\n")
+		fmt.Fprintf(os.Stderr, "  certy -key-type p384 example.com                  # Generate certificate with a P-384 key\n")
+		fmt.Fprintf(os.Stderr, "  certy -client -validity 8h service.internal       # Generate a short-lived certificate\n")
+		fmt.Fprintf(os.Stderr, "  certy -export-issuers /var/www/pki                # Publish issuer certificates for AIA\n")
 		fmt.Fprintf(os.Stderr, "  certy -gencrl crl.pem                             # Generate CRL file\n")
+		fmt.Fprintf(os.Stderr, "  certy -gencrl old.crl -crl-archive archive/intermediate-20260101T000000Z  # Sign with a rotated intermediate\n")
 		fmt.Fprintf(os.Stderr, "  certy -revoke 1234567890                          # Revoke a certificate\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
@@ -51,6 +112,18 @@ func main() {
 		customCADir = *caDirFlag
 	}
 
+	// Select a named CA if provided via -ca flag
+	caName = *caFlag
+
+	// Set passphrase files if provided
+	caPassphrase.file = *caPassphraseFileFlag
+	keyPassphrase.file = *keyPassphraseFileFlag
+	importPassphrase.file = *importPassphraseFileFlag
+	rootKeyPassphrase.file = *rootKeyPassphraseFileFlag
+
+	// Use an offline root key for this invocation if provided
+	rootKeyFile = *rootKeyFlag
+
 	// Handle -CAROOT flag (print CA directory and exit)
 	if *carootFlag {
 		dir, err := getCertyDir()
@@ -61,23 +134,154 @@ func main() {
 		return
 	}
 
+	// Handle -list-cas flag
+	if *listCAsFlag {
+		names, err := listCAs()
+		if err != nil {
+			fatal("Failed to list CAs: %v", err)
+		}
+		home, err := getCertyHome()
+		if err != nil {
+			fatal("Failed to get CA directory: %v", err)
+		}
+		current, err := selectedCAName(home)
+		if err != nil {
+			fatal("%v", err)
+		}
+		for _, name := range names {
+			marker := " "
+			if name == current {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\n", marker, name)
+		}
+		return
+	}
+
+	// Handle -set-default-ca flag
+	if *setDefaultCAFlag != "" {
+		if err := setDefaultCA(*setDefaultCAFlag); err != nil {
+			fatal("Failed to set default CA: %v", err)
+		}
+		fmt.Printf("✓ Default CA set to %s\n", *setDefaultCAFlag)
+		return
+	}
+
 	// Handle -reinstall flag
 	if *reinstallFlag {
-		if !caExists() {
-			fatal("CA not found. Please run 'certy -install' first to initialize the CA infrastructure.")
+		requireCA()
+		if !*forceFlag {
+			dir, err := getCertyDir()
+			if err != nil {
+				fatal("Failed to get CA directory: %v", err)
+			}
+			if err := confirmReinstall(dir); err != nil {
+				fatal("%v", err)
+			}
 		}
-		if err := installCA(); err != nil {
+		archiveName, err := reinstallCA()
+		if err != nil {
 			fatal("Failed to reinstall CA: %v", err)
 		}
 		fmt.Println("✓ CA certificates regenerated successfully")
+		fmt.Printf("  Previous CA backed up in %s\n", archiveName)
+		return
+	}
+
+	// Handle -rotate-intermediate flag
+	if *rotateIntermediateFlag {
+		requireCA()
+		archiveName, err := rotateIntermediateCA(*issuerFlag)
+		if err != nil {
+			fatal("Failed to rotate intermediate CA: %v", err)
+		}
+		fmt.Println("✓ Intermediate CA rotated successfully")
+		fmt.Printf("  Previous intermediate archived in %s\n", archiveName)
+		fmt.Printf("  Its certificates are revoked on its own CRL: certy -gencrl FILE -crl-archive %s\n", archiveName)
+		return
+	}
+
+	// Handle -rollover-root flag
+	if *rolloverRootFlag {
+		requireCA()
+		archiveName, err := rolloverRoot()
+		if err != nil {
+			fatal("Failed to roll over root CA: %v", err)
+		}
+		fmt.Println("✓ Root CA rolled over successfully")
+		fmt.Printf("  Previous CA archived in %s\n", archiveName)
+		fmt.Println("  Distribute rootCA.pem, then run 'certy -rotate-intermediate' to issue under the new root")
+		return
+	}
+
+	// Handle -export-root-key flag
+	if *exportRootKeyFlag != "" {
+		requireCA()
+		if err := exportRootKey(*exportRootKeyFlag); err != nil {
+			fatal("Failed to export root CA key: %v", err)
+		}
+		fmt.Printf("✓ Root CA key exported to %s and removed from the CA directory\n", *exportRootKeyFlag)
+		fmt.Println("  Keep the file offline; pass it with -root-key when the root is needed")
+		return
+	}
+
+	// Handle -encrypt-ca-keys flag
+	if *encryptCAKeysFlag {
+		requireCA()
+		names, err := encryptExistingCAKeys()
+		if err != nil {
+			fatal("Failed to encrypt CA keys: %v", err)
+		}
+		if len(names) == 0 {
+			fmt.Println("✓ All CA keys are already encrypted")
+			return
+		}
+		fmt.Printf("✓ Encrypted CA keys: %s\n", strings.Join(names, ", "))
+		return
+	}
+
+	// Handle -add-issuer flag
+	if *addIssuerFlag != "" {
+		requireCA()
+		if err := addIssuer(*addIssuerFlag); err != nil {
+			fatal("Failed to add issuer: %v", err)
+		}
+		fmt.Printf("✓ Issuer %s created successfully\n", *addIssuerFlag)
+		return
+	}
+
+	// Handle -import-intermediate flag
+	if *importIntermediateFlag != "" {
+		opts := ImportOptions{
+			RootFile:            *importRootFlag,
+			RootKeyFile:         *importRootKeyFlag,
+			IntermediateFile:    *importIntermediateFlag,
+			IntermediateKeyFile: *importIntermediateKeyFlag,
+			Replace:             *forceFlag,
+		}
+		archiveName, err := importCA(opts)
+		if err != nil {
+			fatal("Failed to import CA: %v", err)
+		}
+		fmt.Println("✓ CA imported successfully")
+		if archiveName != "" {
+			fmt.Printf("  Previous CA backed up in %s\n", archiveName)
+		}
+		return
+	}
+
+	// Handle -finish-intermediate flag
+	if *finishIntermediateFlag != "" {
+		if err := finishIntermediateCA(*finishIntermediateFlag, *importRootFlag); err != nil {
+			fatal("Failed to complete intermediate CA: %v", err)
+		}
+		fmt.Println("✓ CA infrastructure installed successfully")
 		return
 	}
 
 	// Handle -revoke flag
 	if *revokeFlag != "" {
-		if !caExists() {
-			fatal("CA not found. Please run 'certy -install' first to initialize the CA infrastructure.")
-		}
+		requireCA()
 		if err := revokeCertificate(*revokeFlag, 0); err != nil {
 			fatal("Failed to revoke certificate: %v", err)
 		}
@@ -88,35 +292,98 @@ func main() {
 
 	// Handle -gencrl flag
 	if *gencrlFlag != "" {
-		if !caExists() {
-			fatal("CA not found. Please run 'certy -install' first to initialize the CA infrastructure.")
-		}
-		if err := generateCRL(*gencrlFlag); err != nil {
-			fatal("Failed to generate CRL: %v", err)
-		}
+		requireCA()
 		outputPath := *gencrlFlag
-		if outputPath == "" {
-			outputPath, _ = getCAFilePath("crl.pem")
+		if *crlArchiveFlag != "" {
+			if err := generateArchivedCRL(*gencrlFlag, *crlArchiveFlag, *issuerFlag); err != nil {
+				fatal("Failed to generate CRL: %v", err)
+			}
+		} else {
+			if err := generateIssuerCRL(*gencrlFlag, *issuerFlag); err != nil {
+				fatal("Failed to generate CRL: %v", err)
+			}
+			if outputPath == "" {
+				outputPath, _ = getCAFilePath(issuerCRLName(*issuerFlag))
+			}
 		}
 		fmt.Printf("✓ CRL generated successfully: %s\n", outputPath)
 		return
 	}
 
+	// Handle -export-issuers flag
+	if *exportIssuersFlag != "" {
+		requireCA()
+		files, err := exportIssuerCertificates(*exportIssuersFlag)
+		if err != nil {
+			fatal("Failed to export issuer certificates: %v", err)
+		}
+		for _, file := range files {
+			fmt.Printf("✓ %s\n", filepath.Join(*exportIssuersFlag, file))
+		}
+		return
+	}
+
+	// Handle -gen-root-crl flag
+	if *genRootCRLFlag != "" {
+		requireCA()
+		if err := generateRootCRL(*genRootCRLFlag); err != nil {
+			fatal("Failed to generate root CRL: %v", err)
+		}
+		fmt.Printf("✓ Root CRL generated successfully: %s\n", *genRootCRLFlag)
+		return
+	}
+
 	// Validate flag conflicts
 	if *csrFlag != "" {
-		if *clientFlag || *ecdsaFlag || *pkcs12Flag || flag.NArg() > 0 {
-			fatal("The -csr flag conflicts with all other flags except -install, -cert-file, -key-file, and -p12-file")
+		if *clientFlag || *ecdsaFlag || *ed25519Flag || *keyTypeFlag != "" || *encryptKeyFlag || *pkcs12Flag || flag.NArg() > 0 {
+			fatal("The -csr flag conflicts with all other flags except -install, -issuer, -profile, the subject and validity flags, -cert-file, -key-file, and -p12-file")
 		}
 	}
 
-	// Handle -install flag
+	if *externalRootFlag && !*installFlag {
+		fatal("The -external-root flag can only be used with -install")
+	}
+
+	if *crlArchiveFlag != "" {
+		fatal("The -crl-archive flag can only be used with -gencrl")
+	}
+
+	if *profileFlag != "" && *clientFlag {
+		fatal("The -profile and -client flags cannot be used together; the profile sets the key usages")
+	}
+
+	if *validityFlag != "" && *notAfterFlag != "" {
+		fatal("The -validity and -not-after flags cannot be used together")
+	}
+
+	if *ecdsaFlag && *ed25519Flag {
+		fatal("The -ecdsa and -ed25519 flags cannot be used together")
+	}
+	if *keyTypeFlag != "" && (*ecdsaFlag || *ed25519Flag) {
+		fatal("The -key-type flag cannot be combined with -ecdsa or -ed25519")
+	}
+
+	// Handle -install flag (an existing CA is kept; use -reinstall to replace it)
 	if *installFlag {
-		if err := installCA(); err != nil {
-			fatal("Failed to install CA: %v", err)
-		}
-		fmt.Println("✓ CA infrastructure installed successfully")
-		if !*installFlag && flag.NArg() == 0 && *csrFlag == "" {
-			return
+		switch caStatus() {
+		case CAReady:
+			fmt.Println("✓ CA infrastructure already installed (use -reinstall to regenerate)")
+		case CAPending:
+			fatal("The intermediate CA is waiting for its signed certificate. Run 'certy -finish-intermediate FILE' to complete the installation.")
+		default:
+			if *externalRootFlag {
+				csrPath, err := installPendingIntermediate()
+				if err != nil {
+					fatal("Failed to install CA: %v", err)
+				}
+				fmt.Printf("✓ Intermediate CA key and CSR generated: %s\n", csrPath)
+				fmt.Println("  Have the CSR signed by your root CA, then run 'certy -finish-intermediate FILE -import-root ROOT'")
+				return
+			}
+			if err := installCA(); err != nil {
+				fatal("Failed to install CA: %v", err)
+			}
+			fmt.Println("✓ CA infrastructure installed successfully")
 		}
 	}
 
@@ -130,9 +397,7 @@ func main() {
 	}
 
 	// Ensure CA is installed before generating certificates
-	if !caExists() {
-		fatal("CA not found. Please run 'certy -install' first to initialize the CA infrastructure.")
-	}
+	requireCA()
 
 	// Load configuration
 	cfg, err := loadConfig()
@@ -140,12 +405,53 @@ func main() {
 		fatal("Failed to load configuration: %v", err)
 	}
 
+	// Collect the subject attributes given on the command line
+	attributes, err := parseAttributeFlags(rdnFlags)
+	if err != nil {
+		fatal("%v", err)
+	}
+	subject := SubjectConfig{
+		Organization:       *organizationFlag,
+		OrganizationalUnit: *organizationalUnitFlag,
+		Country:            *countryFlag,
+		Province:           *provinceFlag,
+		Locality:           *localityFlag,
+		SerialNumber:       *subjectSerialFlag,
+		Attributes:         attributes,
+	}
+
+	// Parse the validity flags
+	var validity time.Duration
+	if *validityFlag != "" {
+		if validity, err = parseValidity(*validityFlag); err != nil {
+			fatal("%v", err)
+		}
+	}
+	notBefore, err := parseTimestampFlag("not-before", *notBeforeFlag)
+	if err != nil {
+		fatal("%v", err)
+	}
+	notAfter, err := parseTimestampFlag("not-after", *notAfterFlag)
+	if err != nil {
+		fatal("%v", err)
+	}
+
 	// Generate certificate
 	var certPath, keyPath, p12Path string
 
 	if *csrFlag != "" {
 		// Generate from CSR
-		certPath, err = generateFromCSR(*csrFlag, *certFileFlag, cfg)
+		opts := CertOptions{
+			CertFile:       *certFileFlag,
+			Issuer:         *issuerFlag,
+			Profile:        *profileFlag,
+			Subject:        subject,
+			OmitCommonName: *noCNFlag,
+			Validity:       validity,
+			NotBefore:      notBefore,
+			NotAfter:       notAfter,
+		}
+		certPath, err = generateFromCSR(*csrFlag, opts, cfg)
 		if err != nil {
 			fatal("Failed to generate certificate from CSR: %v", err)
 		}
@@ -160,7 +466,29 @@ func main() {
 		// Determine certificate type and generate
 		certType := detectCertificateType(inputs, *clientFlag)
 
-		certPath, keyPath, err = generateCertificate(inputs, certType, *ecdsaFlag, *certFileFlag, *keyFileFlag, cfg)
+		// Determine key algorithm (empty means the configured default)
+		keySpec := *keyTypeFlag
+		if *ecdsaFlag {
+			keySpec = "ecdsa"
+		} else if *ed25519Flag {
+			keySpec = "ed25519"
+		}
+
+		opts := CertOptions{
+			KeySpec:        keySpec,
+			CertFile:       *certFileFlag,
+			KeyFile:        *keyFileFlag,
+			EncryptKey:     *encryptKeyFlag,
+			Issuer:         *issuerFlag,
+			Profile:        *profileFlag,
+			Subject:        subject,
+			OmitCommonName: *noCNFlag,
+			Validity:       validity,
+			NotBefore:      notBefore,
+			NotAfter:       notAfter,
+		}
+
+		certPath, keyPath, err = generateCertificate(inputs, certType, opts, cfg)
 		if err != nil {
 			fatal("Failed to generate certificate: %v", err)
 		}
@@ -184,6 +512,56 @@ func main() {
 	}
 }
 
+// requireCA exits with a helpful message unless the CA is ready to sign
+func requireCA() {
+	switch caStatus() {
+	case CAReady:
+		return
+	case CAPending:
+		fatal("The intermediate CA is waiting for its signed certificate. Run 'certy -finish-intermediate FILE' to complete the installation.")
+	default:
+		fatal("CA not found. Please run 'certy -install' first to initialize the CA infrastructure.")
+	}
+}
+
+// stringList is a flag that can be repeated, collecting every value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseAttributeFlags parses -rdn values of the form OID=VALUE
+func parseAttributeFlags(values []string) ([]AttributeConfig, error) {
+	var attributes []AttributeConfig
+	for _, value := range values {
+		oid, attrValue, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -rdn value %q, expected OID=VALUE", value)
+		}
+		attributes = append(attributes, AttributeConfig{OID: strings.TrimSpace(oid), Value: attrValue})
+	}
+	return attributes, nil
+}
+
+// parseTimestampFlag parses an RFC 3339 timestamp given to the named flag,
+// returning the zero time for an empty value
+func parseTimestampFlag(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s value %q, expected an RFC 3339 timestamp such as 2026-01-02T15:04:05Z", name, value)
+	}
+	return t, nil
+}
+
 func fatal(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "Error: "+format+"\n", args...)
 	os.Exit(1)
@@ -191,7 +569,7 @@ func fatal(format string, args ...interface{}) {
 
 func detectCertificateType(inputs []string, clientAuth bool) CertificateType {
 	// Check if first input is an email (S/MIME)
-	if len(inputs) > 0 && strings.Contains(inputs[0], "@") {
+	if len(inputs) > 0 && strings.Contains(inputs[0], "@") && !strings.Contains(inputs[0], "://") {
 		return CertTypeSMIME
 	}
 
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain supplies the CA key passphrase, since CA keys are encrypted by
+// default, and lowers the PBKDF2 iteration count to keep the tests fast
+func TestMain(m *testing.M) {
+	pbkdf2Iterations = 1000
+	os.Setenv("CERTY_CA_PASSPHRASE", "test-ca-passphrase")
+	os.Exit(m.Run())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// rootKeyFile is the offline root key supplied with -root-key. It is only
+// used for the current invocation and never copied into the certy directory.
+var rootKeyFile string
+
+// rootKeyPassphrase supplies the passphrase protecting exported root keys
+var rootKeyPassphrase = &passphraseSource{name: "root key passphrase", envVar: "CERTY_ROOT_KEY_PASSPHRASE"}
+
+// exportRootKey writes the root CA certificate and its key, encrypted with a
+// passphrase from rootKeyPassphrase, to path and removes the key from the
+// certy directory. The key of the previous root kept by -rollover-root is
+// exported and removed along with it. The archive is read back and checked
+// before the keys are removed.
+func exportRootKey(path string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.KeyBackend == "pkcs11" {
+		return fmt.Errorf("the root key cannot be exported from a PKCS#11 token")
+	}
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Collect the root keys still in the certy directory
+	has, err := backend.HasKey("rootCA")
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("root CA key is not in the certy directory (already offline?)")
+	}
+	names := []string{"rootCA"}
+	has, err = backend.HasKey(previousRootName)
+	if err != nil {
+		return err
+	}
+	if has {
+		names = append(names, previousRootName)
+	}
+
+	passphrase, err := rootKeyPassphrase.get(true)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt each key for the archive, next to its certificate
+	var data []byte
+	certs := make([]*x509.Certificate, 0, len(names))
+	for _, name := range names {
+		key, err := backend.Signer(name)
+		if err != nil {
+			return err
+		}
+		cert, err := loadCACertificate(name)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := encryptPrivateKeyPEM(key, passphrase)
+		if err != nil {
+			return err
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		data = append(data, pem.EncodeToMemory(keyPEM)...)
+		certs = append(certs, cert)
+	}
+
+	// Write the archive, never overwriting an existing file
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create root key archive: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write root key archive: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write root key archive: %w", err)
+	}
+
+	// Make sure the archive can be used before removing the keys
+	for _, cert := range certs {
+		key, err := readRootKeyFile(path, cert)
+		if err != nil {
+			return fmt.Errorf("failed to verify root key archive: %w", err)
+		}
+		if key == nil {
+			return fmt.Errorf("failed to verify root key archive: no key for %s", cert.Subject.CommonName)
+		}
+	}
+
+	for _, name := range names {
+		keyPath, err := getCAFilePath(name + "-key.pem")
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(keyPath); err != nil {
+			return fmt.Errorf("failed to remove %s key: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// loadRootKey returns the root CA signer, read from the -root-key file when
+// one was given and from the key backend otherwise
+func loadRootKey(backend KeyBackend, rootCert *x509.Certificate) (crypto.Signer, error) {
+	if rootKeyFile != "" {
+		key, err := readRootKeyFile(rootKeyFile, rootCert)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("the key in %s does not belong to the root CA", rootKeyFile)
+		}
+		return key, nil
+	}
+	has, err := backend.HasKey("rootCA")
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("root CA key is not available; pass the offline root key with -root-key FILE")
+	}
+	return backend.Signer("rootCA")
+}
+
+// loadPreviousRootKey returns the signer of the previous root CA, read from
+// the -root-key file when it holds that key and from the key backend
+// otherwise, or nil when neither has it
+func loadPreviousRootKey(backend KeyBackend, previousRoot *x509.Certificate) (crypto.Signer, error) {
+	if rootKeyFile != "" {
+		key, err := readRootKeyFile(rootKeyFile, previousRoot)
+		if err != nil || key != nil {
+			return key, err
+		}
+	}
+	has, err := backend.HasKey(previousRootName)
+	if err != nil || !has {
+		return nil, err
+	}
+	return backend.Signer(previousRootName)
+}
+
+// readRootKeyFile reads the private keys in a PEM file, decrypting them with
+// rootKeyPassphrase, and returns the one belonging to cert, or nil if none does
+func readRootKeyFile(path string, cert *x509.Certificate) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root key: %w", err)
+	}
+
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			continue
+		}
+
+		key, err := loadPrivateKeyPEM(block, rootKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		if findCertificateForKey([]*x509.Certificate{cert}, key) != nil {
+			return key, nil
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no private key found in %s", path)
+	}
+	return nil, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportRootKey(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+	t.Setenv("CERTY_ROOT_KEY_PASSPHRASE", "offline-root")
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Export the root key
+	archivePath := filepath.Join(t.TempDir(), "root-offline.pem")
+	if err := exportRootKey(archivePath); err != nil {
+		t.Fatalf("Failed to export root key: %v", err)
+	}
+	if caFileExists("rootCA-key.pem") {
+		t.Error("Expected root CA key to be removed from the CA directory")
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to stat archive: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected archive mode 0600, got %o", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	if !strings.Contains(string(data), "ENCRYPTED PRIVATE KEY") {
+		t.Error("Expected the archived root key to be encrypted")
+	}
+
+	// The CA keeps issuing certificates
+	if caStatus() != CAReady {
+		t.Errorf("Expected CA to stay ready, got %v", caStatus())
+	}
+	opts := CertOptions{CertFile: filepath.Join(tmpDir, "leaf.pem"), KeyFile: filepath.Join(tmpDir, "leaf-key.pem")}
+	if _, _, err := generateCertificate([]string{"example.com"}, CertTypeTLS, opts, DefaultConfig()); err != nil {
+		t.Fatalf("Failed to generate certificate with an offline root: %v", err)
+	}
+
+	// Exporting again fails
+	if err := exportRootKey(filepath.Join(t.TempDir(), "again.pem")); err == nil {
+		t.Error("Expected error exporting an offline root key")
+	}
+
+	// Operations needing the root fail without -root-key
+	if _, err := rotateIntermediateCA(""); err == nil || !strings.Contains(err.Error(), "-root-key") {
+		t.Errorf("Expected error pointing to -root-key, got %v", err)
+	}
+
+	// They succeed with -root-key, without putting the key back
+	rootKeyFile = archivePath
+	defer func() { rootKeyFile = "" }()
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA with the offline root: %v", err)
+	}
+	if caFileExists("rootCA-key.pem") {
+		t.Error("Expected root CA key to stay offline")
+	}
+
+	// The root CRL is signed by the root
+	crlPath := filepath.Join(tmpDir, "root.crl")
+	if err := generateRootCRL(crlPath); err != nil {
+		t.Fatalf("Failed to generate root CRL: %v", err)
+	}
+	crlData, err := os.ReadFile(crlPath)
+	if err != nil {
+		t.Fatalf("Failed to read root CRL: %v", err)
+	}
+	block, _ := pem.Decode(crlData)
+	if block == nil {
+		t.Fatal("Failed to decode root CRL PEM")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse root CRL: %v", err)
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(rootCert); err != nil {
+		t.Errorf("Expected root CRL signed by the root CA: %v", err)
+	}
+
+	// A wrong passphrase is rejected
+	t.Setenv("CERTY_ROOT_KEY_PASSPHRASE", "wrong")
+	if err := generateRootCRL(crlPath); err == nil {
+		t.Error("Expected error with a wrong root key passphrase")
+	}
+}
+
+func TestLoadRootKeyRejectsForeignKey(t *testing.T) {
+	// Create an unrelated CA and keep its root key file
+	otherDir := t.TempDir()
+	customCADir = otherDir
+	defer func() { customCADir = "" }()
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	foreignKey := filepath.Join(otherDir, "rootCA-key.pem")
+
+	// The key file is encrypted with the CA passphrase
+	t.Setenv("CERTY_ROOT_KEY_PASSPHRASE", os.Getenv("CERTY_CA_PASSPHRASE"))
+
+	// Use it against a different CA
+	customCADir = t.TempDir()
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	rootKeyFile = foreignKey
+	defer func() { rootKeyFile = "" }()
+	if _, err := rotateIntermediateCA(""); err == nil || !strings.Contains(err.Error(), "does not belong") {
+		t.Errorf("Expected error for a foreign root key, got %v", err)
+	}
+}
+
+func TestExportRootKeyAfterRollover(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+	t.Setenv("CERTY_ROOT_KEY_PASSPHRASE", "offline-root")
+
+	// Install CA and roll over the root
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	oldRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	if _, err := rolloverRoot(); err != nil {
+		t.Fatalf("Failed to roll over root CA: %v", err)
+	}
+	newRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load new root CA: %v", err)
+	}
+
+	// Both root keys leave the CA directory
+	archivePath := filepath.Join(t.TempDir(), "root-offline.pem")
+	if err := exportRootKey(archivePath); err != nil {
+		t.Fatalf("Failed to export root key: %v", err)
+	}
+	for _, file := range []string{"rootCA-key.pem", "rootCA-previous-key.pem"} {
+		if caFileExists(file) {
+			t.Errorf("Expected %s to be removed from the CA directory", file)
+		}
+	}
+
+	// Without -root-key the intermediate cannot be rotated
+	if _, err := rotateIntermediateCA(""); err == nil {
+		t.Error("Expected error rotating the intermediate without -root-key")
+	}
+
+	// With the archive, the new intermediate is signed by the new root and
+	// cross-signed by the previous one
+	rootKeyFile = archivePath
+	defer func() { rootKeyFile = "" }()
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA with the offline roots: %v", err)
+	}
+	intCross, err := loadCACertificate("intermediateCA-cross")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate cross certificate: %v", err)
+	}
+	if err := intCross.CheckSignatureFrom(oldRoot); err != nil {
+		t.Errorf("Expected intermediate cross-signed by the previous root: %v", err)
+	}
+	leaf := issueTestLeaf(t, tmpDir, "leaf", DefaultConfig())
+	verifyWithBundle(t, leaf, newRoot, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+	verifyWithBundle(t, leaf, oldRoot, filepath.Join(tmpDir, "intermediateCA-fullchain-previous.pem"))
+}
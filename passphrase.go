@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// passphraseSource describes where a private key passphrase is read from.
+// An explicit file takes priority over the environment variable, and the
+// terminal is only prompted when neither is available.
+type passphraseSource struct {
+	name     string // human readable name used in prompts and errors
+	envVar   string // environment variable holding the passphrase
+	file     string // file whose first line is the passphrase (set from flags)
+	prompted []byte // passphrase entered at the prompt, reused for this invocation
+}
+
+// caPassphrase supplies the passphrase protecting CA private keys
+var caPassphrase = &passphraseSource{name: "CA key passphrase", envVar: "CERTY_CA_PASSPHRASE"}
+
+// keyPassphrase supplies the passphrase protecting issued private keys
+var keyPassphrase = &passphraseSource{name: "private key passphrase", envVar: "CERTY_KEY_PASSPHRASE"}
+
+// get returns the passphrase. When confirm is set and the passphrase is read
+// from the terminal, it must be entered twice.
+func (s *passphraseSource) get(confirm bool) ([]byte, error) {
+	// Priority 1: passphrase file
+	if s.file != "" {
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s file: %w", s.name, err)
+		}
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			data = data[:i]
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%s file %s is empty", s.name, s.file)
+		}
+		return data, nil
+	}
+
+	// Priority 2: environment variable
+	if value := os.Getenv(s.envVar); value != "" {
+		return []byte(value), nil
+	}
+
+	// Priority 3: interactive prompt
+	if s.prompted != nil {
+		return s.prompted, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("no %s available: set %s or supply a passphrase file", s.name, s.envVar)
+	}
+
+	passphrase, err := readPassword(fmt.Sprintf("Enter %s: ", s.name))
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("%s must not be empty", s.name)
+	}
+	if confirm {
+		again, err := readPassword(fmt.Sprintf("Confirm %s: ", s.name))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, fmt.Errorf("%s entries do not match", s.name)
+		}
+	}
+
+	s.prompted = passphrase
+	return passphrase, nil
+}
+
+// readPassword prompts on stderr and reads a line from the terminal without echo
+func readPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
+
+// loadPrivateKeyPEM parses a private key PEM block, decrypting it with a
+// passphrase from src when it is an encrypted PKCS#8 key
+func loadPrivateKeyPEM(block *pem.Block, src *passphraseSource) (crypto.Signer, error) {
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return parsePrivateKeyPEM(block)
+	}
+
+	passphrase, err := src.get(false)
+	if err != nil {
+		return nil, err
+	}
+	return decryptPrivateKeyPEM(block, passphrase)
+}
+
+// encodePrivateKeyPEM encodes a private key, encrypting it when a passphrase is given
+func encodePrivateKeyPEM(key crypto.Signer, passphrase []byte) (*pem.Block, error) {
+	if passphrase != nil {
+		return encryptPrivateKeyPEM(key, passphrase)
+	}
+	return marshalPrivateKeyPEM(key)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPassphraseSource(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Run("file takes priority over environment", func(t *testing.T) {
+		t.Setenv("CERTY_TEST_PASSPHRASE", "from-env")
+		path := filepath.Join(tmpDir, "passphrase.txt")
+		if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+			t.Fatalf("Failed to write passphrase file: %v", err)
+		}
+
+		src := &passphraseSource{name: "test passphrase", envVar: "CERTY_TEST_PASSPHRASE", file: path}
+		passphrase, err := src.get(false)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(passphrase) != "from-file" {
+			t.Errorf("Expected 'from-file', got '%s'", passphrase)
+		}
+	})
+
+	t.Run("environment variable", func(t *testing.T) {
+		t.Setenv("CERTY_TEST_PASSPHRASE", "from-env")
+
+		src := &passphraseSource{name: "test passphrase", envVar: "CERTY_TEST_PASSPHRASE"}
+		passphrase, err := src.get(true)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(passphrase) != "from-env" {
+			t.Errorf("Expected 'from-env', got '%s'", passphrase)
+		}
+	})
+
+	t.Run("empty file is rejected", func(t *testing.T) {
+		path := filepath.Join(tmpDir, "empty.txt")
+		if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+			t.Fatalf("Failed to write passphrase file: %v", err)
+		}
+
+		src := &passphraseSource{name: "test passphrase", envVar: "CERTY_TEST_PASSPHRASE", file: path}
+		if _, err := src.get(false); err == nil {
+			t.Error("Expected error for empty passphrase file")
+		}
+	})
+
+	t.Run("no source without a terminal", func(t *testing.T) {
+		t.Setenv("CERTY_TEST_PASSPHRASE", "")
+
+		src := &passphraseSource{name: "test passphrase", envVar: "CERTY_TEST_PASSPHRASE"}
+		if _, err := src.get(false); err == nil {
+			t.Error("Expected error when no passphrase source is available")
+		}
+	})
+}
+
+func TestLoadPrivateKeyPEM(t *testing.T) {
+	t.Setenv("CERTY_TEST_PASSPHRASE", "secret")
+	src := &passphraseSource{name: "test passphrase", envVar: "CERTY_TEST_PASSPHRASE"}
+
+	key, err := generatePrivateKey("ecdsa", 256)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// Plain keys are parsed without consulting the passphrase source
+	plain, err := encodePrivateKeyPEM(key, nil)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	if plain.Type != "EC PRIVATE KEY" {
+		t.Errorf("Expected EC PRIVATE KEY, got %s", plain.Type)
+	}
+	if _, err := loadPrivateKeyPEM(plain, src); err != nil {
+		t.Errorf("Failed to load plain key: %v", err)
+	}
+
+	// Encrypted keys are decrypted with the passphrase from the source
+	encrypted, err := encodePrivateKeyPEM(key, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	if _, err := loadPrivateKeyPEM(encrypted, src); err != nil {
+		t.Errorf("Failed to load encrypted key: %v", err)
+	}
+
+	t.Setenv("CERTY_TEST_PASSPHRASE", "wrong")
+	if _, err := loadPrivateKeyPEM(encrypted, src); err == nil {
+		t.Error("Expected error when loading with the wrong passphrase")
+	}
+}
@@ -0,0 +1,231 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11PIN supplies the user PIN for the PKCS#11 token
+var pkcs11PIN = &passphraseSource{name: "PKCS#11 PIN", envVar: "CERTY_PKCS11_PIN"}
+
+// pkcs11Contexts caches open token sessions so a single invocation logs in once
+var (
+	pkcs11Contexts   = map[string]*crypto11.Context{}
+	pkcs11ContextsMu sync.Mutex
+)
+
+// pkcs11Backend keeps CA keys inside a PKCS#11 token. Keys never leave the
+// token; each CA key pair is identified by CKA_LABEL and CKA_ID set to its
+// CA base name prefixed with the configured key prefix.
+type pkcs11Backend struct {
+	ctx    *crypto11.Context
+	cfg    PKCS11Config
+	pin    string
+	prefix string
+}
+
+// newPKCS11Backend opens (or reuses) a session with the configured token
+func newPKCS11Backend(cfg PKCS11Config) (KeyBackend, error) {
+	cacheKey := fmt.Sprintf("%s|%s|%v", cfg.Module, cfg.TokenLabel, cfg.Slot)
+
+	pkcs11ContextsMu.Lock()
+	defer pkcs11ContextsMu.Unlock()
+
+	pkcs11PIN.file = cfg.PinFile
+	pin, err := pkcs11PIN.get(false)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, ok := pkcs11Contexts[cacheKey]
+	if !ok {
+		ctx, err = crypto11.Configure(&crypto11.Config{
+			Path:       cfg.Module,
+			TokenLabel: cfg.TokenLabel,
+			SlotNumber: cfg.Slot,
+			Pin:        string(pin),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open PKCS#11 token: %w", err)
+		}
+		pkcs11Contexts[cacheKey] = ctx
+	}
+
+	return &pkcs11Backend{ctx: ctx, cfg: cfg, pin: string(pin), prefix: cfg.KeyPrefix}, nil
+}
+
+// CreateKey generates a key pair inside the token, replacing any existing
+// key pair with the same label
+func (b *pkcs11Backend) CreateKey(name, keyType string, keySize int) (crypto.Signer, error) {
+	label := []byte(b.prefix + name)
+
+	// Remove a previous key pair so lookups by label stay unambiguous
+	existing, err := b.ctx.FindKeyPairs(nil, label)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search PKCS#11 token: %w", err)
+	}
+	for _, key := range existing {
+		if err := key.Delete(); err != nil {
+			return nil, fmt.Errorf("failed to remove existing %s key from token: %w", name, err)
+		}
+	}
+
+	switch keyType {
+	case "rsa":
+		key, err := b.ctx.GenerateRSAKeyPairWithLabel(label, label, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate RSA key in token: %w", err)
+		}
+		return key, nil
+	case "ecdsa":
+		curve, err := ecdsaCurve(keySize)
+		if err != nil {
+			return nil, err
+		}
+		key, err := b.ctx.GenerateECDSAKeyPairWithLabel(label, label, curve)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ECDSA key in token: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("key type %s is not supported by the PKCS#11 backend", keyType)
+	}
+}
+
+// Signer finds the key pair labelled with the CA name
+func (b *pkcs11Backend) Signer(name string) (crypto.Signer, error) {
+	key, err := b.ctx.FindKeyPair(nil, []byte(b.prefix+name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search PKCS#11 token: %w", err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%s key not found in PKCS#11 token", name)
+	}
+	return key, nil
+}
+
+// HasKey reports whether the token holds a key pair labelled with the CA name
+func (b *pkcs11Backend) HasKey(name string) (bool, error) {
+	key, err := b.ctx.FindKeyPair(nil, []byte(b.prefix+name))
+	if err != nil {
+		return false, fmt.Errorf("failed to search PKCS#11 token: %w", err)
+	}
+	return key != nil, nil
+}
+
+// ImportKey is not supported: CA keys are only ever generated inside the token
+func (b *pkcs11Backend) ImportKey(name string, key crypto.Signer) error {
+	return fmt.Errorf("importing keys is not supported by the PKCS#11 backend")
+}
+
+// CanImport reports that keys cannot be imported into the token
+func (b *pkcs11Backend) CanImport() bool {
+	return false
+}
+
+// ArchiveKey relabels the key pair as <prefix><archiveName>. Keys cannot be
+// exported from the token, so archived keys remain in it under the new label.
+func (b *pkcs11Backend) ArchiveKey(name, archiveName string) error {
+	has, err := b.HasKey(name)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("%s key not found in PKCS#11 token", name)
+	}
+	if err := b.relabel(b.prefix+name, b.prefix+archiveName); err != nil {
+		return fmt.Errorf("failed to archive %s key: %w", name, err)
+	}
+	return nil
+}
+
+// relabel changes CKA_LABEL and CKA_ID of every object labelled oldLabel.
+// crypto11 has no API for modifying attributes, so this uses a separate
+// session on the already initialized module, which is only finalized again
+// if this call initialized it.
+func (b *pkcs11Backend) relabel(oldLabel, newLabel string) error {
+	p := pkcs11.New(b.cfg.Module)
+	if p == nil {
+		return fmt.Errorf("failed to load PKCS#11 module %s", b.cfg.Module)
+	}
+	defer p.Destroy()
+	if err := p.Initialize(); err == nil {
+		defer p.Finalize()
+	} else if !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		return err
+	}
+
+	slot, err := b.findSlot(p)
+	if err != nil {
+		return err
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return err
+	}
+	defer p.CloseSession(session)
+
+	if err := p.Login(session, pkcs11.CKU_USER, b.pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return err
+	}
+
+	// Find all objects with the label (the private and public key, and any
+	// certificate) before changing it
+	if err := p.FindObjectsInit(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, oldLabel)}); err != nil {
+		return err
+	}
+	var handles []pkcs11.ObjectHandle
+	for {
+		var found []pkcs11.ObjectHandle
+		found, _, err = p.FindObjects(session, 16)
+		if err != nil || len(found) == 0 {
+			break
+		}
+		handles = append(handles, found...)
+	}
+	if finalErr := p.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, handle := range handles {
+		if err := p.SetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, newLabel),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, newLabel),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findSlot returns the slot holding the configured token
+func (b *pkcs11Backend) findSlot(p *pkcs11.Ctx) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		if b.cfg.Slot != nil {
+			if int(slot) == *b.cfg.Slot {
+				return slot, nil
+			}
+			continue
+		}
+		info, err := p.GetTokenInfo(slot)
+		if err == nil && info.Label == b.cfg.TokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("PKCS#11 token not found")
+}
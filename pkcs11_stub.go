@@ -0,0 +1,10 @@
+//go:build !pkcs11
+
+package main
+
+import "fmt"
+
+// newPKCS11Backend reports that this binary was built without PKCS#11 support
+func newPKCS11Backend(cfg PKCS11Config) (KeyBackend, error) {
+	return nil, fmt.Errorf("PKCS#11 support is not available in this build (rebuild with -tags pkcs11)")
+}
@@ -0,0 +1,161 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// setupSoftHSM initializes a throwaway SoftHSM2 token and returns a config
+// using it. The test is skipped unless SOFTHSM2_MODULE points at
+// libsofthsm2.so and softhsm2-util is installed.
+func setupSoftHSM(t *testing.T) *Config {
+	t.Helper()
+
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		t.Skip("SOFTHSM2_MODULE not set")
+	}
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skip("softhsm2-util not installed")
+	}
+
+	// Point SoftHSM2 at a private token directory
+	tokenDir := t.TempDir()
+	confPath := filepath.Join(t.TempDir(), "softhsm2.conf")
+	conf := "directories.tokendir = " + tokenDir + "\nobjectstore.backend = file\n"
+	if err := os.WriteFile(confPath, []byte(conf), 0600); err != nil {
+		t.Fatalf("Failed to write SoftHSM2 config: %v", err)
+	}
+	t.Setenv("SOFTHSM2_CONF", confPath)
+	t.Setenv("CERTY_PKCS11_PIN", "1234")
+
+	out, err := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "certy-test", "--pin", "1234", "--so-pin", "5678").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to initialize SoftHSM2 token: %v\n%s", err, out)
+	}
+
+	cfg := DefaultConfig()
+	cfg.KeyBackend = "pkcs11"
+	cfg.PKCS11.Module = module
+	cfg.PKCS11.TokenLabel = "certy-test"
+	return cfg
+}
+
+func TestPKCS11Backend(t *testing.T) {
+	cfg := setupSoftHSM(t)
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open PKCS#11 backend: %v", err)
+	}
+
+	if has, err := backend.HasKey("testCA"); err != nil || has {
+		t.Errorf("Key should not exist before creation (err: %v)", err)
+	}
+
+	key, err := backend.CreateKey("testCA", "ecdsa", 256)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if has, err := backend.HasKey("testCA"); err != nil || !has {
+		t.Errorf("Key should exist after creation (err: %v)", err)
+	}
+
+	signer, err := backend.Signer("testCA")
+	if err != nil {
+		t.Fatalf("Failed to load signer: %v", err)
+	}
+	if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+		t.Error("Loaded signer does not match created key")
+	}
+
+	// Ed25519 is not available through PKCS#11
+	if _, err := backend.CreateKey("edCA", "ed25519", 0); err == nil {
+		t.Error("Expected error creating Ed25519 key in token")
+	}
+
+	if _, err := backend.Signer("missingCA"); err == nil {
+		t.Error("Expected error for missing key")
+	}
+}
+
+func TestIntegration_PKCS11(t *testing.T) {
+	cfg := setupSoftHSM(t)
+
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA with keys held in the token
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	if !caExists() {
+		t.Fatal("CA should exist after installation")
+	}
+	for _, file := range []string{"rootCA-key.pem", "intermediateCA-key.pem"} {
+		if _, err := os.Stat(filepath.Join(tmpDir, file)); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist with the PKCS#11 backend", file)
+		}
+	}
+
+	// Issue a certificate signed by the token
+	certPath, _, err := generateCertificate([]string{"hsm.example.com"}, CertTypeTLS, CertOptions{}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	cert := loadCertFromFile(t, certPath)
+
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intCert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Certificate chain verification failed: %v", err)
+	}
+
+	// CRL signing also uses the token
+	if err := generateCRL(filepath.Join(tmpDir, "test.crl")); err != nil {
+		t.Fatalf("Failed to generate CRL: %v", err)
+	}
+
+	// Rotation relabels the old intermediate key inside the token
+	archiveName, err := rotateIntermediateCA("")
+	if err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open PKCS#11 backend: %v", err)
+	}
+	if has, err := backend.HasKey(filepath.Join(archiveName, "intermediateCA")); err != nil || !has {
+		t.Errorf("Expected archived intermediate key in token (err: %v)", err)
+	}
+	newInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load new intermediate CA: %v", err)
+	}
+	if err := newInt.CheckSignatureFrom(rootCert); err != nil {
+		t.Errorf("New intermediate not signed by root: %v", err)
+	}
+}
@@ -39,46 +39,32 @@ func generatePKCS12(certPath, keyPath, p12Path, password string) error {
 		return fmt.Errorf("failed to decode private key PEM")
 	}
 
-	var privateKey interface{}
-	switch keyBlock.Type {
-	case "RSA PRIVATE KEY":
-		privateKey, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-		if err != nil {
-			return fmt.Errorf("failed to parse RSA private key: %w", err)
-		}
-	case "EC PRIVATE KEY":
-		privateKey, err = x509.ParseECPrivateKey(keyBlock.Bytes)
-		if err != nil {
-			return fmt.Errorf("failed to parse EC private key: %w", err)
-		}
-	default:
-		return fmt.Errorf("unsupported private key type: %s", keyBlock.Type)
+	privateKey, err := loadPrivateKeyPEM(keyBlock, keyPassphrase)
+	if err != nil {
+		return err
 	}
 
-	// Load intermediate CA certificate for the chain
-	intCACertPath, err := getCAFilePath("intermediateCA.pem")
+	// Load the intermediate CA that issued the certificate for the chain
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
-
-	intCACertData, err := os.ReadFile(intCACertPath)
+	intCerts, err := loadIntermediateCertificates(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to read intermediate CA certificate: %w", err)
+		return err
 	}
-
-	intCABlock, _ := pem.Decode(intCACertData)
-	if intCABlock == nil {
-		return fmt.Errorf("failed to decode intermediate CA certificate PEM")
+	intCACert := findIssuer(intCerts, cert)
+	if intCACert == nil {
+		return fmt.Errorf("failed to find the intermediate CA that issued the certificate")
 	}
-
-	intCACert, err := x509.ParseCertificate(intCABlock.Bytes)
+	tiers, err := tierChain(intCACert, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to parse intermediate CA certificate: %w", err)
+		return err
 	}
 
 	// Create PKCS#12 data with the certificate chain
 	// If password is empty, no password protection is used
-	pfxData, err := pkcs12.Modern.Encode(privateKey, cert, []*x509.Certificate{intCACert}, password)
+	pfxData, err := pkcs12.Modern.Encode(privateKey, cert, append([]*x509.Certificate{intCACert}, tiers...), password)
 	if err != nil {
 		return fmt.Errorf("failed to encode PKCS#12: %w", err)
 	}
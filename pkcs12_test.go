@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/x509"
+	"encoding/pem"
 	"os"
 	"path/filepath"
 	"testing"
@@ -25,9 +27,7 @@ func TestGeneratePKCS12(t *testing.T) {
 	certPath, keyPath, err := generateCertificate(
 		[]string{"example.com"},
 		CertTypeTLS,
-		false,
-		"",
-		"",
+		CertOptions{},
 		cfg,
 	)
 	if err != nil {
@@ -107,9 +107,7 @@ func TestGeneratePKCS12WithECDSA(t *testing.T) {
 	certPath, keyPath, err := generateCertificate(
 		[]string{"example.com"},
 		CertTypeTLS,
-		true, // Use ECDSA
-		"",
-		"",
+		CertOptions{KeySpec: "ecdsa"},
 		cfg,
 	)
 	if err != nil {
@@ -153,6 +151,101 @@ func TestGeneratePKCS12WithECDSA(t *testing.T) {
 	}
 }
 
+func TestGeneratePKCS12WithEd25519(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Generate Ed25519 certificate
+	cfg, _ := loadConfig()
+	certPath, keyPath, err := generateCertificate(
+		[]string{"example.com"},
+		CertTypeTLS,
+		CertOptions{KeySpec: "ed25519"},
+		cfg,
+	)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+
+	// Generate PKCS#12
+	p12Path := filepath.Join(tmpDir, "test-ed25519.p12")
+	if err := generatePKCS12(certPath, keyPath, p12Path, ""); err != nil {
+		t.Fatalf("Failed to generate PKCS#12: %v", err)
+	}
+
+	// Load and verify PKCS#12 file
+	p12Data, err := os.ReadFile(p12Path)
+	if err != nil {
+		t.Fatalf("Failed to read PKCS#12 file: %v", err)
+	}
+
+	privateKey, cert, _, err := pkcs12.DecodeChain(p12Data, "")
+	if err != nil {
+		t.Fatalf("Failed to decode PKCS#12: %v", err)
+	}
+
+	// Verify private key is Ed25519
+	if _, ok := privateKey.(ed25519.PrivateKey); !ok {
+		t.Errorf("Expected Ed25519 private key, got %T", privateKey)
+	}
+
+	// Verify certificate uses Ed25519
+	if cert.PublicKeyAlgorithm != x509.Ed25519 {
+		t.Errorf("Expected Ed25519 public key algorithm, got %v", cert.PublicKeyAlgorithm)
+	}
+}
+
+func TestGeneratePKCS12WithEncryptedKey(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+	t.Setenv("CERTY_KEY_PASSPHRASE", "leaf-secret")
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Generate certificate with an encrypted private key
+	cfg, _ := loadConfig()
+	certPath, keyPath, err := generateCertificate(
+		[]string{"example.com"},
+		CertTypeTLS,
+		CertOptions{EncryptKey: true},
+		cfg,
+	)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+
+	// Verify the key is stored encrypted
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	if block, _ := pem.Decode(keyData); block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		t.Fatal("Expected ENCRYPTED PRIVATE KEY block")
+	}
+
+	// PKCS#12 export decrypts the key with the same passphrase
+	p12Path := filepath.Join(tmpDir, "test-encrypted.p12")
+	if err := generatePKCS12(certPath, keyPath, p12Path, ""); err != nil {
+		t.Fatalf("Failed to generate PKCS#12: %v", err)
+	}
+}
+
 func TestPKCS12FilePermissions(t *testing.T) {
 	// Create temp directory
 	tmpDir := t.TempDir()
@@ -169,9 +262,7 @@ func TestPKCS12FilePermissions(t *testing.T) {
 	certPath, keyPath, err := generateCertificate(
 		[]string{"example.com"},
 		CertTypeTLS,
-		false,
-		"",
-		"",
+		CertOptions{},
 		cfg,
 	)
 	if err != nil {
@@ -215,7 +306,7 @@ func TestGeneratePKCS12WithPassword(t *testing.T) {
 
 	// Generate certificate
 	inputs := []string{"test.example.com"}
-	certPath, keyPath, err := generateCertificate(inputs, CertTypeTLS, false, "", "", cfg)
+	certPath, keyPath, err := generateCertificate(inputs, CertTypeTLS, CertOptions{}, cfg)
 	if err != nil {
 		t.Fatalf("Failed to generate certificate: %v", err)
 	}
@@ -288,7 +379,7 @@ func TestGeneratePKCS12WithEmptyPassword(t *testing.T) {
 
 	// Generate certificate
 	inputs := []string{"test.example.com"}
-	certPath, keyPath, err := generateCertificate(inputs, CertTypeTLS, false, "", "", cfg)
+	certPath, keyPath, err := generateCertificate(inputs, CertTypeTLS, CertOptions{}, cfg)
 	if err != nil {
 		t.Fatalf("Failed to generate certificate: %v", err)
 	}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDecryptPrivateKeyPEM(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			keySize := 2048
+			if keyType == "ecdsa" {
+				keySize = 256
+			}
+			key, err := generatePrivateKey(keyType, keySize)
+			if err != nil {
+				t.Fatalf("Failed to generate key: %v", err)
+			}
+
+			block, err := encryptPrivateKeyPEM(key, []byte("correct horse"))
+			if err != nil {
+				t.Fatalf("Failed to encrypt key: %v", err)
+			}
+			if block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Errorf("Expected ENCRYPTED PRIVATE KEY, got %s", block.Type)
+			}
+
+			decrypted, err := decryptPrivateKeyPEM(block, []byte("correct horse"))
+			if err != nil {
+				t.Fatalf("Failed to decrypt key: %v", err)
+			}
+			if !decrypted.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Error("Decrypted key does not match original")
+			}
+
+			if _, err := decryptPrivateKeyPEM(block, []byte("wrong")); err == nil {
+				t.Error("Expected error when decrypting with wrong passphrase")
+			}
+		})
+	}
+}
+
+func TestEncryptPrivateKeyPEMEmptyPassphrase(t *testing.T) {
+	key, err := generatePrivateKey("ed25519", 0)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if _, err := encryptPrivateKeyPEM(key, nil); err == nil {
+		t.Error("Expected error for empty passphrase")
+	}
+}
+
+func TestDeriveKeyParameterLimits(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	tests := []struct {
+		name      string
+		algorithm asn1.ObjectIdentifier
+		params    interface{}
+		wantErr   bool
+	}{
+		{"pbkdf2 default", oidPBKDF2, pbkdf2Params{Salt: salt, IterationCount: 1000}, false},
+		{"pbkdf2 zero iterations", oidPBKDF2, pbkdf2Params{Salt: salt, IterationCount: 0}, true},
+		{"pbkdf2 too many iterations", oidPBKDF2, pbkdf2Params{Salt: salt, IterationCount: maxPBKDF2Iterations + 1}, true},
+		{"scrypt openssl default", oidScrypt, scryptParams{Salt: salt, CostParameter: 16384, BlockSize: 8, ParallelizationParameter: 1}, false},
+		{"scrypt too much memory", oidScrypt, scryptParams{Salt: salt, CostParameter: 1 << 20, BlockSize: 8, ParallelizationParameter: 1}, true},
+		{"scrypt huge block size", oidScrypt, scryptParams{Salt: salt, CostParameter: 16384, BlockSize: 1 << 30, ParallelizationParameter: 1}, true},
+		{"scrypt too parallel", oidScrypt, scryptParams{Salt: salt, CostParameter: 16384, BlockSize: 8, ParallelizationParameter: maxScryptParallelization + 1}, true},
+		{"scrypt zero block size", oidScrypt, scryptParams{Salt: salt, CostParameter: 16384, BlockSize: 0, ParallelizationParameter: 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			der, err := asn1.Marshal(tt.params)
+			if err != nil {
+				t.Fatalf("Failed to encode parameters: %v", err)
+			}
+			kdf := pkix.AlgorithmIdentifier{Algorithm: tt.algorithm, Parameters: asn1.RawValue{FullBytes: der}}
+			_, err = deriveKey(kdf, []byte("correct horse"), 32)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deriveKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptedPrivateKeyOpenSSLCompatibility(t *testing.T) {
+	// Skip if openssl is not available
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not found in PATH")
+	}
+
+	tmpDir := t.TempDir()
+
+	t.Run("openssl reads certy keys", func(t *testing.T) {
+		key, err := generatePrivateKey("ecdsa", 384)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		block, err := encryptPrivateKeyPEM(key, []byte("secret"))
+		if err != nil {
+			t.Fatalf("Failed to encrypt key: %v", err)
+		}
+		keyPath := filepath.Join(tmpDir, "certy-encrypted.pem")
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+
+		cmd := exec.Command("openssl", "pkey", "-in", keyPath, "-passin", "pass:secret", "-noout")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("OpenSSL failed to decrypt key: %v\nOutput: %s", err, output)
+		}
+	})
+
+	for _, kdf := range [][]string{{"-v2", "aes-256-cbc"}, {"-v2", "aes-128-cbc", "-scrypt"}} {
+		t.Run("certy reads openssl "+kdf[len(kdf)-1], func(t *testing.T) {
+			plainPath := filepath.Join(tmpDir, "plain.pem")
+			encPath := filepath.Join(tmpDir, "openssl-encrypted.pem")
+
+			key, _ := generatePrivateKey("rsa", 2048)
+			block, _ := marshalPrivateKeyPEM(key)
+			if err := os.WriteFile(plainPath, pem.EncodeToMemory(block), 0600); err != nil {
+				t.Fatalf("Failed to write key: %v", err)
+			}
+
+			args := append([]string{"pkcs8", "-topk8", "-in", plainPath, "-out", encPath, "-passout", "pass:secret"}, kdf...)
+			if output, err := exec.Command("openssl", args...).CombinedOutput(); err != nil {
+				t.Skipf("OpenSSL does not support %v: %s", kdf, output)
+			}
+
+			data, err := os.ReadFile(encPath)
+			if err != nil {
+				t.Fatalf("Failed to read key: %v", err)
+			}
+			encBlock, _ := pem.Decode(data)
+			decrypted, err := decryptPrivateKeyPEM(encBlock, []byte("secret"))
+			if err != nil {
+				t.Fatalf("Failed to decrypt OpenSSL key: %v", err)
+			}
+			if !decrypted.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Error("Decrypted key does not match original")
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Object identifiers of the certificate policies extension (RFC 5280 section 4.2.1.4)
+var (
+	oidExtensionCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidPolicyQualifierCPS           = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+	oidPolicyQualifierUserNotice    = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 2}
+)
+
+// maxUserNoticeLength is the longest explicit text RFC 5280 allows in a user notice
+const maxUserNoticeLength = 200
+
+// policyInformation is the ASN.1 PolicyInformation structure
+type policyInformation struct {
+	Policy     asn1.ObjectIdentifier
+	Qualifiers []policyQualifierInfo `asn1:"optional,omitempty"`
+}
+
+// policyQualifierInfo is the ASN.1 PolicyQualifierInfo structure
+type policyQualifierInfo struct {
+	PolicyQualifierID asn1.ObjectIdentifier
+	Qualifier         asn1.RawValue
+}
+
+// userNotice is the ASN.1 UserNotice structure, with explicit text only
+type userNotice struct {
+	ExplicitText string `asn1:"utf8"`
+}
+
+// validatePolicies checks a list of certificate policies configured in field
+func validatePolicies(field string, policies []PolicyConfig) error {
+	seen := map[string]bool{}
+	for _, p := range policies {
+		if _, err := parseOID(p.OID); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		if seen[p.OID] {
+			return fmt.Errorf("%s: duplicate policy %s", field, p.OID)
+		}
+		seen[p.OID] = true
+
+		for _, cps := range p.CPS {
+			u, err := url.Parse(cps)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s: policy %s: cps must be an http or https URL, got '%s'", field, p.OID, cps)
+			}
+		}
+		if utf8.RuneCountInString(p.UserNotice) > maxUserNoticeLength {
+			return fmt.Errorf("%s: policy %s: user_notice cannot exceed %d characters", field, p.OID, maxUserNoticeLength)
+		}
+	}
+	return nil
+}
+
+// parseOID parses a dotted object identifier such as 1.3.6.1.4.1.99999.1
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (part != "0" && strings.HasPrefix(part, "0")) {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = n
+	}
+	if oid[0] > 2 || (oid[0] < 2 && oid[1] > 39) {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+// addPolicies writes the certificate policies, with their CPS and user notice
+// qualifiers, to a template as a non-critical extension. Nothing is written
+// if no policies are given.
+func addPolicies(template *x509.Certificate, policies []PolicyConfig) error {
+	if len(policies) == 0 {
+		return nil
+	}
+
+	var infos []policyInformation
+	for _, p := range policies {
+		oid, err := parseOID(p.OID)
+		if err != nil {
+			return err
+		}
+		info := policyInformation{Policy: oid}
+
+		// Add the qualifiers
+		for _, cps := range p.CPS {
+			value, err := asn1.MarshalWithParams(cps, "ia5")
+			if err != nil {
+				return fmt.Errorf("failed to encode CPS URI: %w", err)
+			}
+			info.Qualifiers = append(info.Qualifiers, policyQualifierInfo{oidPolicyQualifierCPS, asn1.RawValue{FullBytes: value}})
+		}
+		if p.UserNotice != "" {
+			value, err := asn1.Marshal(userNotice{p.UserNotice})
+			if err != nil {
+				return fmt.Errorf("failed to encode user notice: %w", err)
+			}
+			info.Qualifiers = append(info.Qualifiers, policyQualifierInfo{oidPolicyQualifierUserNotice, asn1.RawValue{FullBytes: value}})
+		}
+		infos = append(infos, info)
+	}
+
+	value, err := asn1.Marshal(infos)
+	if err != nil {
+		return fmt.Errorf("failed to encode certificate policies: %w", err)
+	}
+	template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidExtensionCertificatePolicies, Value: value})
+	return nil
+}
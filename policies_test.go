@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCertificatePolicies(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure a test policy with both qualifiers
+	cfg := DefaultConfig()
+	cfg.CertificatePolicies = []PolicyConfig{{
+		OID:        "1.3.6.1.4.1.99999.1",
+		CPS:        []string{"https://pki.example.com/cps"},
+		UserNotice: "Test certificate, not for production",
+	}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA and issue a certificate
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	leaf := issueTestLeaf(t, tmpDir, "leaf", cfg)
+
+	want := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	for _, cert := range []*x509.Certificate{intCert, leaf} {
+		if len(cert.PolicyIdentifiers) != 1 || !cert.PolicyIdentifiers[0].Equal(want) {
+			t.Errorf("Expected policy %v on %s, got %v", want, cert.Subject.CommonName, cert.PolicyIdentifiers)
+		}
+
+		// Check the qualifiers
+		var infos []policyInformation
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidExtensionCertificatePolicies) {
+				if _, err := asn1.Unmarshal(ext.Value, &infos); err != nil {
+					t.Fatalf("Failed to parse certificate policies: %v", err)
+				}
+			}
+		}
+		if len(infos) != 1 || len(infos[0].Qualifiers) != 2 {
+			t.Fatalf("Expected one policy with 2 qualifiers on %s, got %+v", cert.Subject.CommonName, infos)
+		}
+		var cps string
+		if _, err := asn1.Unmarshal(infos[0].Qualifiers[0].Qualifier.FullBytes, &cps); err != nil || cps != "https://pki.example.com/cps" {
+			t.Errorf("Expected CPS qualifier, got %q (%v)", cps, err)
+		}
+		var notice userNotice
+		if _, err := asn1.Unmarshal(infos[0].Qualifiers[1].Qualifier.FullBytes, &notice); err != nil || notice.ExplicitText != "Test certificate, not for production" {
+			t.Errorf("Expected user notice qualifier, got %q (%v)", notice.ExplicitText, err)
+		}
+	}
+
+	// Certificates from a CSR carry the policies too
+	csrPath := filepath.Join(tmpDir, "csr.pem")
+	writeTestCSR(t, csrPath, &x509.CertificateRequest{DNSNames: []string{"csr.example.com"}})
+	certPath, err := generateFromCSR(csrPath, CertOptions{CertFile: filepath.Join(tmpDir, "csr-cert.pem")}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to sign CSR: %v", err)
+	}
+	if csrCert := loadCertFromFile(t, certPath); len(csrCert.PolicyIdentifiers) != 1 {
+		t.Errorf("Expected policy on the certificate from the CSR, got %v", csrCert.PolicyIdentifiers)
+	}
+}
+
+func TestValidatePolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []PolicyConfig
+		wantErr  string
+	}{
+		{"none", nil, ""},
+		{"oid only", []PolicyConfig{{OID: "2.23.140.1.2.1"}}, ""},
+		{"qualifiers", []PolicyConfig{{OID: "1.3.6.1.4.1.99999.1", CPS: []string{"http://pki.example.com/cps"}, UserNotice: "Test only"}}, ""},
+		{"invalid oid", []PolicyConfig{{OID: "1.3.x"}}, "invalid OID"},
+		{"single arc", []PolicyConfig{{OID: "1"}}, "invalid OID"},
+		{"leading zero", []PolicyConfig{{OID: "1.03.6"}}, "invalid OID"},
+		{"duplicate", []PolicyConfig{{OID: "1.2.3"}, {OID: "1.2.3"}}, "duplicate"},
+		{"cps not a URL", []PolicyConfig{{OID: "1.2.3", CPS: []string{"pki.example.com/cps"}}}, "cps"},
+		{"long notice", []PolicyConfig{{OID: "1.2.3", UserNotice: strings.Repeat("x", 201)}}, "user_notice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.CertificatePolicies = tt.policies
+			err := validateConfig(cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// keyUsageNames maps the key_usage names of profiles to key usages
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+	"encipher_only":      x509.KeyUsageEncipherOnly,
+	"decipher_only":      x509.KeyUsageDecipherOnly,
+}
+
+// extKeyUsageNames maps the ext_key_usage names of profiles to extended key usages
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// managedExtensions lists the extensions certy sets itself, which custom
+// profile extensions may not replace
+var managedExtensions = map[string]string{
+	"2.5.29.14":         "subject key identifier",
+	"2.5.29.15":         "key usage (use key_usage)",
+	"2.5.29.17":         "subject alternative name",
+	"2.5.29.19":         "basic constraints",
+	"2.5.29.30":         "name constraints",
+	"2.5.29.31":         "CRL distribution points (use crl_url)",
+	"2.5.29.32":         "certificate policies (use certificate_policies)",
+	"2.5.29.35":         "authority key identifier",
+	"2.5.29.37":         "extended key usage (use ext_key_usage)",
+	"1.3.6.1.5.5.7.1.1": "authority information access (use ocsp_url and ca_issuers_url)",
+}
+
+// validateProfiles checks the issuance profiles
+func validateProfiles(cfg *Config) error {
+	names := map[string]bool{}
+	for i, p := range cfg.Profiles {
+		section := fmt.Sprintf("profiles[%d]", i)
+		if err := validateCAName(p.Name); err != nil {
+			return fmt.Errorf("%s: %w", section, err)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("%s: duplicate profile name '%s'", section, p.Name)
+		}
+		names[p.Name] = true
+
+		for _, usage := range p.KeyUsage {
+			if _, ok := keyUsageNames[usage]; !ok {
+				return fmt.Errorf("%s.key_usage: unknown usage '%s'", section, usage)
+			}
+		}
+		for _, usage := range p.ExtKeyUsage {
+			if _, ok := extKeyUsageNames[usage]; !ok {
+				return fmt.Errorf("%s.ext_key_usage: unknown usage '%s'", section, usage)
+			}
+		}
+
+		if p.ValidityDays != 0 && (p.ValidityDays < 1 || p.ValidityDays > 825) {
+			return fmt.Errorf("%s.validity_days must be between 1 and 825, got %d", section, p.ValidityDays)
+		}
+		if p.Validity != "" {
+			if p.ValidityDays != 0 {
+				return fmt.Errorf("%s: validity and validity_days cannot be used together", section)
+			}
+			if _, err := parseValidity(p.Validity); err != nil {
+				return fmt.Errorf("%s.validity: %w", section, err)
+			}
+		}
+		if p.KeyType != "" {
+			if _, _, err := resolveKeySpec(p.KeyType, cfg); err != nil {
+				return fmt.Errorf("%s.key_type: %w", section, err)
+			}
+		}
+		if err := validateSubject(section+".subject", p.Subject, false); err != nil {
+			return err
+		}
+		for _, pattern := range p.AllowedSANs {
+			if strings.TrimSpace(pattern) == "" {
+				return fmt.Errorf("%s.allowed_sans: empty pattern", section)
+			}
+		}
+		if p.Issuer != "" && p.Issuer != defaultIssuerName {
+			if _, err := findIssuerConfig(cfg, p.Issuer); err != nil {
+				return fmt.Errorf("%s.issuer: %w", section, err)
+			}
+		}
+		if err := validatePolicies(section+".certificate_policies", p.CertificatePolicies); err != nil {
+			return err
+		}
+
+		// X.509-SVIDs must be usable for signatures and carry only the SPIFFE ID
+		if p.SPIFFE {
+			if len(cfg.SPIFFETrustDomains) == 0 {
+				return fmt.Errorf("%s.spiffe requires spiffe_trust_domains", section)
+			}
+			if len(p.KeyUsage) > 0 && !slices.Contains(p.KeyUsage, "digital_signature") {
+				return fmt.Errorf("%s.key_usage must include digital_signature for spiffe", section)
+			}
+			if p.Subject.CommonName != "" {
+				return fmt.Errorf("%s.subject.common_name cannot be used with spiffe", section)
+			}
+		}
+
+		// Validate the custom extensions
+		for _, ext := range p.Extensions {
+			if _, err := parseOID(ext.OID); err != nil {
+				return fmt.Errorf("%s.extensions: %w", section, err)
+			}
+			if name, ok := managedExtensions[ext.OID]; ok {
+				return fmt.Errorf("%s.extensions: %s is set by certy: %s", section, ext.OID, name)
+			}
+			if _, err := decodeExtensionValue(ext.Value); err != nil {
+				return fmt.Errorf("%s.extensions: %s: %w", section, ext.OID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// findProfile returns the configured profile with the given name, or the
+// built-in spiffe profile. Empty key usages default to those of the
+// certificate type the profile issues, or to server and client
+// authentication for X.509-SVIDs.
+func findProfile(cfg *Config, name string) (ProfileConfig, error) {
+	profile := ProfileConfig{Name: name, SPIFFE: true}
+	if i := slices.IndexFunc(cfg.Profiles, func(p ProfileConfig) bool { return p.Name == name }); i >= 0 {
+		profile = cfg.Profiles[i]
+	} else if name != spiffeProfileName {
+		return ProfileConfig{}, fmt.Errorf("profile %s is not defined in profiles", name)
+	}
+
+	if profile.SPIFFE {
+		profile.OmitCommonName = true
+		if len(profile.ExtKeyUsage) == 0 {
+			profile.ExtKeyUsage = []string{"server_auth", "client_auth"}
+		}
+	}
+	builtin := certTypeProfile(profile.certType())
+	if len(profile.KeyUsage) == 0 {
+		profile.KeyUsage = builtin.KeyUsage
+	}
+	if len(profile.ExtKeyUsage) == 0 {
+		profile.ExtKeyUsage = builtin.ExtKeyUsage
+	}
+	return profile, nil
+}
+
+// certTypeProfile returns the built-in profile of a certificate type
+func certTypeProfile(certType CertificateType) ProfileConfig {
+	switch certType {
+	case CertTypeClient:
+		return ProfileConfig{KeyUsage: []string{"digital_signature"}, ExtKeyUsage: []string{"client_auth"}}
+	case CertTypeSMIME:
+		return ProfileConfig{KeyUsage: []string{"digital_signature", "key_encipherment"}, ExtKeyUsage: []string{"email_protection"}}
+	default:
+		return ProfileConfig{KeyUsage: []string{"digital_signature", "key_encipherment"}, ExtKeyUsage: []string{"server_auth"}}
+	}
+}
+
+// certType returns the certificate type a profile issues, which routes it to
+// an issuer and picks the common name. Profiles with server_auth count as
+// TLS, then client_auth as client and email_protection as S/MIME.
+func (p ProfileConfig) certType() CertificateType {
+	switch {
+	case slices.Contains(p.ExtKeyUsage, "server_auth"):
+		return CertTypeTLS
+	case slices.Contains(p.ExtKeyUsage, "client_auth"):
+		return CertTypeClient
+	case slices.Contains(p.ExtKeyUsage, "email_protection"):
+		return CertTypeSMIME
+	default:
+		return CertTypeTLS
+	}
+}
+
+// keyUsage returns the key usages of the profile
+func (p ProfileConfig) keyUsage() x509.KeyUsage {
+	var usage x509.KeyUsage
+	for _, name := range p.KeyUsage {
+		usage |= keyUsageNames[name]
+	}
+	return usage
+}
+
+// leafKeyUsage drops key encipherment from usage unless publicKey is an RSA
+// key. Only RSA keys encipher session keys, and RFC 8410 forbids the usage
+// for Ed25519.
+func leafKeyUsage(usage x509.KeyUsage, publicKey crypto.PublicKey) x509.KeyUsage {
+	if _, ok := publicKey.(*rsa.PublicKey); !ok {
+		usage &^= x509.KeyUsageKeyEncipherment
+	}
+	return usage
+}
+
+// extKeyUsage returns the extended key usages of the profile
+func (p ProfileConfig) extKeyUsage() []x509.ExtKeyUsage {
+	var usages []x509.ExtKeyUsage
+	for _, name := range p.ExtKeyUsage {
+		usages = append(usages, extKeyUsageNames[name])
+	}
+	return usages
+}
+
+// notAfter returns the end of a certificate of the profile starting at
+// start, from validity, validity_days or default_validity_days
+func (p ProfileConfig) notAfter(start time.Time, cfg *Config) (time.Time, error) {
+	if p.Validity != "" {
+		validity, err := parseValidity(p.Validity)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		return start.Add(validity), nil
+	}
+	if p.ValidityDays == 0 {
+		return start.AddDate(0, 0, cfg.DefaultValidityDays), nil
+	}
+	return start.AddDate(0, 0, p.ValidityDays), nil
+}
+
+// policies returns the certificate policies of the profile, defaulting to
+// the top-level certificate_policies
+func (p ProfileConfig) policies(cfg *Config) []PolicyConfig {
+	if len(p.CertificatePolicies) > 0 {
+		return p.CertificatePolicies
+	}
+	return cfg.CertificatePolicies
+}
+
+// applySubjectDefaults fills the attributes missing from name with those of
+// the profile subject
+func (p ProfileConfig) applySubjectDefaults(name *pkix.Name) {
+	if name.CommonName == "" {
+		name.CommonName = p.Subject.CommonName
+	}
+	p.Subject.applyTo(name, false)
+}
+
+// checkAllowedSANs refuses a template with a SAN matching none of the
+// allowed_sans patterns of the profile. Profiles without patterns allow any SAN.
+func (p ProfileConfig) checkAllowedSANs(template *x509.Certificate) error {
+	if len(p.AllowedSANs) == 0 {
+		return nil
+	}
+
+	var names []string
+	names = append(names, template.DNSNames...)
+	names = append(names, template.EmailAddresses...)
+	for _, uri := range template.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(p.AllowedSANs, func(pattern string) bool { return matchSANPattern(pattern, name) }) {
+			return fmt.Errorf("profile %s does not allow %s", p.Name, name)
+		}
+	}
+	ips := template.IPAddresses
+
+	// Clients that still match host names against the common name would
+	// accept a CN shaped like a host name or IP address, e.g. one taken
+	// from a CSR, so it must be allowed as well
+	if cn := template.Subject.CommonName; cn != "" {
+		if ip := net.ParseIP(cn); ip != nil {
+			ips = append(slices.Clip(ips), ip)
+		} else if isHostnameLike(cn) && !slices.ContainsFunc(p.AllowedSANs, func(pattern string) bool { return matchSANPattern(pattern, cn) }) {
+			return fmt.Errorf("profile %s does not allow common name %s", p.Name, cn)
+		}
+	}
+
+	for _, ip := range ips {
+		if !slices.ContainsFunc(p.AllowedSANs, func(pattern string) bool { return matchIPPattern(pattern, ip) }) {
+			return fmt.Errorf("profile %s does not allow %s", p.Name, ip)
+		}
+	}
+	return nil
+}
+
+// isHostnameLike reports whether s looks like a DNS name: dot-separated
+// labels of letters, digits, '-', '_' and '*'
+func isHostnameLike(s string) bool {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || strings.TrimLeft(label, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_*") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSANPattern reports whether a name matches a pattern, where '*'
+// matches any run of characters. Matching is case-insensitive.
+func matchSANPattern(pattern, name string) bool {
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(pattern)), `\*`, ".*") + "$"
+	matched, err := regexp.MatchString(expr, strings.ToLower(name))
+	return err == nil && matched
+}
+
+// matchIPPattern reports whether an IP address is in a CIDR pattern or
+// matches a '*' pattern
+func matchIPPattern(pattern string, ip net.IP) bool {
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		return ipNet.Contains(ip)
+	}
+	return matchSANPattern(pattern, ip.String())
+}
+
+// addExtensions writes the custom extensions of the profile to a template
+func (p ProfileConfig) addExtensions(template *x509.Certificate) error {
+	for _, ext := range p.Extensions {
+		oid, err := parseOID(ext.OID)
+		if err != nil {
+			return err
+		}
+		value, err := decodeExtensionValue(ext.Value)
+		if err != nil {
+			return fmt.Errorf("extension %s: %w", ext.OID, err)
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oid, Critical: ext.Critical, Value: value})
+	}
+	return nil
+}
+
+// decodeExtensionValue decodes a hex-encoded DER extension value
+func decodeExtensionValue(s string) ([]byte, error) {
+	value, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("value must be hex-encoded DER")
+	}
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(value, &raw); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("value is not a single DER element")
+	}
+	return value, nil
+}
+
+// checkPublicKey refuses a requested public key that does not match the key
+// type of the profile
+func (p ProfileConfig) checkPublicKey(publicKey crypto.PublicKey, cfg *Config) error {
+	if p.KeyType == "" {
+		return nil
+	}
+	wantType, wantSize, err := resolveKeySpec(p.KeyType, cfg)
+	if err != nil {
+		return err
+	}
+
+	var keyType string
+	var keySize int
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		keyType, keySize = "rsa", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		keyType, keySize = "ecdsa", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		keyType = "ed25519"
+	default:
+		keyType = fmt.Sprintf("%T", publicKey)
+	}
+	if keyType != wantType || keySize != wantSize {
+		return fmt.Errorf("profile %s requires a %s key", p.Name, p.KeyType)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProfiles returns the profiles used by the profile tests
+func testProfiles() []ProfileConfig {
+	return []ProfileConfig{
+		{
+			Name:         "grpc-both",
+			ExtKeyUsage:  []string{"server_auth", "client_auth"},
+			ValidityDays: 30,
+			KeyType:      "p256",
+			Subject:      SubjectConfig{Organization: "Acme Corp", Country: "US"},
+			AllowedSANs:  []string{"*.internal.example.com", "10.0.0.0/8"},
+			CRLURL:       "http://crl.example.com/grpc.crl",
+			Extensions:   []ExtensionConfig{{OID: "1.3.6.1.4.1.99999.2", Value: "0c0474657374"}},
+		},
+		{
+			Name:        "smime-sign-only",
+			KeyUsage:    []string{"digital_signature"},
+			ExtKeyUsage: []string{"email_protection"},
+		},
+		{
+			Name:        "mtls-peer",
+			ExtKeyUsage: []string{"client_auth"},
+		},
+		{
+			Name:    "rsa-only",
+			KeyType: "rsa2048",
+		},
+	}
+}
+
+func TestIssueWithProfile(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure the profiles and a client issuer
+	cfg := DefaultConfig()
+	cfg.Profiles = testProfiles()
+	cfg.CA.Issuers = []IssuerConfig{{Name: "clients", Purposes: []string{"client"}}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Issue with the grpc-both profile
+	certPath := filepath.Join(tmpDir, "grpc.pem")
+	opts := CertOptions{CertFile: certPath, KeyFile: filepath.Join(tmpDir, "grpc-key.pem"), Profile: "grpc-both"}
+	if _, _, err := generateCertificate([]string{"api.internal.example.com", "10.1.2.3"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	cert := loadCertFromFile(t, certPath)
+
+	if !slices.Equal(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("Expected server and client auth, got %v", cert.ExtKeyUsage)
+	}
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("Expected the default TLS key usage without key encipherment for an ECDSA key, got %v", cert.KeyUsage)
+	}
+	if days := cert.NotAfter.Sub(time.Now()).Hours() / 24; days < 29 || days > 31 {
+		t.Errorf("Expected 30 days validity, got %.0f", days)
+	}
+	if key, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok || key.Curve.Params().BitSize != 256 {
+		t.Errorf("Expected a P-256 key, got %T", cert.PublicKey)
+	}
+	if cert.Subject.CommonName != "api.internal.example.com" || !slices.Equal(cert.Subject.Organization, []string{"Acme Corp"}) {
+		t.Errorf("Expected the profile subject defaults, got %q", cert.Subject.String())
+	}
+	if !slices.Equal(cert.CRLDistributionPoints, []string{"http://crl.example.com/grpc.crl"}) {
+		t.Errorf("Expected the profile CRL URL, got %v", cert.CRLDistributionPoints)
+	}
+	found := false
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}) {
+			found = true
+			var value string
+			if _, err := asn1.Unmarshal(ext.Value, &value); err != nil || value != "test" {
+				t.Errorf("Expected custom extension value \"test\", got %q (%v)", value, err)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected the custom profile extension")
+	}
+
+	// Names outside allowed_sans are refused before a serial is used
+	serialBefore, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to read serial: %v", err)
+	}
+	for _, inputs := range [][]string{{"www.example.com"}, {"api.internal.example.com", "192.168.1.1"}} {
+		opts := CertOptions{CertFile: filepath.Join(tmpDir, "bad.pem"), KeyFile: filepath.Join(tmpDir, "bad-key.pem"), Profile: "grpc-both"}
+		if _, _, err := generateCertificate(inputs, CertTypeTLS, opts, cfg); err == nil || !strings.Contains(err.Error(), "does not allow") {
+			t.Errorf("Expected %v to be refused, got %v", inputs, err)
+		}
+	}
+	serialAfter, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to read serial: %v", err)
+	}
+	if serialAfter != serialBefore+1 {
+		t.Errorf("Expected refused requests not to use serials, got %d after %d", serialAfter, serialBefore)
+	}
+
+	// A sign-only S/MIME profile
+	smimePath := filepath.Join(tmpDir, "smime.pem")
+	opts = CertOptions{CertFile: smimePath, KeyFile: filepath.Join(tmpDir, "smime-key.pem"), Profile: "smime-sign-only"}
+	if _, _, err := generateCertificate([]string{"user@example.com"}, CertTypeSMIME, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	smimeCert := loadCertFromFile(t, smimePath)
+	if smimeCert.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("Expected digital signature only, got %v", smimeCert.KeyUsage)
+	}
+
+	// Client profiles are routed to the client issuer
+	mtlsPath := filepath.Join(tmpDir, "mtls.pem")
+	opts = CertOptions{CertFile: mtlsPath, KeyFile: filepath.Join(tmpDir, "mtls-key.pem"), Profile: "mtls-peer"}
+	if _, _, err := generateCertificate([]string{"peer.example.com"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	clientIssuer, err := loadCACertificate("intermediateCA-clients")
+	if err != nil {
+		t.Fatalf("Failed to load client issuer: %v", err)
+	}
+	if err := loadCertFromFile(t, mtlsPath).CheckSignatureFrom(clientIssuer); err != nil {
+		t.Errorf("Expected the mtls-peer certificate from the client issuer: %v", err)
+	}
+
+	// Unknown profiles are refused
+	opts = CertOptions{CertFile: filepath.Join(tmpDir, "x.pem"), KeyFile: filepath.Join(tmpDir, "x-key.pem"), Profile: "missing"}
+	if _, _, err := generateCertificate([]string{"x.example.com"}, CertTypeTLS, opts, cfg); err == nil {
+		t.Error("Expected error for an unknown profile")
+	}
+}
+
+func TestSignCSRWithProfile(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure the profiles
+	cfg := DefaultConfig()
+	cfg.Profiles = testProfiles()
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Sign a P-256 CSR with the grpc-both profile
+	csrPath := filepath.Join(tmpDir, "grpc.csr")
+	writeTestCSR(t, csrPath, &x509.CertificateRequest{DNSNames: []string{"api.internal.example.com"}})
+	certPath, err := generateFromCSR(csrPath, CertOptions{CertFile: filepath.Join(tmpDir, "grpc.pem"), Profile: "grpc-both"}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to sign CSR: %v", err)
+	}
+	cert := loadCertFromFile(t, certPath)
+	if !slices.Equal(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("Expected server and client auth, got %v", cert.ExtKeyUsage)
+	}
+	if !slices.Equal(cert.Subject.Country, []string{"US"}) {
+		t.Errorf("Expected the profile country, got %q", cert.Subject.String())
+	}
+	if days := cert.NotAfter.Sub(time.Now()).Hours() / 24; days < 29 || days > 31 {
+		t.Errorf("Expected 30 days validity, got %.0f", days)
+	}
+
+	// The CSR key must match the profile key type
+	if _, err := generateFromCSR(csrPath, CertOptions{CertFile: filepath.Join(tmpDir, "rsa.pem"), Profile: "rsa-only"}, cfg); err == nil || !strings.Contains(err.Error(), "requires a rsa2048 key") {
+		t.Errorf("Expected error for a key not matching the profile, got %v", err)
+	}
+
+	// And its names must be allowed
+	badCSR := filepath.Join(tmpDir, "bad.csr")
+	writeTestCSR(t, badCSR, &x509.CertificateRequest{DNSNames: []string{"www.example.com"}})
+	if _, err := generateFromCSR(badCSR, CertOptions{CertFile: filepath.Join(tmpDir, "bad.pem"), Profile: "grpc-both"}, cfg); err == nil {
+		t.Error("Expected error for a CSR name outside allowed_sans")
+	}
+
+	// So must a common name shaped like a host name or IP address
+	tests := []struct {
+		name    string
+		cn      string
+		wantErr bool
+	}{
+		{"host name outside allowed_sans", "www.example.com", true},
+		{"IP outside allowed_sans", "192.168.1.1", true},
+		{"allowed host name", "web.internal.example.com", false},
+		{"allowed IP", "10.9.8.7", false},
+		{"not a host name", "API Service", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csrPath := filepath.Join(tmpDir, "cn.csr")
+			writeTestCSR(t, csrPath, &x509.CertificateRequest{Subject: pkix.Name{CommonName: tt.cn}, DNSNames: []string{"api.internal.example.com"}})
+			_, err := generateFromCSR(csrPath, CertOptions{CertFile: filepath.Join(tmpDir, "cn.pem"), Profile: "grpc-both"}, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("generateFromCSR() with CN %q error = %v, wantErr %v", tt.cn, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile ProfileConfig
+		wantErr string
+	}{
+		{"minimal", ProfileConfig{Name: "web-server"}, ""},
+		{"full", testProfiles()[0], ""},
+		{"invalid name", ProfileConfig{Name: "web server"}, "invalid"},
+		{"unknown key usage", ProfileConfig{Name: "p", KeyUsage: []string{"cert_sign"}}, "key_usage"},
+		{"unknown extended key usage", ProfileConfig{Name: "p", ExtKeyUsage: []string{"any"}}, "ext_key_usage"},
+		{"long validity", ProfileConfig{Name: "p", ValidityDays: 900}, "validity_days"},
+		{"bad key type", ProfileConfig{Name: "p", KeyType: "dsa"}, "key_type"},
+		{"bad country", ProfileConfig{Name: "p", Subject: SubjectConfig{Country: "usa"}}, "country"},
+		{"unknown issuer", ProfileConfig{Name: "p", Issuer: "missing"}, "issuer"},
+		{"managed extension", ProfileConfig{Name: "p", Extensions: []ExtensionConfig{{OID: "2.5.29.19", Value: "3000"}}}, "set by certy"},
+		{"bad extension value", ProfileConfig{Name: "p", Extensions: []ExtensionConfig{{OID: "1.2.3", Value: "zz"}}}, "hex"},
+		{"trailing extension data", ProfileConfig{Name: "p", Extensions: []ExtensionConfig{{OID: "1.2.3", Value: "05000500"}}}, "single DER element"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Profiles = []ProfileConfig{tt.profile}
+			err := validateConfig(cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Profile names must be unique
+	cfg := DefaultConfig()
+	cfg.Profiles = []ProfileConfig{{Name: "p"}, {Name: "p"}}
+	if err := validateConfig(cfg); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Expected duplicate profile error, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// reinstallCA regenerates the root and intermediate CA after backing up the
+// current CA with backupCA. If the new CA cannot be created, the backup is
+// restored. It returns the archive path relative to the certy directory.
+func reinstallCA() (string, error) {
+	archiveName, err := backupCA("reinstall")
+	if err != nil {
+		return "", err
+	}
+
+	// Generate the new CA
+	if err := installCA(); err != nil {
+		if restoreErr := restoreCA(archiveName); restoreErr != nil {
+			return "", fmt.Errorf("%w (restoring the previous CA from %s also failed: %v)", err, archiveName, restoreErr)
+		}
+		return "", fmt.Errorf("%w (the previous CA was restored from %s)", err, archiveName)
+	}
+
+	return archiveName, nil
+}
+
+// backupCA snapshots the certy directory into archive/<prefix>-<timestamp>
+// and moves the CA keys into the snapshot, so a new CA can be created in
+// place. The serial state stays behind, so serials keep counting.
+func backupCA(prefix string) (string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// Write out settings derived from the current keys, such as
+	// encrypt_ca_keys for CAs that predate it, before the keys are moved
+	if err := saveConfig(cfg); err != nil {
+		return "", err
+	}
+
+	// Snapshot the current CA
+	archiveName, err := newArchiveDir(prefix)
+	if err != nil {
+		return "", err
+	}
+	if err := snapshotCADir(archiveName); err != nil {
+		return "", err
+	}
+	for _, name := range caKeyNames(cfg) {
+		has, err := backend.HasKey(name)
+		if err != nil {
+			return "", err
+		}
+		if !has {
+			continue
+		}
+		if err := backend.ArchiveKey(name, filepath.Join(archiveName, name)); err != nil {
+			return "", err
+		}
+	}
+
+	// Retire the purpose-specific issuers, the hierarchy tiers and the root
+	// rollover state, which do not apply to a new root
+	stale := []string{previousRootName + ".pem", rootCrossName + ".pem", previousRootCrossName + ".pem", "intermediateCA-cross.pem", "intermediateCA-fullchain-previous.pem"}
+	for _, ic := range cfg.CA.Issuers {
+		name := issuerBaseName(ic.Name)
+		stale = append(stale, name+".pem", name+crossSuffix+".pem", name+"-fullchain.pem", name+"-fullchain-previous.pem")
+	}
+	for _, tc := range cfg.CA.Hierarchy {
+		name := tierBaseName(tc.Name)
+		stale = append(stale, name+".pem", name+crossSuffix+".pem")
+	}
+	for _, file := range stale {
+		path, err := getCAFilePath(file)
+		if err != nil {
+			return "", err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to remove %s: %w", file, err)
+		}
+	}
+
+	return archiveName, nil
+}
+
+// restoreCA undoes backupCA after a failed replacement: keys created since
+// the backup are moved into the archive with a -discarded suffix, the
+// archived keys are moved back and the files of the snapshot are copied over
+// the certy directory. Other files created since the backup are left in
+// place.
+func restoreCA(archiveName string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Set aside keys created since the backup and move the archived keys back
+	for _, name := range caKeyNames(cfg) {
+		has, err := backend.HasKey(name)
+		if err != nil {
+			return err
+		}
+		if has {
+			if err := backend.ArchiveKey(name, filepath.Join(archiveName, name+"-discarded")); err != nil {
+				return err
+			}
+		}
+		archived := filepath.Join(archiveName, name)
+		has, err = backend.HasKey(archived)
+		if err != nil {
+			return err
+		}
+		if !has {
+			continue
+		}
+		if err := backend.ArchiveKey(archived, name); err != nil {
+			return err
+		}
+	}
+
+	// Copy the snapshot back, never overwriting a key file
+	dir, err := getCertyDir()
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(dir, archiveName)
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, rel)
+		switch {
+		case rel == ".":
+			return nil
+		case d.IsDir():
+			return os.MkdirAll(target, 0700)
+		case strings.HasSuffix(rel, "-key.pem") && caFileExists(rel):
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", rel, err)
+		}
+		return nil
+	})
+}
+
+// caKeyNames returns the names of the CA keys backupCA archives
+func caKeyNames(cfg *Config) []string {
+	names := []string{"rootCA", previousRootName, "intermediateCA"}
+	for _, ic := range cfg.CA.Issuers {
+		names = append(names, issuerBaseName(ic.Name))
+	}
+	for _, tc := range cfg.CA.Hierarchy {
+		names = append(names, tierBaseName(tc.Name))
+	}
+	return names
+}
+
+// confirmReinstall asks the user to confirm replacing the CA in dir
+func confirmReinstall(dir string) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("refusing to reinstall without confirmation; use -force to reinstall non-interactively")
+	}
+
+	fmt.Fprintf(os.Stderr, "This replaces the root and intermediate CA in %s.\n", dir)
+	fmt.Fprintf(os.Stderr, "Certificates issued by the current CA will no longer chain to the new root.\n")
+	fmt.Fprintf(os.Stderr, "A backup is saved under %s first.\n", filepath.Join(dir, archiveDirName))
+	fmt.Fprint(os.Stderr, "Type 'yes' to continue: ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return fmt.Errorf("reinstall cancelled")
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReinstallCA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA and issue a few certificates
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	cfg := DefaultConfig()
+	for i := 0; i < 3; i++ {
+		opts := CertOptions{
+			CertFile: filepath.Join(tmpDir, "leaf.pem"),
+			KeyFile:  filepath.Join(tmpDir, "leaf-key.pem"),
+		}
+		if _, _, err := generateCertificate([]string{"example.com"}, CertTypeTLS, opts, cfg); err != nil {
+			t.Fatalf("Failed to generate certificate: %v", err)
+		}
+	}
+
+	oldRoot, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	oldRootKey, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA-key.pem"))
+	oldIntKey, _ := os.ReadFile(filepath.Join(tmpDir, "intermediateCA-key.pem"))
+
+	// Reinstall
+	archiveName, err := reinstallCA()
+	if err != nil {
+		t.Fatalf("Failed to reinstall CA: %v", err)
+	}
+	if !strings.HasPrefix(archiveName, filepath.Join("archive", "reinstall-")) {
+		t.Errorf("Unexpected archive name %q", archiveName)
+	}
+
+	// The snapshot holds the previous CA
+	archiveDir := filepath.Join(tmpDir, archiveName)
+	for file, want := range map[string][]byte{
+		"rootCA.pem":             oldRoot,
+		"rootCA-key.pem":         oldRootKey,
+		"intermediateCA-key.pem": oldIntKey,
+	} {
+		got, err := os.ReadFile(filepath.Join(archiveDir, file))
+		if err != nil {
+			t.Errorf("Expected %s in snapshot: %v", file, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Snapshot of %s does not match the previous file", file)
+		}
+	}
+	for _, file := range []string{"config.yml", "serial.txt", "issued.db", "leaf.pem"} {
+		if _, err := os.Stat(filepath.Join(archiveDir, file)); err != nil {
+			t.Errorf("Expected %s in snapshot: %v", file, err)
+		}
+	}
+
+	// A new root was generated
+	newRoot, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	if bytes.Equal(newRoot, oldRoot) {
+		t.Error("Expected a new root CA")
+	}
+	if !caExists() {
+		t.Error("CA should exist after reinstall")
+	}
+
+	// Serial numbers continue after the issued ones
+	serial, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	if serial != 4 {
+		t.Errorf("Expected next serial 4 after reinstall, got %d", serial)
+	}
+
+	// A second reinstall does not snapshot earlier archives
+	second, err := reinstallCA()
+	if err != nil {
+		t.Fatalf("Failed to reinstall CA again: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, second, "archive")); !os.IsNotExist(err) {
+		t.Error("Snapshot should not include previous archives")
+	}
+}
+
+func TestReinstallCASerialFromIndex(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	certPath, keyPath, err := generateCertificate([]string{"example.com"}, CertTypeTLS, CertOptions{}, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+
+	// Simulate a lost serial counter and a revoked certificate with a higher serial
+	if err := os.WriteFile(filepath.Join(tmpDir, "serial.txt"), []byte("1"), 0644); err != nil {
+		t.Fatalf("Failed to reset serial file: %v", err)
+	}
+	if err := revokeCertificate("41", 0); err != nil {
+		t.Fatalf("Failed to revoke certificate: %v", err)
+	}
+
+	if _, err := reinstallCA(); err != nil {
+		t.Fatalf("Failed to reinstall CA: %v", err)
+	}
+
+	serial, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	if serial != 42 {
+		t.Errorf("Expected next serial 42, got %d", serial)
+	}
+}
+
+func TestRestoreCA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA with an issuer
+	cfg := DefaultConfig()
+	cfg.CA.Issuers = []IssuerConfig{{Name: "clients", Purposes: []string{"client"}}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, file := range []string{"rootCA.pem", "rootCA-key.pem", "intermediateCA-key.pem", "intermediateCA-clients.pem", "intermediateCA-clients-key.pem"} {
+		data, err := os.ReadFile(filepath.Join(tmpDir, file))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		files[file] = data
+	}
+
+	// Back up, leave a partial replacement behind and restore
+	archiveName, err := backupCA("import")
+	if err != nil {
+		t.Fatalf("Failed to back up CA: %v", err)
+	}
+	partialKey, partialRoot, err := generateRootCA(cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate root CA: %v", err)
+	}
+	if err := saveKeyAndCert(partialKey, partialRoot, "rootCA", nil); err != nil {
+		t.Fatalf("Failed to save root CA: %v", err)
+	}
+	if err := restoreCA(archiveName); err != nil {
+		t.Fatalf("Failed to restore CA: %v", err)
+	}
+
+	for file, want := range files {
+		got, err := os.ReadFile(filepath.Join(tmpDir, file))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Expected %s to be restored: %v", file, err)
+		}
+	}
+	if !caFileExists(filepath.Join(archiveName, "rootCA-discarded-key.pem")) {
+		t.Error("Expected the partial root key to be set aside in the archive")
+	}
+	if !caExists() {
+		t.Fatal("CA should exist after restore")
+	}
+	if _, _, err := generateCertificate([]string{"restored.example.com"}, CertTypeClient, CertOptions{CertFile: filepath.Join(tmpDir, "leaf.pem"), KeyFile: filepath.Join(tmpDir, "leaf-key.pem")}, cfg); err != nil {
+		t.Errorf("Failed to issue from the restored CA: %v", err)
+	}
+}
+
+func TestReinstallCAFailureRestoresCA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	oldRoot := loadCertFromFile(t, filepath.Join(tmpDir, "rootCA.pem"))
+	oldInt := loadCertFromFile(t, filepath.Join(tmpDir, "intermediateCA.pem"))
+
+	// Without a CA passphrase the new keys cannot be created
+	passphrase := os.Getenv("CERTY_CA_PASSPHRASE")
+	t.Setenv("CERTY_CA_PASSPHRASE", "")
+	if _, err := reinstallCA(); err == nil || !strings.Contains(err.Error(), "previous CA was restored") {
+		t.Fatalf("Expected the reinstall to fail and restore the CA, got %v", err)
+	}
+	t.Setenv("CERTY_CA_PASSPHRASE", passphrase)
+
+	// The old root and intermediate still sign
+	crlPath := filepath.Join(tmpDir, "root.crl")
+	if err := generateRootCRL(crlPath); err != nil {
+		t.Fatalf("Failed to generate root CRL: %v", err)
+	}
+	crl := loadCRLFromFile(t, crlPath)
+	if err := crl.CheckSignatureFrom(oldRoot); err != nil {
+		t.Errorf("Expected the root CRL signed by the old root: %v", err)
+	}
+	leaf := issueTestLeaf(t, tmpDir, "restored", DefaultConfig())
+	if err := leaf.CheckSignatureFrom(oldInt); err != nil {
+		t.Errorf("Expected the certificate signed by the old intermediate: %v", err)
+	}
+}
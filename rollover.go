@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Certificates kept in the CA directory after a root rollover
+const (
+	previousRootName      = "rootCA-previous"       // The replaced root CA
+	rootCrossName         = "rootCA-cross"          // The current root CA signed by the previous root
+	previousRootCrossName = "rootCA-previous-cross" // The previous root CA signed by the current root
+)
+
+// rolloverRootMaxPathLen leaves room for a cross certificate between a root
+// created by rolloverRoot and the intermediate CAs, so the root can be rolled
+// over again later. The path length of the hierarchy tiers is added to it.
+const rolloverRootMaxPathLen = 2
+
+// rolloverRoot replaces the root CA with a new one and cross-signs the two
+// roots, so clients trusting either root can validate the intermediates. The
+// previous root and both cross certificates are saved next to rootCA.pem, the
+// chain bundles of all intermediates are regenerated, and the previous CA
+// state is archived in archive/root-<timestamp>. Existing intermediates stay
+// in place; rotate them to move issuance under the new root. The top
+// hierarchy tier is re-signed by the new root, keeping its certificate from
+// the previous root as <tier>-cross.pem. The previous root key is kept as
+// rootCA-previous to cross-sign intermediates issued under the new root. The
+// rollover is refused while a CA still chains to the previous root of an
+// earlier rollover. It returns the archive path relative to the certy
+// directory.
+func rolloverRoot() (string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// Load root CA, which may be offline and given with -root-key
+	oldRootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		return "", err
+	}
+	oldRootKey, err := loadRootKey(backend, oldRootCert)
+	if err != nil {
+		return "", err
+	}
+
+	// A CA still under the previous root would lose its path to a trusted
+	// root once the current root is replaced
+	if err := checkSignedByRoot(oldRootCert, cfg); err != nil {
+		return "", err
+	}
+
+	// Build the new root subject, which must differ from the old one
+	suffix := ""
+	if cfg.CA.UniqueSuffix {
+		suffix, err = newCASuffix()
+		if err != nil {
+			return "", err
+		}
+	}
+	subject := cfg.CA.Root.pkixName(defaultRootCN, suffix)
+	if subject.String() == oldRootCert.Subject.String() {
+		suffix, err = newCASuffix()
+		if err != nil {
+			return "", err
+		}
+		subject = cfg.CA.Root.pkixName(defaultRootCN, suffix)
+	}
+
+	// Archive the current CA
+	archiveName, err := newArchiveDir("root")
+	if err != nil {
+		return "", err
+	}
+	if err := snapshotCADir(archiveName); err != nil {
+		return "", err
+	}
+
+	// Generate the new root CA under a staging key name
+	fmt.Println("Generating root CA...")
+	newRootKey, err := backend.CreateKey(stagedRootKeyName, cfg.DefaultKeyType, cfg.DefaultKeySize)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate root CA key: %w", err)
+	}
+	staged := map[string]*x509.Certificate{previousRootName: oldRootCert}
+	abort := func(err error) (string, error) {
+		discardStagedRollover(backend, archiveName, staged)
+		return "", err
+	}
+	staged["rootCA"], err = signRootCA(newRootKey, subject, rolloverRootMaxPathLen+hierarchyPathLen(cfg), cfg)
+	if err != nil {
+		return abort(fmt.Errorf("failed to generate root CA: %w", err))
+	}
+
+	// Cross-sign new-with-old and old-with-new
+	staged[rootCrossName], err = signCrossCertificate(staged["rootCA"], oldRootKey, oldRootCert, cfg)
+	if err != nil {
+		return abort(fmt.Errorf("failed to cross-sign the new root CA: %w", err))
+	}
+	staged[previousRootCrossName], err = signCrossCertificate(oldRootCert, newRootKey, staged["rootCA"], cfg)
+	if err != nil {
+		return abort(fmt.Errorf("failed to cross-sign the previous root CA: %w", err))
+	}
+
+	// Move the hierarchy tiers under the new root, keeping their
+	// certificates from the previous root as cross certificates
+	for _, tc := range cfg.CA.Hierarchy {
+		baseName := tierBaseName(tc.Name)
+		if !caFileExists(baseName + ".pem") {
+			continue
+		}
+		tierCert, err := loadCACertificate(baseName)
+		if err != nil {
+			return abort(err)
+		}
+		if tierCert.CheckSignatureFrom(oldRootCert) != nil {
+			continue
+		}
+		staged[baseName], err = signCrossCertificate(tierCert, newRootKey, staged["rootCA"], cfg)
+		if err != nil {
+			return abort(fmt.Errorf("failed to sign CA tier %s with the new root CA: %w", tc.Name, err))
+		}
+		staged[baseName+crossSuffix] = tierCert
+	}
+
+	// Stage the roots and cross certificates next to their final names
+	for baseName, cert := range staged {
+		if err := saveCACertificate(cert, baseName+stagedSuffix); err != nil {
+			return abort(fmt.Errorf("failed to save %s: %w", baseName, err))
+		}
+	}
+
+	// Swap in the new root key and certificates. The replaced root key is
+	// kept as rootCA-previous, and the one it replaces goes to the archive.
+	hasPrevious, err := backend.HasKey(previousRootName)
+	if err != nil {
+		return abort(err)
+	}
+	if hasPrevious {
+		if err := backend.ArchiveKey(previousRootName, filepath.Join(archiveName, previousRootName)); err != nil {
+			return abort(err)
+		}
+	}
+	hasRoot, err := backend.HasKey("rootCA")
+	if err != nil {
+		return abort(err)
+	}
+	if hasRoot {
+		if err := backend.ArchiveKey("rootCA", previousRootName); err != nil {
+			return abort(err)
+		}
+	}
+	if err := backend.ArchiveKey(stagedRootKeyName, "rootCA"); err != nil {
+		return "", fmt.Errorf("failed to install the new root CA key (previous CA archived in %s): %w", archiveName, err)
+	}
+	for baseName := range staged {
+		if err := renameCAFile(baseName+stagedSuffix+".pem", baseName+".pem"); err != nil {
+			return "", fmt.Errorf("%w (previous CA archived in %s)", err, archiveName)
+		}
+	}
+
+	// Regenerate the chain bundles of all intermediates, which are now under
+	// the previous root and need no cross certificate of their own
+	for _, name := range installedIssuers(cfg) {
+		baseName := issuerBaseName(name)
+		intCert, err := loadCACertificate(baseName)
+		if err != nil {
+			return "", err
+		}
+		if err := removeCAFile(baseName + crossSuffix + ".pem"); err != nil {
+			return "", err
+		}
+		if err := saveChainBundles(baseName, intCert); err != nil {
+			return "", err
+		}
+	}
+
+	return archiveName, nil
+}
+
+// Names used for the new root CA until rolloverRoot swaps it in
+const (
+	stagedRootKeyName = "rootCA-staged"
+	stagedSuffix      = ".staged"
+)
+
+// crossSuffix names the certificate of a CA under the current root that is
+// signed by the previous root instead
+const crossSuffix = "-cross"
+
+// checkSignedByRoot returns an error if an installed intermediate CA or
+// hierarchy tier does not chain to rootCert
+func checkSignedByRoot(rootCert *x509.Certificate, cfg *Config) error {
+	for _, tc := range cfg.CA.Hierarchy {
+		baseName := tierBaseName(tc.Name)
+		if !caFileExists(baseName + ".pem") {
+			continue
+		}
+		cert, err := loadCACertificate(baseName)
+		if err != nil {
+			return err
+		}
+		if err := checkChainsTo(cert, rootCert, cfg); err != nil {
+			return fmt.Errorf("CA tier %s does not chain to the current root CA; use -reinstall before rolling over the root", tc.Name)
+		}
+	}
+
+	for _, name := range installedIssuers(cfg) {
+		cert, err := loadCACertificate(issuerBaseName(name))
+		if err != nil {
+			return err
+		}
+		if err := checkChainsTo(cert, rootCert, cfg); err != nil {
+			rotate := "certy -rotate-intermediate"
+			if name != "" {
+				rotate += " -issuer " + name
+			}
+			return fmt.Errorf("%s is still signed by the previous root CA; run '%s' before rolling over the root again", issuerBaseName(name), rotate)
+		}
+	}
+	return nil
+}
+
+// checkChainsTo checks that the top of the tier chain above cert is signed
+// by rootCert
+func checkChainsTo(cert, rootCert *x509.Certificate, cfg *Config) error {
+	tiers, err := tierChain(cert, cfg)
+	if err != nil {
+		return err
+	}
+	if len(tiers) > 0 {
+		cert = tiers[len(tiers)-1]
+	}
+	return cert.CheckSignatureFrom(rootCert)
+}
+
+// discardStagedRollover removes the staged certificates and moves the staged
+// root key into the archive after a failed rollover
+func discardStagedRollover(backend KeyBackend, archiveName string, staged map[string]*x509.Certificate) {
+	for baseName := range staged {
+		if path, err := getCAFilePath(baseName + stagedSuffix + ".pem"); err == nil {
+			os.Remove(path)
+		}
+	}
+	has, err := backend.HasKey(stagedRootKeyName)
+	if err == nil && has {
+		err = backend.ArchiveKey(stagedRootKeyName, filepath.Join(archiveName, stagedRootKeyName))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to discard the staged root CA key: %v\n", err)
+	}
+}
+
+// renameCAFile renames a file in the certy directory, replacing newName
+func renameCAFile(oldName, newName string) error {
+	oldPath, err := getCAFilePath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := getCAFilePath(newName)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("failed to install %s: %w", newName, err)
+	}
+	return nil
+}
+
+// signCrossCertificate issues a certificate for the subject, key and
+// extensions of the CA cert, signed by another CA. The authority key and
+// CA issuers URL follow the new issuer. The certificate cannot outlive
+// either CA.
+func signCrossCertificate(cert *x509.Certificate, issuerKey crypto.Signer, issuerCert *x509.Certificate, cfg *Config) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	notAfter := cert.NotAfter
+	if issuerCert.NotAfter.Before(notAfter) {
+		notAfter = issuerCert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		RawSubject:            cert.RawSubject,
+		SubjectKeyId:          cert.SubjectKeyId,
+		NotBefore:             time.Now().AddDate(0, 0, -1),
+		NotAfter:              notAfter,
+		KeyUsage:              cert.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            cert.MaxPathLen,
+		MaxPathLenZero:        cert.MaxPathLenZero,
+		OCSPServer:            cert.OCSPServer,
+		IssuingCertificateURL: caIssuersURL(issuerCert, cfg),
+	}
+
+	// Keep the usages, name constraints, policies and CRL distribution points
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionAuthorityKeyId) || ext.Id.Equal(oidExtensionAuthorityInfoAccess) {
+			continue
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, issuerCert, cert.PublicKey, issuerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	crossCert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	return crossCert, nil
+}
+
+// Extensions signCrossCertificate leaves to the new issuer
+var (
+	oidExtensionAuthorityKeyId      = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidExtensionAuthorityInfoAccess = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 1}
+)
+
+// savePreviousRootCross saves <baseName>-cross.pem, the CA certificate cert
+// signed by the previous root, so clients that only trust the previous root
+// can validate a CA issued under the new root. It is skipped before the
+// first rollover, for CAs below a hierarchy tier, and when the previous root
+// key is neither in the key backend nor in the -root-key file.
+func savePreviousRootCross(backend KeyBackend, baseName string, cert *x509.Certificate, cfg *Config) error {
+	// Drop the cross certificate of the CA this one replaces
+	if err := removeCAFile(baseName + crossSuffix + ".pem"); err != nil {
+		return err
+	}
+	if !caFileExists(previousRootName + ".pem") {
+		return nil
+	}
+
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		return err
+	}
+	if cert.CheckSignatureFrom(rootCert) != nil {
+		return nil
+	}
+	previousRoot, err := loadCACertificate(previousRootName)
+	if err != nil {
+		return err
+	}
+	previousKey, err := loadPreviousRootKey(backend, previousRoot)
+	if err != nil {
+		return err
+	}
+	if previousKey == nil {
+		return nil
+	}
+
+	cross, err := signCrossCertificate(cert, previousKey, previousRoot, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to cross-sign %s with the previous root CA: %w", baseName, err)
+	}
+	return saveCACertificate(cross, baseName+crossSuffix)
+}
+
+// loadPreviousRootCross returns <baseName>-cross.pem if it holds the key of
+// cert signed by previousRoot, or nil otherwise
+func loadPreviousRootCross(baseName string, cert, previousRoot *x509.Certificate) (*x509.Certificate, error) {
+	if !caFileExists(baseName + crossSuffix + ".pem") {
+		return nil, nil
+	}
+	cross, err := loadCACertificate(baseName + crossSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cross.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) || cross.CheckSignatureFrom(previousRoot) != nil {
+		return nil, nil
+	}
+	return cross, nil
+}
+
+// removeCAFile removes a file from the certy directory if it exists
+func removeCAFile(name string) error {
+	path, err := getCAFilePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", name, err)
+	}
+	return nil
+}
+
+// saveChainBundles saves <baseName>-fullchain.pem for clients trusting the
+// current root and, after a root rollover, <baseName>-fullchain-previous.pem
+// for clients that only trust the previous root. Both bundles include the
+// hierarchy tiers above the intermediate. When the top of the chain was
+// signed by the other root, they go through its cross certificate from
+// savePreviousRootCross or, failing that, through the cross-signed root.
+func saveChainBundles(baseName string, intCert *x509.Certificate) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	tiers, err := tierChain(intCert, cfg)
+	if err != nil {
+		return err
+	}
+	chain := append([]*x509.Certificate{intCert}, tiers...)
+	top := chain[len(chain)-1]
+
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		return err
+	}
+	if !caFileExists(previousRootName + ".pem") {
+		return saveChain(baseName+"-fullchain.pem", append(chain, rootCert)...)
+	}
+
+	// Load the previous root and the cross certificates
+	previousRoot, err := loadCACertificate(previousRootName)
+	if err != nil {
+		return err
+	}
+	rootCross, err := loadCACertificate(rootCrossName)
+	if err != nil {
+		return err
+	}
+	previousCross, err := loadCACertificate(previousRootCrossName)
+	if err != nil {
+		return err
+	}
+
+	previousBundle := baseName + "-fullchain-previous.pem"
+	switch {
+	case top.CheckSignatureFrom(rootCert) == nil:
+		if err := saveChain(baseName+"-fullchain.pem", append(chain, rootCert)...); err != nil {
+			return err
+		}
+
+		// Prefer the top CA signed by the previous root, which keeps the path
+		// as short as under the current root
+		topBase := baseName
+		if len(tiers) > 0 {
+			topBase = installedTierBaseName(top, cfg)
+		}
+		topCross, err := loadPreviousRootCross(topBase, top, previousRoot)
+		if err != nil {
+			return err
+		}
+		if topCross != nil {
+			previousChain := append(slices.Clone(chain[:len(chain)-1]), topCross, previousRoot)
+			return saveChain(previousBundle, previousChain...)
+		}
+
+		// Otherwise the previous root must allow the cross-signed root in the path
+		if previousRoot.MaxPathLen >= 0 && previousRoot.MaxPathLen < len(chain)+1 {
+			fmt.Printf("Note: %s cannot be validated by clients that only trust the previous root (its key is not available to cross-sign it)\n", baseName)
+			return removeCAFile(previousBundle)
+		}
+		return saveChain(previousBundle, append(chain, rootCross, previousRoot)...)
+	case top.CheckSignatureFrom(previousRoot) == nil:
+		if err := saveChain(baseName+"-fullchain.pem", append(chain, previousCross, rootCert)...); err != nil {
+			return err
+		}
+		return saveChain(previousBundle, append(chain, previousRoot)...)
+	default:
+		return fmt.Errorf("%s is not signed by the current or the previous root CA", baseName)
+	}
+}
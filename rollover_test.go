@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRolloverRoot(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA and issue a certificate from the current intermediate
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	cfg := DefaultConfig()
+	oldLeaf := issueTestLeaf(t, tmpDir, "old", cfg)
+	oldRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+
+	// Roll over the root
+	archiveName, err := rolloverRoot()
+	if err != nil {
+		t.Fatalf("Failed to roll over root CA: %v", err)
+	}
+	if !strings.HasPrefix(archiveName, filepath.Join(archiveDirName, "root-")) {
+		t.Errorf("Unexpected archive name %q", archiveName)
+	}
+	if !caFileExists(filepath.Join(archiveName, "rootCA-key.pem")) {
+		t.Error("Expected the previous root key in the archive")
+	}
+
+	newRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load new root CA: %v", err)
+	}
+	previousRoot, err := loadCACertificate("rootCA-previous")
+	if err != nil {
+		t.Fatalf("Failed to load previous root CA: %v", err)
+	}
+	if !previousRoot.Equal(oldRoot) {
+		t.Error("Expected rootCA-previous.pem to hold the old root")
+	}
+	if newRoot.Subject.String() == oldRoot.Subject.String() {
+		t.Errorf("Expected the new root subject to differ from %q", oldRoot.Subject.String())
+	}
+	if newRoot.MaxPathLen != rolloverRootMaxPathLen {
+		t.Errorf("Expected new root MaxPathLen %d, got %d", rolloverRootMaxPathLen, newRoot.MaxPathLen)
+	}
+
+	// Verify both cross certificates
+	rootCross, err := loadCACertificate("rootCA-cross")
+	if err != nil {
+		t.Fatalf("Failed to load cross certificate: %v", err)
+	}
+	if err := rootCross.CheckSignatureFrom(oldRoot); err != nil {
+		t.Errorf("Expected new root cross-signed by the old root: %v", err)
+	}
+	if rootCross.Subject.String() != newRoot.Subject.String() || string(rootCross.SubjectKeyId) != string(newRoot.SubjectKeyId) {
+		t.Error("Expected the cross certificate to carry the new root's subject and key ID")
+	}
+	previousCross, err := loadCACertificate("rootCA-previous-cross")
+	if err != nil {
+		t.Fatalf("Failed to load previous cross certificate: %v", err)
+	}
+	if err := previousCross.CheckSignatureFrom(newRoot); err != nil {
+		t.Errorf("Expected old root cross-signed by the new root: %v", err)
+	}
+	if previousCross.NotAfter.After(newRoot.NotAfter) || previousCross.NotAfter.After(oldRoot.NotAfter) {
+		t.Error("Expected the cross certificate not to outlive either root")
+	}
+
+	// Certificates from the existing intermediate validate against both roots
+	verifyWithBundle(t, oldLeaf, newRoot, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+	verifyWithBundle(t, oldLeaf, oldRoot, filepath.Join(tmpDir, "intermediateCA-fullchain-previous.pem"))
+
+	// After rotating, the new intermediate chains to the new root, and to
+	// the old root through its certificate signed by the old root key
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	newLeaf := issueTestLeaf(t, tmpDir, "new", cfg)
+	verifyWithBundle(t, newLeaf, newRoot, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+	verifyWithBundle(t, newLeaf, oldRoot, filepath.Join(tmpDir, "intermediateCA-fullchain-previous.pem"))
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	intCross, err := loadCACertificate("intermediateCA-cross")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate cross certificate: %v", err)
+	}
+	if err := intCross.CheckSignatureFrom(oldRoot); err != nil {
+		t.Errorf("Expected intermediate cross-signed by the old root: %v", err)
+	}
+	if intCross.Subject.String() != intCert.Subject.String() || intCross.MaxPathLen != intCert.MaxPathLen || len(intCross.Extensions) != len(intCert.Extensions) {
+		t.Error("Expected the cross certificate to carry the intermediate's subject and extensions")
+	}
+
+	// A root created by a rollover can be rolled over again with both paths
+	if _, err := rolloverRoot(); err != nil {
+		t.Fatalf("Failed to roll over root CA again: %v", err)
+	}
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	thirdRoot, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	leaf := issueTestLeaf(t, tmpDir, "third", cfg)
+	verifyWithBundle(t, leaf, thirdRoot, filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+	verifyWithBundle(t, leaf, newRoot, filepath.Join(tmpDir, "intermediateCA-fullchain-previous.pem"))
+	if !caFileExists(filepath.Join(archiveName, "rootCA-key.pem")) {
+		t.Error("Expected the original root key to stay in the first archive")
+	}
+}
+
+func TestRolloverRootRefusedUnderPreviousRoot(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA and roll over the root
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	if _, err := rolloverRoot(); err != nil {
+		t.Fatalf("Failed to roll over root CA: %v", err)
+	}
+	rootBefore, err := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read root CA: %v", err)
+	}
+	previousBefore, err := os.ReadFile(filepath.Join(tmpDir, "rootCA-previous.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read previous root CA: %v", err)
+	}
+
+	// The intermediate is still under the previous root
+	_, err = rolloverRoot()
+	if err == nil || !strings.Contains(err.Error(), "-rotate-intermediate") {
+		t.Fatalf("Expected rollover to be refused until the intermediate is rotated, got %v", err)
+	}
+
+	// Nothing was replaced or staged
+	rootAfter, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	previousAfter, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA-previous.pem"))
+	if string(rootAfter) != string(rootBefore) || string(previousAfter) != string(previousBefore) {
+		t.Error("Expected the refused rollover to leave the roots unchanged")
+	}
+	staged, _ := filepath.Glob(filepath.Join(tmpDir, "*"+stagedSuffix+"*"))
+	if len(staged) > 0 || caFileExists(stagedRootKeyName+"-key.pem") {
+		t.Errorf("Expected no staged files, found %v", staged)
+	}
+	if !caExists() {
+		t.Error("Expected the CA to stay usable")
+	}
+	verifyWithBundle(t, issueTestLeaf(t, tmpDir, "leaf", DefaultConfig()), loadCertFromFile(t, filepath.Join(tmpDir, "rootCA.pem")), filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+}
+
+func TestReinstallCARemovesRolloverState(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA, roll over the root and rotate under it
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	if _, err := rolloverRoot(); err != nil {
+		t.Fatalf("Failed to roll over root CA: %v", err)
+	}
+	if _, err := rotateIntermediateCA(""); err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+
+	// A reinstall starts a new hierarchy without the cross certificates
+	if _, err := reinstallCA(); err != nil {
+		t.Fatalf("Failed to reinstall CA: %v", err)
+	}
+	for _, file := range []string{"rootCA-previous.pem", "rootCA-previous-key.pem", "rootCA-cross.pem", "rootCA-previous-cross.pem", "intermediateCA-cross.pem", "intermediateCA-fullchain-previous.pem"} {
+		if caFileExists(file) {
+			t.Errorf("Expected %s to be removed by -reinstall", file)
+		}
+	}
+}
+
+// issueTestLeaf issues a TLS certificate into dir and returns it
+func issueTestLeaf(t *testing.T, dir, name string, cfg *Config) *x509.Certificate {
+	t.Helper()
+	certPath := filepath.Join(dir, name+".pem")
+	opts := CertOptions{CertFile: certPath, KeyFile: filepath.Join(dir, name+"-key.pem")}
+	if _, _, err := generateCertificate([]string{name + ".example.com"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	return loadCertFromFile(t, certPath)
+}
+
+// verifyWithBundle verifies leaf against root, using the certificates in the
+// bundle file as intermediates
+func verifyWithBundle(t *testing.T, leaf, root *x509.Certificate, bundle string) {
+	t.Helper()
+	data, err := os.ReadFile(bundle)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", bundle, err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("Failed to parse certificate in %s: %v", bundle, err)
+		}
+		intermediates.AddCert(cert)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Failed to verify %s with %s against %q: %v", leaf.Subject.CommonName, filepath.Base(bundle), root.Subject.CommonName, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rotateIntermediateCA replaces the intermediate CA with a new one signed by
+// the existing root CA, or the lowest tier of a configured hierarchy. The old
+// intermediate certificate, key and serial state are moved to
+// archive/intermediate-<timestamp>, and the serial counter keeps counting so
+// serial numbers are never reused. A non-empty issuer rotates that
+// purpose-specific issuer instead, leaving the shared serial state in place.
+// It returns the archive path relative to the certy directory.
+func rotateIntermediateCA(issuer string) (string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+
+	// Resolve the intermediate being rotated
+	baseName := issuerBaseName(issuer)
+	subject := cfg.CA.Intermediate
+	var extKeyUsage []x509.ExtKeyUsage
+	archivePrefix := "intermediate"
+	archiveFiles := []string{"intermediateCA.pem", "intermediateCA-cross.pem", "intermediateCA-fullchain.pem", "intermediateCA-fullchain-previous.pem", "serial.txt", "issued.db", "revoked.db", "crl.pem"}
+	if baseName != "intermediateCA" {
+		ic, err := findIssuerConfig(cfg, issuer)
+		if err != nil {
+			return "", err
+		}
+		if !caFileExists(baseName + ".pem") {
+			return "", fmt.Errorf("issuer %s is not installed", issuer)
+		}
+		subject = ic.subject()
+		extKeyUsage = ic.extKeyUsage()
+		archivePrefix = "intermediate-" + issuer
+		archiveFiles = []string{baseName + ".pem", baseName + crossSuffix + ".pem", baseName + "-fullchain.pem", baseName + "-fullchain-previous.pem", issuerCRLName(issuer)}
+	}
+
+	backend, err := newKeyBackend(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// Load the signing CA (the root or the lowest tier) and the root for its install suffix
+	parentKey, parentCert, err := loadIssuingParent(backend, cfg)
+	if err != nil {
+		return "", err
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		return "", err
+	}
+
+	// Archive the current intermediate CA files
+	archiveName, err := newArchiveDir(archivePrefix)
+	if err != nil {
+		return "", err
+	}
+	if err := archiveCAFiles(archiveName, archiveFiles...); err != nil {
+		return "", err
+	}
+
+	// Generate and sign the new intermediate CA under a staging name, keeping
+	// the root's install suffix, so a failure leaves the current one in place
+	fmt.Println("Generating intermediate CA...")
+	stagedKeyName := baseName + "-staged"
+	intKey, err := backend.CreateKey(stagedKeyName, cfg.DefaultKeyType, cfg.DefaultKeySize)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate intermediate CA key: %w", err)
+	}
+	abort := func(err error) (string, error) {
+		if archiveErr := backend.ArchiveKey(stagedKeyName, filepath.Join(archiveName, stagedKeyName)); archiveErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to discard the staged intermediate CA key: %v\n", archiveErr)
+		}
+		removeCAFile(baseName + stagedSuffix + ".pem")
+		return "", err
+	}
+	intSubject := subject.pkixName(defaultIntermediateCN, rootSuffix(rootCert, cfg))
+	intCert, err := signIntermediateCA(intKey.Public(), intSubject, extKeyUsage, parentKey, parentCert, cfg)
+	if err != nil {
+		return abort(fmt.Errorf("failed to generate intermediate CA: %w", err))
+	}
+	if err := saveCACertificate(intCert, baseName+stagedSuffix); err != nil {
+		return abort(fmt.Errorf("failed to save intermediate CA: %w", err))
+	}
+
+	// Swap in the new key and certificate, moving the old key to the archive
+	if err := backend.ArchiveKey(baseName, filepath.Join(archiveName, baseName)); err != nil {
+		return abort(err)
+	}
+	if err := backend.ArchiveKey(stagedKeyName, baseName); err != nil {
+		return "", fmt.Errorf("failed to install the new intermediate CA key (previous CA archived in %s): %w", archiveName, err)
+	}
+	if err := renameCAFile(baseName+stagedSuffix+".pem", baseName+".pem"); err != nil {
+		return "", fmt.Errorf("%w (previous CA archived in %s)", err, archiveName)
+	}
+
+	// Save its cross certificate and fullchain
+	if err := savePreviousRootCross(backend, baseName, intCert, cfg); err != nil {
+		return "", err
+	}
+	if err := saveChainBundles(baseName, intCert); err != nil {
+		return "", fmt.Errorf("failed to save intermediate CA fullchain: %w", err)
+	}
+
+	return archiveName, nil
+}
+
+// rootSuffix returns the per-install suffix of the root CA common name, or
+// an empty string if the root was not installed with unique_suffix
+func rootSuffix(rootCert *x509.Certificate, cfg *Config) string {
+	if !cfg.CA.UniqueSuffix {
+		return ""
+	}
+	prefix := cfg.CA.Root.pkixName(defaultRootCN, "").CommonName + " "
+	suffix, ok := strings.CutPrefix(rootCert.Subject.CommonName, prefix)
+	if !ok || len(suffix) != caSuffixLength {
+		return ""
+	}
+	return suffix
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotateIntermediateCA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Install CA and issue a certificate from the first intermediate
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	cfg := DefaultConfig()
+	certPath, keyPath, err := generateCertificate([]string{"old.example.com"}, CertTypeTLS, CertOptions{}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	oldLeaf := loadCertFromFile(t, certPath)
+
+	rootBefore, err := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read root CA: %v", err)
+	}
+	rootKeyBefore, err := os.ReadFile(filepath.Join(tmpDir, "rootCA-key.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read root CA key: %v", err)
+	}
+	oldIntKey, err := os.ReadFile(filepath.Join(tmpDir, "intermediateCA-key.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read intermediate CA key: %v", err)
+	}
+	oldInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	serialBefore, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to read serial number: %v", err)
+	}
+
+	// Rotate
+	archiveName, err := rotateIntermediateCA("")
+	if err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	if !strings.HasPrefix(archiveName, filepath.Join("archive", "intermediate-")) {
+		t.Errorf("Unexpected archive name %q", archiveName)
+	}
+
+	// Root CA is untouched
+	rootAfter, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA.pem"))
+	rootKeyAfter, _ := os.ReadFile(filepath.Join(tmpDir, "rootCA-key.pem"))
+	if !bytes.Equal(rootBefore, rootAfter) || !bytes.Equal(rootKeyBefore, rootKeyAfter) {
+		t.Error("Root CA should not change during rotation")
+	}
+
+	// Old intermediate, key and serial state are archived
+	archiveDir := filepath.Join(tmpDir, archiveName)
+	for _, file := range []string{"intermediateCA.pem", "intermediateCA-key.pem", "intermediateCA-fullchain.pem", "serial.txt"} {
+		if _, err := os.Stat(filepath.Join(archiveDir, file)); err != nil {
+			t.Errorf("Expected %s in archive: %v", file, err)
+		}
+	}
+	archivedKey, _ := os.ReadFile(filepath.Join(archiveDir, "intermediateCA-key.pem"))
+	if !bytes.Equal(archivedKey, oldIntKey) {
+		t.Error("Archived key does not match the previous intermediate key")
+	}
+
+	// New intermediate chains to the same root
+	newInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load new intermediate CA: %v", err)
+	}
+	if newInt.SerialNumber.Cmp(oldInt.SerialNumber) == 0 {
+		t.Error("Expected a new intermediate certificate")
+	}
+	rootCert, err := loadCACertificate("rootCA")
+	if err != nil {
+		t.Fatalf("Failed to load root CA: %v", err)
+	}
+	if err := newInt.CheckSignatureFrom(rootCert); err != nil {
+		t.Errorf("New intermediate not signed by root: %v", err)
+	}
+
+	// Fullchain contains the new intermediate followed by the root
+	chainData, err := os.ReadFile(filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read fullchain: %v", err)
+	}
+	if !bytes.HasPrefix(chainData, pemEncodeCert(newInt)) {
+		t.Error("Fullchain should start with the new intermediate")
+	}
+
+	// Serial numbers keep counting
+	serialAfter, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to read serial number: %v", err)
+	}
+	if serialAfter <= serialBefore {
+		t.Errorf("Expected serial to continue after %d, got %d", serialBefore, serialAfter)
+	}
+
+	// Certificates from the old intermediate still verify against the archived chain
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(oldInt)
+	if _, err := oldLeaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Old certificate no longer verifies: %v", err)
+	}
+
+	// New certificates are issued by the new intermediate
+	newCertPath, newKeyPath, err := generateCertificate([]string{"new.example.com"}, CertTypeTLS, CertOptions{}, cfg)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate after rotation: %v", err)
+	}
+	defer os.Remove(newCertPath)
+	defer os.Remove(newKeyPath)
+	if err := loadCertFromFile(t, newCertPath).CheckSignatureFrom(newInt); err != nil {
+		t.Errorf("Certificate not signed by new intermediate: %v", err)
+	}
+}
+
+func TestRotateIntermediateCAKeepsSuffix(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	cfg := DefaultConfig()
+	cfg.CA.UniqueSuffix = true
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	oldInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	// Rotate twice; both archives must be kept
+	first, err := rotateIntermediateCA("")
+	if err != nil {
+		t.Fatalf("Failed to rotate intermediate CA: %v", err)
+	}
+	second, err := rotateIntermediateCA("")
+	if err != nil {
+		t.Fatalf("Failed to rotate intermediate CA again: %v", err)
+	}
+	if first == second {
+		t.Errorf("Expected distinct archives, both were %q", first)
+	}
+
+	newInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	if newInt.Subject.CommonName != oldInt.Subject.CommonName {
+		t.Errorf("Expected intermediate CN %q, got %q", oldInt.Subject.CommonName, newInt.Subject.CommonName)
+	}
+}
+
+func TestRotateIntermediateCAFailureKeepsCA(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	oldInt, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	// Block the staged certificate so the rotation fails after signing
+	if err := os.Mkdir(filepath.Join(tmpDir, "intermediateCA"+stagedSuffix+".pem"), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if _, err := rotateIntermediateCA(""); err == nil {
+		t.Fatal("Expected error when the new intermediate cannot be saved")
+	}
+
+	// The old intermediate is still installed and keeps signing
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+	if !intCert.Equal(oldInt) {
+		t.Error("Expected the old intermediate CA to stay installed")
+	}
+	leaf := issueTestLeaf(t, tmpDir, "leaf", DefaultConfig())
+	if err := leaf.CheckSignatureFrom(oldInt); err != nil {
+		t.Errorf("Expected the old intermediate CA to sign: %v", err)
+	}
+	staged, _ := filepath.Glob(filepath.Join(tmpDir, "*staged*"))
+	if len(staged) > 0 {
+		t.Errorf("Expected no staged files, found %v", staged)
+	}
+}
+
+// pemEncodeCert returns the PEM encoding of a certificate
+func pemEncodeCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// spiffeProfileName names the built-in profile for X.509-SVIDs, used when
+// profiles does not define a profile of that name
+const spiffeProfileName = "spiffe"
+
+// maxSPIFFEIDLength is the maximum length of a SPIFFE ID in bytes
+const maxSPIFFEIDLength = 2048
+
+// validateSPIFFETrustDomains checks the configured SPIFFE trust domains
+func validateSPIFFETrustDomains(domains []string) error {
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		if err := validateTrustDomainName(domain); err != nil {
+			return fmt.Errorf("spiffe_trust_domains: %w", err)
+		}
+		if seen[domain] {
+			return fmt.Errorf("spiffe_trust_domains: duplicate trust domain '%s'", domain)
+		}
+		seen[domain] = true
+	}
+	return nil
+}
+
+// validateTrustDomainName checks a trust domain name, which may only contain
+// lowercase letters, digits, dots, dashes and underscores
+func validateTrustDomainName(domain string) error {
+	if domain == "" || len(domain) > 255 {
+		return fmt.Errorf("trust domain must be 1 to 255 characters")
+	}
+	for _, c := range domain {
+		if !isSPIFFEChar(c) || (c >= 'A' && c <= 'Z') {
+			return fmt.Errorf("invalid trust domain %q (use lowercase letters, digits, '.', '-' and '_')", domain)
+		}
+	}
+	return nil
+}
+
+// spiffeTrustDomain checks that u is a valid SPIFFE ID and returns its trust
+// domain. SPIFFE IDs have no port, user info, query or fragment, and their
+// path segments are non-empty, unescaped and not '.' or '..'.
+func spiffeTrustDomain(u *url.URL) (string, error) {
+	id := u.String()
+	if len(id) > maxSPIFFEIDLength {
+		return "", fmt.Errorf("SPIFFE ID %s exceeds %d bytes", id, maxSPIFFEIDLength)
+	}
+	if u.Opaque != "" || u.User != nil || u.Port() != "" || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" || u.RawPath != "" {
+		return "", fmt.Errorf("invalid SPIFFE ID %s: only spiffe://<trust domain>/<path> is allowed", id)
+	}
+	if err := validateTrustDomainName(u.Host); err != nil {
+		return "", fmt.Errorf("invalid SPIFFE ID %s: %w", id, err)
+	}
+
+	if u.Path != "" {
+		for _, segment := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return "", fmt.Errorf("invalid SPIFFE ID %s: empty, '.' or '..' path segment", id)
+			}
+			if strings.IndexFunc(segment, func(c rune) bool { return !isSPIFFEChar(c) }) >= 0 {
+				return "", fmt.Errorf("invalid SPIFFE ID %s: path segments may only contain letters, digits, '.', '-' and '_'", id)
+			}
+		}
+	}
+	return u.Host, nil
+}
+
+// isSPIFFEChar reports whether c may appear in a trust domain or path segment
+func isSPIFFEChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_'
+}
+
+// checkSPIFFEIDs refuses invalid SPIFFE IDs among the URI SANs of template
+// and those outside spiffe_trust_domains. X.509-SVID profiles also need
+// exactly one URI SAN, which must be a SPIFFE ID.
+func checkSPIFFEIDs(template *x509.Certificate, profile ProfileConfig, cfg *Config) error {
+	for _, uri := range template.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		domain, err := spiffeTrustDomain(uri)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(cfg.SPIFFETrustDomains, domain) {
+			return fmt.Errorf("trust domain %s of %s is not in spiffe_trust_domains", domain, uri)
+		}
+	}
+
+	if profile.SPIFFE && (len(template.URIs) != 1 || template.URIs[0].Scheme != "spiffe") {
+		return fmt.Errorf("profile %s issues X.509-SVIDs, which need exactly one spiffe:// URI SAN", profile.Name)
+	}
+	return nil
+}
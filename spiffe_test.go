@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIssueSPIFFESVID(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	// Configure the trust domain
+	cfg := DefaultConfig()
+	cfg.SPIFFETrustDomains = []string{"prod.example"}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+
+	// Issue with the built-in spiffe profile
+	certPath := filepath.Join(tmpDir, "svid.pem")
+	opts := CertOptions{CertFile: certPath, KeyFile: filepath.Join(tmpDir, "svid-key.pem"), Profile: "spiffe"}
+	if _, _, err := generateCertificate([]string{"spiffe://prod.example/ns/web/sa/api"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate SVID: %v", err)
+	}
+	cert := loadCertFromFile(t, certPath)
+
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != "spiffe://prod.example/ns/web/sa/api" {
+		t.Errorf("Expected a single SPIFFE ID URI SAN, got %v", cert.URIs)
+	}
+	if len(cert.DNSNames) != 0 || cert.Subject.CommonName != "" {
+		t.Errorf("Expected no DNS names or common name, got %v and %q", cert.DNSNames, cert.Subject.CommonName)
+	}
+	if cert.IsCA || cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 || cert.KeyUsage&(x509.KeyUsageCertSign|x509.KeyUsageCRLSign) != 0 {
+		t.Errorf("Expected a leaf with digital signature usage, got IsCA=%v KeyUsage=%v", cert.IsCA, cert.KeyUsage)
+	}
+	if !slices.Equal(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("Expected server and client authentication, got %v", cert.ExtKeyUsage)
+	}
+	verifyWithBundle(t, cert, loadCertFromFile(t, filepath.Join(tmpDir, "rootCA.pem")), filepath.Join(tmpDir, "intermediateCA-fullchain.pem"))
+
+	// A CSR carrying the SPIFFE ID is signed with the same profile
+	csrPath := filepath.Join(tmpDir, "svid.csr")
+	spiffeID, _ := url.Parse("spiffe://prod.example/ns/db")
+	writeTestCSR(t, csrPath, &x509.CertificateRequest{URIs: []*url.URL{spiffeID}})
+	csrOpts := CertOptions{CertFile: filepath.Join(tmpDir, "svid-csr.pem"), Profile: "spiffe"}
+	if _, err := generateFromCSR(csrPath, csrOpts, cfg); err != nil {
+		t.Fatalf("Failed to sign SVID CSR: %v", err)
+	}
+	if csrCert := loadCertFromFile(t, csrOpts.CertFile); len(csrCert.URIs) != 1 || csrCert.URIs[0].String() != spiffeID.String() {
+		t.Errorf("Expected the SPIFFE ID from the CSR, got %v", csrCert.URIs)
+	}
+
+	// Requests that do not make a valid SVID are refused without using a serial
+	serialBefore, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	refused := []struct {
+		name    string
+		inputs  []string
+		profile string
+		errMsg  string
+	}{
+		{"other trust domain", []string{"spiffe://staging.example/api"}, "spiffe", "not in spiffe_trust_domains"},
+		{"other trust domain without profile", []string{"api.example.com", "spiffe://staging.example/api"}, "", "not in spiffe_trust_domains"},
+		{"two SPIFFE IDs", []string{"spiffe://prod.example/a", "spiffe://prod.example/b"}, "spiffe", "exactly one"},
+		{"no SPIFFE ID", []string{"api.example.com"}, "spiffe", "exactly one"},
+		{"invalid path", []string{"spiffe://prod.example/ns//api"}, "spiffe", "path segment"},
+		{"query", []string{"spiffe://prod.example/api?x=1"}, "spiffe", "invalid SPIFFE ID"},
+	}
+	for _, tt := range refused {
+		opts := CertOptions{CertFile: filepath.Join(tmpDir, "refused.pem"), KeyFile: filepath.Join(tmpDir, "refused-key.pem"), Profile: tt.profile}
+		_, _, err := generateCertificate(tt.inputs, CertTypeTLS, opts, cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.errMsg, err)
+		}
+	}
+	serialAfter, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	if serialAfter != serialBefore+1 {
+		t.Errorf("Expected refused requests not to consume serial numbers")
+	}
+}
+
+func TestSPIFFETrustDomain(t *testing.T) {
+	tests := []struct {
+		id      string
+		domain  string
+		wantErr bool
+	}{
+		{"spiffe://prod.example", "prod.example", false},
+		{"spiffe://prod.example/ns/web/sa/api", "prod.example", false},
+		{"spiffe://my_domain-1.example/a.b-c_d", "my_domain-1.example", false},
+		{"spiffe://Prod.example/api", "", true},
+		{"spiffe://prod.example:8443/api", "", true},
+		{"spiffe://user@prod.example/api", "", true},
+		{"spiffe://prod.example/api#frag", "", true},
+		{"spiffe://prod.example/api/", "", true},
+		{"spiffe://prod.example/a/../b", "", true},
+		{"spiffe://prod.example/a%20b", "", true},
+		{"spiffe://prod.example/" + strings.Repeat("a", maxSPIFFEIDLength), "", true},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.id)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.id, err)
+		}
+		domain, err := spiffeTrustDomain(u)
+		if tt.wantErr && err == nil {
+			t.Errorf("Expected error for %s", tt.id)
+		}
+		if !tt.wantErr && (err != nil || domain != tt.domain) {
+			t.Errorf("Expected trust domain %s for %s, got %q, %v", tt.domain, tt.id, domain, err)
+		}
+	}
+}
+
+func TestValidateSPIFFEConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		domains  []string
+		profiles []ProfileConfig
+		wantErr  string
+	}{
+		{"valid", []string{"prod.example", "staging.example"}, []ProfileConfig{{Name: "svid", SPIFFE: true}}, ""},
+		{"uppercase trust domain", []string{"Prod.example"}, nil, "invalid trust domain"},
+		{"duplicate trust domain", []string{"prod.example", "prod.example"}, nil, "duplicate trust domain"},
+		{"profile without trust domains", nil, []ProfileConfig{{Name: "svid", SPIFFE: true}}, "requires spiffe_trust_domains"},
+		{"profile without digital signature", []string{"prod.example"}, []ProfileConfig{{Name: "svid", SPIFFE: true, KeyUsage: []string{"key_agreement"}}}, "must include digital_signature"},
+		{"profile with common name", []string{"prod.example"}, []ProfileConfig{{Name: "svid", SPIFFE: true, Subject: SubjectConfig{CommonName: "api"}}}, "cannot be used with spiffe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.SPIFFETrustDomains = tt.domains
+			cfg.Profiles = tt.profiles
+			err := validateConfig(cfg)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Expected valid config, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLeafValidity is the longest validity of an issued certificate, matching
+// the 825-day limit of default_validity_days
+const maxLeafValidity = 825 * 24 * time.Hour
+
+// defaultBackdate is how far issued certificates start in the past when
+// backdate is not configured, allowing for clock skew
+const defaultBackdate = 24 * time.Hour
+
+// maxBackdate is the largest configurable backdate
+const maxBackdate = 7 * 24 * time.Hour
+
+// Policies for certificates that would outlive their issuer
+const (
+	issuerExpiryClamp  = "clamp"  // Shorten the certificate to end with the issuer
+	issuerExpiryRefuse = "refuse" // Refuse to issue the certificate
+)
+
+// warningOutput receives the warnings printed while issuing certificates
+var warningOutput io.Writer = os.Stderr
+
+// parseValidity parses a validity period given as a Go duration (e.g. 12h or
+// 90m) or in whole days with a d suffix (e.g. 30d)
+func parseValidity(s string) (time.Duration, error) {
+	var validity time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid validity %q (use a duration like 12h or days like 30d)", s)
+		}
+		if n > 825 {
+			return 0, fmt.Errorf("validity cannot exceed 825 days, got %q", s)
+		}
+		validity = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if validity, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid validity %q (use a duration like 12h or days like 30d)", s)
+		}
+	}
+
+	if validity <= 0 {
+		return 0, fmt.Errorf("validity must be positive, got %q", s)
+	}
+	if validity > maxLeafValidity {
+		return 0, fmt.Errorf("validity cannot exceed 825 days, got %q", s)
+	}
+	return validity, nil
+}
+
+// backdate returns how far issued certificates start before the time of
+// issuance
+func (cfg *Config) backdate() (time.Duration, error) {
+	if cfg.Backdate == "" {
+		return defaultBackdate, nil
+	}
+	backdate, err := time.ParseDuration(cfg.Backdate)
+	if err != nil || backdate < 0 || backdate > maxBackdate {
+		return 0, fmt.Errorf("backdate must be a duration between 0s and 168h, got '%s'", cfg.Backdate)
+	}
+	return backdate, nil
+}
+
+// certValidity returns the validity window of a certificate issued by
+// issuer. The window starts at -not-before, or at the time of issuance minus
+// the backdate. It ends at -not-after, or -validity or the profile validity
+// after the start (not counting the backdate). A window ending after the
+// issuer is clamped to the issuer's expiry with a warning, or refused when
+// issuer_expiry_policy is refuse. An expired issuer is always refused, as is
+// a clamped window that has already ended.
+func certValidity(opts CertOptions, profile ProfileConfig, issuer *x509.Certificate, cfg *Config) (time.Time, time.Time, error) {
+	if opts.Validity != 0 && !opts.NotAfter.IsZero() {
+		return time.Time{}, time.Time{}, fmt.Errorf("-validity and -not-after cannot be used together")
+	}
+
+	// Determine the start
+	backdate, err := cfg.backdate()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start := time.Now()
+	notBefore := start.Add(-backdate)
+	if !opts.NotBefore.IsZero() {
+		start, notBefore = opts.NotBefore, opts.NotBefore
+	}
+
+	// Determine the end
+	notAfter := opts.NotAfter
+	switch {
+	case !notAfter.IsZero():
+	case opts.Validity != 0:
+		notAfter = start.Add(opts.Validity)
+	default:
+		if notAfter, err = profile.notAfter(start, cfg); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if !notAfter.After(notBefore) {
+		return time.Time{}, time.Time{}, fmt.Errorf("not-after %s must be later than not-before %s", notAfter.Format(time.RFC3339), notBefore.Format(time.RFC3339))
+	}
+	if notAfter.Sub(start) > maxLeafValidity {
+		return time.Time{}, time.Time{}, fmt.Errorf("validity from %s to %s exceeds 825 days", start.Format(time.RFC3339), notAfter.Format(time.RFC3339))
+	}
+
+	// An expired issuer cannot issue, whatever the policy
+	now := time.Now()
+	if !issuer.NotAfter.After(now) {
+		return time.Time{}, time.Time{}, fmt.Errorf("issuer %q expired at %s; rotate it before issuing", issuer.Subject.CommonName, issuer.NotAfter.Format(time.RFC3339))
+	}
+
+	// Never outlive the issuer
+	if notAfter.After(issuer.NotAfter) {
+		if !notBefore.Before(issuer.NotAfter) {
+			return time.Time{}, time.Time{}, fmt.Errorf("issuer %q expires at %s, before the certificate would start", issuer.Subject.CommonName, issuer.NotAfter.Format(time.RFC3339))
+		}
+		if cfg.IssuerExpiryPolicy == issuerExpiryRefuse {
+			return time.Time{}, time.Time{}, fmt.Errorf("certificate would end at %s, after issuer %q expires at %s (issuer_expiry_policy: refuse)", notAfter.Format(time.RFC3339), issuer.Subject.CommonName, issuer.NotAfter.Format(time.RFC3339))
+		}
+		warn("validity_clamped", fmt.Sprintf("certificate validity shortened from %s to %s, when issuer %q expires", notAfter.Format(time.RFC3339), issuer.NotAfter.Format(time.RFC3339), issuer.Subject.CommonName), map[string]any{
+			"issuer_subject":      issuer.Subject.CommonName,
+			"requested_not_after": notAfter.Format(time.RFC3339),
+			"not_after":           issuer.NotAfter.Format(time.RFC3339),
+		})
+		notAfter = issuer.NotAfter
+		if !notAfter.After(now) {
+			return time.Time{}, time.Time{}, fmt.Errorf("certificate would already have expired at %s, when issuer %q expires", notAfter.Format(time.RFC3339), issuer.Subject.CommonName)
+		}
+	}
+	return notBefore, notAfter, nil
+}
+
+// warnIssuerExpiry warns when the named issuer expires within
+// issuer_expiry_warning_days, so it can be rotated before certificates
+// have to be shortened, or when it has already expired
+func warnIssuerExpiry(name string, issuer *x509.Certificate, cfg *Config) {
+	remaining := time.Until(issuer.NotAfter)
+	rotate := "certy -rotate-intermediate"
+	if name != defaultIssuerName {
+		rotate += " -issuer " + name
+	}
+	if remaining <= 0 {
+		warn("issuer_expired", fmt.Sprintf("issuer %q expired at %s; run '%s'", issuer.Subject.CommonName, issuer.NotAfter.Format(time.RFC3339), rotate), map[string]any{
+			"issuer":         name,
+			"issuer_subject": issuer.Subject.CommonName,
+			"not_after":      issuer.NotAfter.Format(time.RFC3339),
+		})
+		return
+	}
+	if cfg.ExpiryWarningDays == 0 || remaining > time.Duration(cfg.ExpiryWarningDays)*24*time.Hour {
+		return
+	}
+
+	days := int(remaining.Hours() / 24)
+	warn("issuer_expiring", fmt.Sprintf("issuer %q expires in %d days, at %s; run '%s'", issuer.Subject.CommonName, days, issuer.NotAfter.Format(time.RFC3339), rotate), map[string]any{
+		"issuer":         name,
+		"issuer_subject": issuer.Subject.CommonName,
+		"not_after":      issuer.NotAfter.Format(time.RFC3339),
+		"days_remaining": days,
+	})
+}
+
+// warn prints a warning for people, followed by the same warning as a JSON
+// line with a stable code for scripts and monitoring
+func warn(code, message string, fields map[string]any) {
+	fmt.Fprintf(warningOutput, "WARNING: %s\n", message)
+	record := map[string]any{"level": "warning", "code": code, "message": message}
+	maps.Copy(record, fields)
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(warningOutput, "%s\n", line)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseValidity(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"30d", 30 * 24 * time.Hour, false},
+		{"825d", maxLeafValidity, false},
+		{"826d", 0, true},
+		{"20000h", 0, true},
+		{"0s", 0, true},
+		{"-1h", 0, true},
+		{"1w", 0, true},
+		{"d", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseValidity(tt.input)
+		if tt.wantErr && err == nil {
+			t.Errorf("Expected error for %q", tt.input)
+		}
+		if !tt.wantErr && (err != nil || got != tt.want) {
+			t.Errorf("Expected %v for %q, got %v, %v", tt.want, tt.input, got, err)
+		}
+	}
+}
+
+func TestCertValidity(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+
+	warningOutput = io.Discard
+	defer func() { warningOutput = os.Stderr }()
+
+	// Configure a short-lived profile and no backdate
+	cfg := DefaultConfig()
+	cfg.Backdate = "0s"
+	cfg.Profiles = []ProfileConfig{{Name: "short", ExtKeyUsage: []string{"client_auth"}, Validity: "12h"}}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	explicitStart := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name          string
+		opts          CertOptions
+		wantLifetime  time.Duration
+		wantNotBefore time.Time
+		wantNotAfter  time.Time
+	}{
+		{"validity flag", CertOptions{Validity: 8 * time.Hour}, 8 * time.Hour, time.Time{}, time.Time{}},
+		{"profile validity", CertOptions{Profile: "short"}, 12 * time.Hour, time.Time{}, time.Time{}},
+		{"flag overrides profile", CertOptions{Profile: "short", Validity: time.Hour}, time.Hour, time.Time{}, time.Time{}},
+		{"explicit window", CertOptions{NotBefore: explicitStart, NotAfter: explicitStart.Add(36 * time.Hour)}, 36 * time.Hour, explicitStart, explicitStart.Add(36 * time.Hour)},
+		{"not-before with validity", CertOptions{NotBefore: explicitStart, Validity: 2 * time.Hour}, 2 * time.Hour, explicitStart, explicitStart.Add(2 * time.Hour)},
+		{"clamped to issuer", CertOptions{NotBefore: intCert.NotAfter.Add(-24 * time.Hour), Validity: 48 * time.Hour}, 0, time.Time{}, intCert.NotAfter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.CertFile = filepath.Join(tmpDir, "leaf.pem")
+			tt.opts.KeyFile = filepath.Join(tmpDir, "leaf-key.pem")
+			if _, _, err := generateCertificate([]string{"service.internal"}, CertTypeClient, tt.opts, cfg); err != nil {
+				t.Fatalf("Failed to generate certificate: %v", err)
+			}
+			cert := loadCertFromFile(t, tt.opts.CertFile)
+
+			if tt.wantLifetime != 0 && cert.NotAfter.Sub(cert.NotBefore) != tt.wantLifetime {
+				t.Errorf("Expected a lifetime of %v, got %v", tt.wantLifetime, cert.NotAfter.Sub(cert.NotBefore))
+			}
+			if !tt.wantNotBefore.IsZero() && !cert.NotBefore.Equal(tt.wantNotBefore) {
+				t.Errorf("Expected NotBefore %v, got %v", tt.wantNotBefore, cert.NotBefore)
+			}
+			if !tt.wantNotAfter.IsZero() && !cert.NotAfter.Equal(tt.wantNotAfter) {
+				t.Errorf("Expected NotAfter %v, got %v", tt.wantNotAfter, cert.NotAfter)
+			}
+			if cert.NotAfter.After(intCert.NotAfter) {
+				t.Errorf("Expected the certificate not to outlive the intermediate CA")
+			}
+		})
+	}
+
+	// Invalid windows are refused
+	invalid := []struct {
+		name   string
+		opts   CertOptions
+		errMsg string
+	}{
+		{"validity with not-after", CertOptions{Validity: time.Hour, NotAfter: explicitStart}, "cannot be used together"},
+		{"end before start", CertOptions{NotBefore: explicitStart, NotAfter: explicitStart.Add(-time.Hour)}, "must be later than"},
+		{"too long", CertOptions{NotBefore: explicitStart, NotAfter: explicitStart.AddDate(0, 0, 826)}, "exceeds 825 days"},
+		{"after issuer expiry", CertOptions{NotBefore: intCert.NotAfter.Add(time.Hour), Validity: time.Hour}, "before the certificate would start"},
+	}
+	for _, tt := range invalid {
+		tt.opts.CertFile = filepath.Join(tmpDir, "invalid.pem")
+		tt.opts.KeyFile = filepath.Join(tmpDir, "invalid-key.pem")
+		_, _, err := generateCertificate([]string{"service.internal"}, CertTypeClient, tt.opts, cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.errMsg, err)
+		}
+	}
+}
+
+func TestBackdate(t *testing.T) {
+	tests := []struct {
+		backdate string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"", defaultBackdate, false},
+		{"0s", 0, false},
+		{"5m", 5 * time.Minute, false},
+		{"168h", maxBackdate, false},
+		{"169h", 0, true},
+		{"-1h", 0, true},
+		{"1d", 0, true},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.Backdate = tt.backdate
+		got, err := cfg.backdate()
+		if tt.wantErr {
+			if err == nil || validateConfig(cfg) == nil {
+				t.Errorf("Expected error for backdate %q", tt.backdate)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Expected %v for backdate %q, got %v, %v", tt.want, tt.backdate, got, err)
+		}
+	}
+}
+
+func TestIssuerExpiryPolicy(t *testing.T) {
+	// Create temp directory
+	tmpDir := t.TempDir()
+	customCADir = tmpDir
+	defer func() { customCADir = "" }()
+	var warnings bytes.Buffer
+	warningOutput = &warnings
+	defer func() { warningOutput = os.Stderr }()
+
+	// Leaves outlive a one-year intermediate by default
+	cfg := DefaultConfig()
+	cfg.IntCAValidityDays = 365
+	cfg.DefaultValidityDays = 400
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := installCA(); err != nil {
+		t.Fatalf("Failed to install CA: %v", err)
+	}
+	intCert, err := loadCACertificate("intermediateCA")
+	if err != nil {
+		t.Fatalf("Failed to load intermediate CA: %v", err)
+	}
+
+	// The clamp policy shortens the certificate and says so
+	leaf := issueTestLeaf(t, tmpDir, "clamped", cfg)
+	if !leaf.NotAfter.Equal(intCert.NotAfter) {
+		t.Errorf("Expected NotAfter clamped to %v, got %v", intCert.NotAfter, leaf.NotAfter)
+	}
+	codes := warningCodes(t, warnings.String())
+	if len(codes) != 1 || codes[0]["code"] != "validity_clamped" {
+		t.Errorf("Expected a validity_clamped warning, got %v", codes)
+	}
+
+	// The refuse policy issues nothing and keeps the serial number
+	cfg.IssuerExpiryPolicy = issuerExpiryRefuse
+	serialBefore, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	opts := CertOptions{CertFile: filepath.Join(tmpDir, "refused.pem"), KeyFile: filepath.Join(tmpDir, "refused-key.pem")}
+	if _, _, err := generateCertificate([]string{"refused.example.com"}, CertTypeTLS, opts, cfg); err == nil || !strings.Contains(err.Error(), "issuer_expiry_policy") {
+		t.Errorf("Expected error from the refuse policy, got %v", err)
+	}
+	serialAfter, err := getSerialNumber()
+	if err != nil {
+		t.Fatalf("Failed to get serial number: %v", err)
+	}
+	if serialAfter != serialBefore+1 {
+		t.Errorf("Expected the refused certificate not to consume a serial number")
+	}
+
+	// Certificates ending before the issuer are still issued
+	opts.Validity = 30 * 24 * time.Hour
+	if _, _, err := generateCertificate([]string{"short.example.com"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Errorf("Expected a certificate within the issuer's validity, got %v", err)
+	}
+
+	// An intermediate within issuer_expiry_warning_days is reported
+	warnings.Reset()
+	cfg.ExpiryWarningDays = 400
+	if _, _, err := generateCertificate([]string{"short.example.com"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	if !strings.Contains(warnings.String(), "WARNING: issuer") {
+		t.Errorf("Expected a human-readable warning, got %q", warnings.String())
+	}
+	codes = warningCodes(t, warnings.String())
+	if len(codes) != 1 || codes[0]["code"] != "issuer_expiring" || codes[0]["issuer"] != defaultIssuerName {
+		t.Fatalf("Expected an issuer_expiring warning, got %v", codes)
+	}
+	if days, ok := codes[0]["days_remaining"].(float64); !ok || days < 363 || days > 365 {
+		t.Errorf("Expected about 364 days remaining, got %v", codes[0]["days_remaining"])
+	}
+
+	// Setting it to 0 disables the warning
+	warnings.Reset()
+	cfg.ExpiryWarningDays = 0
+	if _, _, err := generateCertificate([]string{"short.example.com"}, CertTypeTLS, opts, cfg); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	if warnings.Len() != 0 {
+		t.Errorf("Expected no warnings, got %q", warnings.String())
+	}
+}
+
+func TestExpiredIssuer(t *testing.T) {
+	var warnings bytes.Buffer
+	warningOutput = &warnings
+	defer func() { warningOutput = os.Stderr }()
+
+	// An issuer that expired after the backdated start of the certificate
+	issuer := &x509.Certificate{Subject: pkix.Name{CommonName: "Expired CA"}, NotAfter: time.Now().Add(-2 * time.Hour)}
+	for _, policy := range []string{issuerExpiryClamp, issuerExpiryRefuse} {
+		cfg := DefaultConfig()
+		cfg.IssuerExpiryPolicy = policy
+		if _, _, err := certValidity(CertOptions{}, ProfileConfig{}, issuer, cfg); err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Errorf("Expected an expired issuer to be refused with policy %s, got %v", policy, err)
+		}
+	}
+
+	// The warning reports it as expired, even with expiry warnings disabled
+	cfg := DefaultConfig()
+	cfg.ExpiryWarningDays = 0
+	warnIssuerExpiry(defaultIssuerName, issuer, cfg)
+	codes := warningCodes(t, warnings.String())
+	if len(codes) != 1 || codes[0]["code"] != "issuer_expired" {
+		t.Errorf("Expected an issuer_expired warning, got %v", codes)
+	}
+	if strings.Contains(warnings.String(), "expires in") {
+		t.Errorf("Expected no remaining days for an expired issuer, got %q", warnings.String())
+	}
+}
+
+func TestValidateIssuerExpiry(t *testing.T) {
+	tests := []struct {
+		policy  string
+		days    int
+		wantErr bool
+	}{
+		{"clamp", 90, false},
+		{"refuse", 0, false},
+		{"", 3650, false},
+		{"truncate", 90, true},
+		{"clamp", -1, true},
+		{"clamp", 3651, true},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.IssuerExpiryPolicy = tt.policy
+		cfg.ExpiryWarningDays = tt.days
+		err := validateConfig(cfg)
+		if tt.wantErr && err == nil {
+			t.Errorf("Expected validation error for policy %q and %d days", tt.policy, tt.days)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("Expected policy %q and %d days to be valid, got %v", tt.policy, tt.days, err)
+		}
+	}
+}
+
+// warningCodes parses the JSON lines of the warning output
+func warningCodes(t *testing.T, output string) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to parse warning %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}